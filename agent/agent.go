@@ -40,6 +40,9 @@ type Agent struct {
 
 	modules  *modules.Registry
 	executor *control.Executor
+	// certs is loaded on the first connection attempt and reloaded as the
+	// files change.
+	certs *security.CertReloader
 
 	metricsQueue chan api.MetricSample
 	resultQueue  chan *api.CommandResult
@@ -98,6 +101,7 @@ func New(cfg config.AgentConfig, logger zerolog.Logger) (*Agent, error) {
 			NodeID:  nodeID,
 			Basic:   basicInfo,
 			Modules: moduleRegistry.ModuleMetadata(),
+			Labels:  cfg.Labels,
 			At:      time.Now().UnixNano(),
 		},
 
@@ -140,10 +144,17 @@ func (a *Agent) Run(ctx context.Context) error {
 }
 
 func (a *Agent) runOnce(ctx context.Context) error {
-	tlsCfg, err := security.LoadClientTLSConfig(a.cfg.TLS)
-	if err != nil {
+	if err := a.ensureCertificate(ctx); err != nil {
 		return err
 	}
+	if a.certs == nil {
+		certs, err := security.NewClientCertReloader(a.cfg.TLS, a.log)
+		if err != nil {
+			return err
+		}
+		a.certs = certs
+	}
+	tlsCfg := a.certs.TLSConfig()
 
 	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
@@ -178,7 +189,7 @@ func (a *Agent) runOnce(ctx context.Context) error {
 	defer streamCancel()
 
 	var wg sync.WaitGroup
-	wg.Add(4)
+	wg.Add(5)
 
 	go func() {
 		defer wg.Done()
@@ -190,6 +201,11 @@ func (a *Agent) runOnce(ctx context.Context) error {
 		a.reportDroppedMetrics(streamCtx)
 	}()
 
+	go func() {
+		defer wg.Done()
+		a.renewLoop(streamCtx, client)
+	}()
+
 	errCh := make(chan error, 2)
 
 	go func() {
@@ -194,7 +194,7 @@ func (w *commandWorker) supersededResult(cmd *api.Command) *api.CommandResult {
 		NodeID:     w.dispatcher.nodeID,
 		Type:       commandType,
 		Success:    false,
-		Error:      "superseded by newer command of same type",
+		Error:      api.CommandErrorSuperseded,
 		FinishedAt: time.Now().UnixNano(),
 	}
 }
@@ -0,0 +1,283 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+)
+
+const (
+	enrollTimeout       = 30 * time.Second
+	renewRetryInterval  = time.Minute
+	maxEnrollReplyBytes = 1 << 20
+)
+
+// newKeyAndCSR generates a key and a certificate request for the node.
+func newKeyAndCSR(nodeID string) (keyPEM, csrPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: nodeID},
+	}, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create csr: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encode key: %w", err)
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	csrPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})
+	return keyPEM, csrPEM, nil
+}
+
+// parseFingerprint decodes a SHA-256 certificate fingerprint, with or without
+// the colons openssl prints.
+func parseFingerprint(raw string) ([]byte, error) {
+	clean := strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(raw))
+	sum, err := hex.DecodeString(clean)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("enrollment.ca_fingerprint must be a SHA-256 fingerprint (%d hex bytes)", sha256.Size)
+	}
+	return sum, nil
+}
+
+// pinnedCA returns the certificates of a CA bundle whose SHA-256 fingerprint
+// is pin, as PEM. Other certificates in the bundle are dropped.
+func pinnedCA(bundle []byte, pin []byte) ([]byte, error) {
+	var out []byte
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if sum := sha256.Sum256(block.Bytes); bytes.Equal(sum[:], pin) {
+			out = append(out, pem.EncodeToMemory(block)...)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no certificate in the server's ca_pem matches enrollment.ca_fingerprint")
+	}
+	return out, nil
+}
+
+// readLeaf returns the first certificate of a PEM file.
+func readLeaf(path string) (*x509.Certificate, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no PEM certificate", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// storeCertificate replaces the agent's key and certificate. The key goes
+// first: a reload between the two renames fails on the mismatched pair and
+// keeps the previous one until the certificate lands.
+func (a *Agent) storeCertificate(keyPEM, certPEM []byte) error {
+	if err := writeFileAtomic(a.cfg.TLS.KeyFile, keyPEM, 0o600); err != nil {
+		return fmt.Errorf("write tls key: %w", err)
+	}
+	if err := writeFileAtomic(a.cfg.TLS.CertFile, certPEM, 0o644); err != nil {
+		return fmt.Errorf("write tls cert: %w", err)
+	}
+	return nil
+}
+
+// ensureCertificate enrolls the agent when enrollment is configured and it
+// has no usable certificate.
+func (a *Agent) ensureCertificate(ctx context.Context) error {
+	cfg := a.cfg.Enrollment
+	if cfg.ServerURL == "" {
+		return nil
+	}
+	leaf, err := readLeaf(a.cfg.TLS.CertFile)
+	if err == nil && time.Now().Before(leaf.NotAfter) {
+		return nil
+	}
+	if cfg.Token == "" {
+		return fmt.Errorf("tls.cert_file is missing or expired and enrollment.token is empty")
+	}
+	// The token and the CA travel in this exchange, so it must not happen in
+	// the clear, and the CA is only taken from the server when it is pinned.
+	if u, err := url.Parse(cfg.ServerURL); err != nil || u.Scheme != "https" {
+		return fmt.Errorf("enrollment.server_url %q must be an https URL", cfg.ServerURL)
+	}
+	_, err = os.Stat(a.cfg.TLS.CAFile)
+	haveCA := err == nil
+	var pin []byte
+	if !haveCA {
+		if cfg.CAFingerprint == "" {
+			return fmt.Errorf("enrollment needs tls.ca_file provisioned or enrollment.ca_fingerprint set")
+		}
+		if pin, err = parseFingerprint(cfg.CAFingerprint); err != nil {
+			return err
+		}
+	}
+	a.log.Info().Str("server_url", cfg.ServerURL).Msg("enrolling agent")
+
+	keyPEM, csrPEM, err := newKeyAndCSR(a.nodeID)
+	if err != nil {
+		return err
+	}
+	body, err := proto.Marshal(&pb.EnrollRequest{Token: cfg.Token, NodeId: a.nodeID, CsrPem: string(csrPEM)})
+	if err != nil {
+		return fmt.Errorf("encode enroll request: %w", err)
+	}
+	reqCtx, cancel := context.WithTimeout(ctx, enrollTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, strings.TrimRight(cfg.ServerURL, "/")+"/api/enroll", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("enroll: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	resp, err := a.enrollClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("enroll: %w", err)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxEnrollReplyBytes))
+	if err != nil {
+		return fmt.Errorf("enroll: read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr pb.ErrorResponse
+		if proto.Unmarshal(raw, &apiErr) == nil && apiErr.GetError() != "" {
+			return fmt.Errorf("enroll: %s: %s", resp.Status, apiErr.GetError())
+		}
+		return fmt.Errorf("enroll: %s", resp.Status)
+	}
+	var reply pb.EnrollResponse
+	if err := proto.Unmarshal(raw, &reply); err != nil {
+		return fmt.Errorf("enroll: decode response: %w", err)
+	}
+
+	if !haveCA {
+		caPEM, err := pinnedCA([]byte(reply.GetCaPem()), pin)
+		if err != nil {
+			return fmt.Errorf("enroll: %w", err)
+		}
+		if err := writeFileAtomic(a.cfg.TLS.CAFile, caPEM, 0o644); err != nil {
+			return fmt.Errorf("write tls ca: %w", err)
+		}
+	}
+	if err := a.storeCertificate(keyPEM, []byte(reply.GetCertificatePem())); err != nil {
+		return err
+	}
+	a.log.Info().Time("expires_at", time.Unix(0, reply.GetExpiresAtUnixNano())).Msg("agent enrolled")
+	return nil
+}
+
+// enrollClient trusts tls.ca_file, when there is one yet, and otherwise the
+// system roots for the https server_url.
+func (a *Agent) enrollClient() *http.Client {
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: a.cfg.TLS.ServerNameOverride}
+	if caPEM, err := os.ReadFile(a.cfg.TLS.CAFile); err == nil {
+		pool := x509.NewCertPool()
+		if pool.AppendCertsFromPEM(caPEM) {
+			tlsCfg.RootCAs = pool
+		}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg, Proxy: http.ProxyFromEnvironment}}
+}
+
+// renewAt is when a certificate should be renewed.
+func (a *Agent) renewAt(leaf *x509.Certificate) time.Time {
+	if before := a.cfg.Enrollment.RenewBefore; before > 0 {
+		return leaf.NotAfter.Add(-before)
+	}
+	return leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) * 2 / 3)
+}
+
+// renewLoop renews the agent's certificate over the server connection
+// before it expires, for as long as the stream lasts.
+func (a *Agent) renewLoop(ctx context.Context, client pb.TelemetryServiceClient) {
+	if a.cfg.Enrollment.ServerURL == "" {
+		return
+	}
+	for {
+		wait := renewRetryInterval
+		if leaf, err := readLeaf(a.cfg.TLS.CertFile); err != nil {
+			a.log.Error().Err(err).Msg("read tls cert for renewal")
+		} else {
+			wait = time.Until(a.renewAt(leaf))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if wait > 0 {
+			// Re-read the certificate: it may have been replaced meanwhile.
+			continue
+		}
+		if err := a.renewCertificate(ctx, client); err != nil {
+			a.log.Error().Err(err).Dur("retry_in", renewRetryInterval).Msg("renew tls cert")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(renewRetryInterval):
+			}
+		}
+	}
+}
+
+func (a *Agent) renewCertificate(ctx context.Context, client pb.TelemetryServiceClient) error {
+	keyPEM, csrPEM, err := newKeyAndCSR(a.nodeID)
+	if err != nil {
+		return err
+	}
+	callCtx, cancel := context.WithTimeout(ctx, enrollTimeout)
+	defer cancel()
+	reply, err := client.RenewCertificate(callCtx, &pb.RenewCertificateRequest{CsrPem: string(csrPEM)})
+	if err != nil {
+		return err
+	}
+	if err := a.storeCertificate(keyPEM, []byte(reply.GetCertificatePem())); err != nil {
+		return err
+	}
+	a.log.Info().Time("expires_at", time.Unix(0, reply.GetExpiresAtUnixNano())).Msg("tls cert renewed")
+	return nil
+}
@@ -30,13 +30,17 @@ type uncoreDomain struct {
 }
 
 type raplZone struct {
-	packageID        int
-	energyPath       string
-	powerCapPath     string
-	maxPowerPath     string
-	dramEnergyPath   string
-	dramPowerCapPath string
-	dramMaxPowerPath string
+	packageID            int
+	energyPath           string
+	maxEnergyRangePath   string
+	powerCapPath         string
+	maxPowerPath         string
+	dramEnergyPath       string
+	dramMaxEnergyPath    string
+	dramPowerCapPath     string
+	dramMaxPowerPath     string
+	maxEnergyRangeMicroJ uint64
+	dramMaxEnergyMicroJ  uint64
 }
 
 type coreTick struct {
@@ -246,10 +250,11 @@ func discoverRAPLZones() map[int]raplZone {
 			continue
 		}
 		zone := raplZone{
-			packageID:    pkgID,
-			energyPath:   filepath.Join(base, "energy_uj"),
-			powerCapPath: filepath.Join(base, "constraint_0_power_limit_uw"),
-			maxPowerPath: filepath.Join(base, "constraint_0_max_power_uw"),
+			packageID:          pkgID,
+			energyPath:         filepath.Join(base, "energy_uj"),
+			maxEnergyRangePath: filepath.Join(base, "max_energy_range_uj"),
+			powerCapPath:       filepath.Join(base, "constraint_0_power_limit_uw"),
+			maxPowerPath:       filepath.Join(base, "constraint_0_max_power_uw"),
 		}
 		attachDramSubzoneFromPackageBase(base, name, &zone)
 		zones[pkgID] = zone
@@ -311,6 +316,7 @@ func attachDramSubzonePaths(base string, zone *raplZone) bool {
 		return false
 	}
 	zone.dramEnergyPath = filepath.Join(base, "energy_uj")
+	zone.dramMaxEnergyPath = filepath.Join(base, "max_energy_range_uj")
 	zone.dramPowerCapPath = filepath.Join(base, "constraint_0_power_limit_uw")
 	zone.dramMaxPowerPath = filepath.Join(base, "constraint_0_max_power_uw")
 	return true
@@ -127,6 +127,9 @@ func toPBUltraMetrics(v *UltraMetrics) *cpupb.UltraMetrics {
 			DramEnergyMicroJ:   r.DramEnergyMicroJ,
 			DramPowerCapMicroW: r.DramPowerCapMicroW,
 			SampledAtUnixNano:  r.SampledAtNano,
+
+			MaxEnergyRangeMicroJ:     r.MaxEnergyRangeMicroJ,
+			DramMaxEnergyRangeMicroJ: r.DramMaxEnergyRangeMicroJ,
 		})
 	}
 	for _, u := range v.Uncore {
@@ -54,6 +54,15 @@ func newIntelRAPLBackend() *intelRAPLBackend {
 	if len(zones) == 0 {
 		return nil
 	}
+	// The wrap range is fixed per zone; read it once so consumers can tell a
+	// wrapped energy counter from a reset.
+	for pkgID, zone := range zones {
+		zone.maxEnergyRangeMicroJ, _ = readUint(zone.maxEnergyRangePath)
+		if zone.dramMaxEnergyPath != "" {
+			zone.dramMaxEnergyMicroJ, _ = readUint(zone.dramMaxEnergyPath)
+		}
+		zones[pkgID] = zone
+	}
 	return &intelRAPLBackend{zones: zones}
 }
 
@@ -90,6 +99,9 @@ func (b *intelRAPLBackend) ReadAll() []PackageRAPL {
 			DramEnergyMicroJ:   dramEnergy,
 			DramPowerCapMicroW: dramCap,
 			SampledAtNano:      sampledAt,
+
+			MaxEnergyRangeMicroJ:     zone.maxEnergyRangeMicroJ,
+			DramMaxEnergyRangeMicroJ: zone.dramMaxEnergyMicroJ,
 		})
 	}
 	return out
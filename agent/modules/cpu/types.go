@@ -94,7 +94,11 @@ type PackageRAPL struct {
 	PowerCapMicroW     uint64
 	DramEnergyMicroJ   uint64
 	DramPowerCapMicroW uint64
-	SampledAtNano      int64
+	// Energy counters wrap to zero after the max energy range; 0 means the
+	// range is unknown.
+	MaxEnergyRangeMicroJ     uint64
+	DramMaxEnergyRangeMicroJ uint64
+	SampledAtNano            int64
 }
 
 type PackageTemperature struct {
@@ -18,6 +18,10 @@ const (
 type MetricCategory string
 type CommandType string
 
+// CommandErrorSuperseded is the error of a command the agent dropped because
+// a newer command of the same type was queued behind it.
+const CommandErrorSuperseded = "superseded by newer command of same type"
+
 type AgentMessage struct {
 	Kind         MessageKind
 	Registration *Registration
@@ -36,6 +40,7 @@ type Registration struct {
 	NodeID  string
 	Basic   BasicInfo
 	Modules map[string]any
+	Labels  map[string]string
 	At      int64
 }
 
@@ -69,11 +74,12 @@ type BasicInfo struct {
 }
 
 type Command struct {
-	ID       string
-	NodeID   string
-	Type     CommandType
-	IssuedAt int64
-	Payload  any
+	ID        string
+	NodeID    string
+	Type      CommandType
+	IssuedAt  int64
+	DeliverBy int64
+	Payload   any
 }
 
 type CommandResult struct {
@@ -93,6 +99,12 @@ type ServerAck struct {
 type NodeSnapshot struct {
 	NodeID       string
 	Connected    bool
+	Stale        bool
+	Cordoned     bool
+	CordonReason string
+	CordonedAt   int64
+	Annotations  map[string]string
+	Labels       map[string]string
 	LastSeen     int64
 	SourceIP     string
 	Registration *Registration
@@ -21,6 +21,12 @@ const (
 	categoryNetwork    = "network"
 	categoryInfiniBand = "infiniband"
 	categoryProcess    = "process"
+
+	// Derived categories are computed by the server from counter samples.
+	categoryCPUPower       = "cpu_power"
+	categoryNetworkRate    = "network_rate"
+	categoryStorageRate    = "storage_rate"
+	categoryInfiniBandRate = "infiniband_rate"
 )
 
 const (
@@ -142,6 +148,7 @@ func toPBRegistration(v *Registration) *transportpb.Registration {
 		Basic:      toPBBasicInfo(v.Basic),
 		Modules:    modules,
 		AtUnixNano: v.At,
+		Labels:     v.Labels,
 	}
 }
 
@@ -164,6 +171,7 @@ func fromPBRegistration(v *transportpb.Registration) *Registration {
 		NodeID:  v.GetNodeId(),
 		Basic:   fromPBBasicInfo(v.GetBasic()),
 		Modules: modules,
+		Labels:  v.GetLabels(),
 		At:      v.GetAtUnixNano(),
 	}
 }
@@ -347,6 +355,10 @@ func setPBMetricPayload(out *transportpb.MetricSample, payload any) {
 		if v, ok := decodeAs[processpb.Metrics](payload); ok {
 			out.Payload = &transportpb.MetricSample_ProcessMetrics{ProcessMetrics: v}
 		}
+	case categoryCPUPower, categoryNetworkRate, categoryStorageRate, categoryInfiniBandRate:
+		if v, ok := decodeAs[transportpb.DerivedMetrics](payload); ok {
+			out.Payload = &transportpb.MetricSample_DerivedMetrics{DerivedMetrics: v}
+		}
 	}
 }
 
@@ -371,6 +383,8 @@ func fromPBMetricPayload(v *transportpb.MetricSample) any {
 		return payload.InfinibandMetrics
 	case *transportpb.MetricSample_ProcessMetrics:
 		return payload.ProcessMetrics
+	case *transportpb.MetricSample_DerivedMetrics:
+		return payload.DerivedMetrics
 	default:
 		return nil
 	}
@@ -380,7 +394,7 @@ func toPBCommand(v *Command) *transportpb.Command {
 	if v == nil {
 		return nil
 	}
-	out := &transportpb.Command{Id: v.ID, NodeId: v.NodeID, Type: string(v.Type), IssuedAtUnixNano: v.IssuedAt}
+	out := &transportpb.Command{Id: v.ID, NodeId: v.NodeID, Type: string(v.Type), IssuedAtUnixNano: v.IssuedAt, DeliverByUnixNano: v.DeliverBy}
 	switch out.GetType() {
 	case commandCPUScalingRange:
 		if payload, ok := decodeAs[cpupb.ScalingRangeCommand](v.Payload); ok {
@@ -426,7 +440,7 @@ func fromPBCommand(v *transportpb.Command) *Command {
 	if v == nil {
 		return nil
 	}
-	out := &Command{ID: v.GetId(), NodeID: v.GetNodeId(), Type: CommandType(v.GetType()), IssuedAt: v.GetIssuedAtUnixNano()}
+	out := &Command{ID: v.GetId(), NodeID: v.GetNodeId(), Type: CommandType(v.GetType()), IssuedAt: v.GetIssuedAtUnixNano(), DeliverBy: v.GetDeliverByUnixNano()}
 	switch payload := v.Payload.(type) {
 	case *transportpb.Command_CpuScalingRange:
 		out.Payload = payload.CpuScalingRange
@@ -23,7 +23,10 @@ func main() {
 	logger := logging.New(cfg.Log, "telemetry-server")
 	logger.Info().Str("config_path", *cfgPath).Msg("server starting")
 
-	srv := server.New(cfg, logger)
+	srv, err := server.New(cfg, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("init server")
+	}
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
@@ -8,11 +8,18 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+// TLSConfig locates the certificates of one side of the agent connection.
+// The files are re-read when they change, checked every ReloadInterval.
+// Peer certificates listed in CRLFile (PEM or DER, signed by a CA in CAFile)
+// or RevokedSerialsFile (one hex serial number per line) are rejected.
 type TLSConfig struct {
-	CAFile             string `yaml:"ca_file"`
-	CertFile           string `yaml:"cert_file"`
-	KeyFile            string `yaml:"key_file"`
-	ServerNameOverride string `yaml:"server_name_override"`
+	CAFile             string        `yaml:"ca_file"`
+	CertFile           string        `yaml:"cert_file"`
+	KeyFile            string        `yaml:"key_file"`
+	ServerNameOverride string        `yaml:"server_name_override"`
+	CRLFile            string        `yaml:"crl_file"`
+	RevokedSerialsFile string        `yaml:"revoked_serials_file"`
+	ReloadInterval     time.Duration `yaml:"reload_interval"`
 }
 
 type LogConfig struct {
@@ -20,30 +27,255 @@ type LogConfig struct {
 	Format string `yaml:"format"`
 }
 
+type StorageConfig struct {
+	Backend         string        `yaml:"backend"`
+	Path            string        `yaml:"path"`
+	Partition       time.Duration `yaml:"partition"`
+	WALSyncInterval time.Duration `yaml:"wal_sync_interval"`
+}
+
+type RollupTierConfig struct {
+	Resolution time.Duration `yaml:"resolution"`
+	Retention  time.Duration `yaml:"retention"`
+}
+
+// ExportQueueConfig tunes batching and retries of a push exporter. A negative
+// MaxRetries disables retries.
+type ExportQueueConfig struct {
+	Timeout       time.Duration `yaml:"timeout"`
+	QueueSize     int           `yaml:"queue_size"`
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	MaxRetries    int           `yaml:"max_retries"`
+	RetryBackoff  time.Duration `yaml:"retry_backoff"`
+}
+
+// OTLPConfig configures pushing ingested samples to an OpenTelemetry
+// collector. Endpoint is host:port for grpc and a full URL for http.
+type OTLPConfig struct {
+	Enabled           bool              `yaml:"enabled"`
+	Protocol          string            `yaml:"protocol"`
+	Endpoint          string            `yaml:"endpoint"`
+	Insecure          bool              `yaml:"insecure"`
+	CAFile            string            `yaml:"ca_file"`
+	Headers           map[string]string `yaml:"headers"`
+	Categories        []string          `yaml:"categories"`
+	ExportQueueConfig `yaml:",inline"`
+}
+
+// SinkConfig configures a push sink. Type is "influxdb" (line protocol, URL
+// of the write endpoint including db/bucket parameters) or "remote_write"
+// (Prometheus remote-write URL). An empty Categories list forwards all.
+type SinkConfig struct {
+	Name              string            `yaml:"name"`
+	Type              string            `yaml:"type"`
+	URL               string            `yaml:"url"`
+	CAFile            string            `yaml:"ca_file"`
+	Headers           map[string]string `yaml:"headers"`
+	Categories        []string          `yaml:"categories"`
+	ExportQueueConfig `yaml:",inline"`
+}
+
+type ExportersConfig struct {
+	OTLP  OTLPConfig   `yaml:"otlp"`
+	Sinks []SinkConfig `yaml:"sinks"`
+}
+
+// AlertRuleConfig is one alerting rule. Type "threshold" (default) compares
+// Metric, the dotted field path of a Category payload such as
+// "devices.temperature_c", optionally divided by the sum of DivideBy; type
+// "heartbeat" compares the seconds since a node was last heard from. The
+// condition must hold for For before the alert fires, and a firing alert
+// resolves only once the value no longer passes ClearThreshold, which
+// defaults to Threshold.
+type AlertRuleConfig struct {
+	Name           string            `yaml:"name"`
+	Type           string            `yaml:"type"`
+	Category       string            `yaml:"category"`
+	Metric         string            `yaml:"metric"`
+	DivideBy       []string          `yaml:"divide_by"`
+	Op             string            `yaml:"op"`
+	Threshold      float64           `yaml:"threshold"`
+	ClearThreshold *float64          `yaml:"clear_threshold"`
+	For            time.Duration     `yaml:"for"`
+	Nodes          []string          `yaml:"nodes"`
+	Severity       string            `yaml:"severity"`
+	Labels         map[string]string `yaml:"labels"`
+	Annotations    map[string]string `yaml:"annotations"`
+}
+
+// WebhookConfig is an HTTP endpoint that receives alert state changes as
+// JSON. A negative MaxRetries disables retries.
+type WebhookConfig struct {
+	Name         string            `yaml:"name"`
+	URL          string            `yaml:"url"`
+	CAFile       string            `yaml:"ca_file"`
+	Headers      map[string]string `yaml:"headers"`
+	Timeout      time.Duration     `yaml:"timeout"`
+	QueueSize    int               `yaml:"queue_size"`
+	MaxRetries   int               `yaml:"max_retries"`
+	RetryBackoff time.Duration     `yaml:"retry_backoff"`
+}
+
+// AlertingConfig holds the alert rules, given inline and/or in RulesFile (a
+// YAML document with a top-level "rules" list), and the webhooks notified
+// when alerts fire or resolve.
+type AlertingConfig struct {
+	RulesFile         string            `yaml:"rules_file"`
+	Rules             []AlertRuleConfig `yaml:"rules"`
+	EvalInterval      time.Duration     `yaml:"eval_interval"`
+	ResolvedRetention time.Duration     `yaml:"resolved_retention"`
+	Webhooks          []WebhookConfig   `yaml:"webhooks"`
+}
+
+// ReaperConfig controls stale-node detection. A connected node that sends
+// neither heartbeats nor metrics for StaleAfter heartbeat intervals is marked
+// stale and its session is closed. Nodes without a session are forgotten
+// once they have been silent for EvictAfter, though their history stays
+// queryable until retention; a negative EvictAfter keeps them.
+type ReaperConfig struct {
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+	StaleAfter        int           `yaml:"stale_after"`
+	CheckInterval     time.Duration `yaml:"check_interval"`
+	EvictAfter        time.Duration `yaml:"evict_after"`
+}
+
+// PowerBudgetConfig caps the combined power of a node group, chosen by Nodes
+// and/or Selector (their intersection when both are set).
+type PowerBudgetConfig struct {
+	Name        string   `yaml:"name"`
+	Nodes       []string `yaml:"nodes"`
+	Selector    string   `yaml:"selector"`
+	BudgetWatts float64  `yaml:"budget_watts"`
+}
+
+// PowerConfig drives the power budget controller, which reassigns CPU
+// package and GPU power caps of each group every Interval. Caps move only
+// when they change by at least MinChangeWatts.
+type PowerConfig struct {
+	Interval       time.Duration       `yaml:"interval"`
+	MinChangeWatts float64             `yaml:"min_change_watts"`
+	Budgets        []PowerBudgetConfig `yaml:"budgets"`
+}
+
+// OfflineCommandsConfig bounds the commands held for offline nodes until
+// their deliver_by time: how far ahead deliver_by may be and how many
+// commands one node may have waiting.
+type OfflineCommandsConfig struct {
+	MaxTTL     time.Duration `yaml:"max_ttl"`
+	MaxPerNode int           `yaml:"max_per_node"`
+}
+
+// AuditConfig locates the command audit log, a JSON Lines file that is only
+// ever appended to. An empty Path keeps it under storage.path.
+type AuditConfig struct {
+	Path string `yaml:"path"`
+}
+
+// AuthConfig guards the HTTP API and websocket. TokensFile lists the API
+// tokens by the SHA-256 of their value, each with a role; when it is empty
+// the API is open to anyone who can reach http_listen. AllowedOrigins are
+// the browser origins (scheme://host[:port], or "*" for any) that may open a
+// websocket besides the server's own.
+type AuthConfig struct {
+	TokensFile     string   `yaml:"tokens_file"`
+	AllowedOrigins []string `yaml:"allowed_origins"`
+}
+
+// NodeIdentityConfig binds the node_id an agent registers with to its client
+// certificate. Mode is enforce (reject mismatches), audit (only log and
+// audit them; the default, so that agents sharing one certificate keep
+// connecting after an upgrade) or off. A certificate matches a node when its CN or one of its
+// DNS or URI SANs equals Template with {node_id} replaced by the node ID.
+// Allow lists, per certificate name, the node IDs (path.Match patterns) it
+// may register besides, for certificates shared by several nodes.
+type NodeIdentityConfig struct {
+	Mode     string              `yaml:"mode"`
+	Template string              `yaml:"template"`
+	Allow    map[string][]string `yaml:"allow"`
+}
+
+// EnrollmentConfig lets agents trade a one-time bootstrap token for a client
+// certificate signed by the CA in CACertFile/CAKeyFile, usually an
+// intermediate of the CA in tls.ca_file. Certificates are valid for CertTTL
+// and tokens, unless created with an expiry, for TokenTTL. Enrollment is
+// disabled without CACertFile.
+type EnrollmentConfig struct {
+	CACertFile string        `yaml:"ca_cert_file"`
+	CAKeyFile  string        `yaml:"ca_key_file"`
+	CertTTL    time.Duration `yaml:"cert_ttl"`
+	TokenTTL   time.Duration `yaml:"token_ttl"`
+}
+
+// HTTPTLSConfig serves http_listen over HTTPS when CertFile is set. CAFile,
+// if set, verifies client certificates, which ClientAuth makes optional
+// (default) or required; ClientRoles maps a verified certificate's CN or a
+// DNS, URI or email SAN to an API role (viewer, operator or admin).
+// RedirectListen serves plain HTTP redirects to the HTTPS listener, and
+// HSTSMaxAge, when positive, sets Strict-Transport-Security on responses.
+type HTTPTLSConfig struct {
+	TLSConfig      `yaml:",inline"`
+	ClientAuth     string            `yaml:"client_auth"`
+	ClientRoles    map[string]string `yaml:"client_roles"`
+	RedirectListen string            `yaml:"redirect_listen"`
+	HSTSMaxAge     time.Duration     `yaml:"hsts_max_age"`
+}
+
 type ServerConfig struct {
-	GRPCListen        string        `yaml:"grpc_listen"`
-	HTTPListen        string        `yaml:"http_listen"`
-	Retention         time.Duration `yaml:"retention"`
-	MaxSamplesPerNode int           `yaml:"max_samples_per_node"`
-	IngestQueueSize   int           `yaml:"ingest_queue_size"`
-	PerNodeQueueSize  int           `yaml:"per_node_queue_size"`
-	CommandTimeout    time.Duration `yaml:"command_timeout"`
-	HTTPReadTimeout   time.Duration `yaml:"http_read_timeout"`
-	HTTPWriteTimeout  time.Duration `yaml:"http_write_timeout"`
-	HTTPIdleTimeout   time.Duration `yaml:"http_idle_timeout"`
-	Log               LogConfig     `yaml:"log"`
-	TLS               TLSConfig     `yaml:"tls"`
+	GRPCListen        string                `yaml:"grpc_listen"`
+	HTTPListen        string                `yaml:"http_listen"`
+	Retention         time.Duration         `yaml:"retention"`
+	MaxSamplesPerNode int                   `yaml:"max_samples_per_node"`
+	IngestQueueSize   int                   `yaml:"ingest_queue_size"`
+	PerNodeQueueSize  int                   `yaml:"per_node_queue_size"`
+	CommandTimeout    time.Duration         `yaml:"command_timeout"`
+	CommandFanout     int                   `yaml:"command_fanout"`
+	CommandHistory    int                   `yaml:"command_history"`
+	HTTPReadTimeout   time.Duration         `yaml:"http_read_timeout"`
+	HTTPWriteTimeout  time.Duration         `yaml:"http_write_timeout"`
+	HTTPIdleTimeout   time.Duration         `yaml:"http_idle_timeout"`
+	HTTPTLS           HTTPTLSConfig         `yaml:"http_tls"`
+	Storage           StorageConfig         `yaml:"storage"`
+	Rollups           []RollupTierConfig    `yaml:"rollups"`
+	Exporters         ExportersConfig       `yaml:"exporters"`
+	Alerting          AlertingConfig        `yaml:"alerting"`
+	Reaper            ReaperConfig          `yaml:"reaper"`
+	Audit             AuditConfig           `yaml:"audit"`
+	Power             PowerConfig           `yaml:"power"`
+	OfflineCommands   OfflineCommandsConfig `yaml:"offline_commands"`
+	Auth              AuthConfig            `yaml:"auth"`
+	NodeIdentity      NodeIdentityConfig    `yaml:"node_identity"`
+	Enrollment        EnrollmentConfig      `yaml:"enrollment"`
+	Log               LogConfig             `yaml:"log"`
+	TLS               TLSConfig             `yaml:"tls"`
+}
+
+// AgentEnrollmentConfig has the agent enroll at ServerURL (the server's
+// http_listen, which must be https) with a bootstrap Token when
+// tls.cert_file does not exist or has expired, writing the issued
+// certificate and its key to tls.cert_file and tls.key_file. tls.ca_file
+// must be provisioned beforehand, or else is written from the server's reply
+// with only the certificate whose SHA-256 fingerprint is CAFingerprint. The
+// certificate is renewed over the agent connection RenewBefore its expiry,
+// by default once two thirds of its lifetime have passed.
+type AgentEnrollmentConfig struct {
+	ServerURL     string        `yaml:"server_url"`
+	Token         string        `yaml:"token"`
+	CAFingerprint string        `yaml:"ca_fingerprint"`
+	RenewBefore   time.Duration `yaml:"renew_before"`
 }
 
 type AgentConfig struct {
-	NodeID           string        `yaml:"node_id"`
-	ServerAddress    string        `yaml:"server_address"`
-	ReconnectBackoff time.Duration `yaml:"reconnect_backoff"`
-	SendQueueSize    int           `yaml:"send_queue_size"`
-	ControlTimeout   time.Duration `yaml:"control_timeout"`
-	Report           ReportConfig  `yaml:"report"`
-	Log              LogConfig     `yaml:"log"`
-	TLS              TLSConfig     `yaml:"tls"`
+	NodeID           string                `yaml:"node_id"`
+	Labels           map[string]string     `yaml:"labels"`
+	ServerAddress    string                `yaml:"server_address"`
+	ReconnectBackoff time.Duration         `yaml:"reconnect_backoff"`
+	SendQueueSize    int                   `yaml:"send_queue_size"`
+	ControlTimeout   time.Duration         `yaml:"control_timeout"`
+	Report           ReportConfig          `yaml:"report"`
+	Log              LogConfig             `yaml:"log"`
+	TLS              TLSConfig             `yaml:"tls"`
+	Enrollment       AgentEnrollmentConfig `yaml:"enrollment"`
 }
 
 type ReportConfig struct {
@@ -73,9 +305,54 @@ func DefaultServerConfig() ServerConfig {
 		IngestQueueSize:   16384,
 		PerNodeQueueSize:  4096,
 		CommandTimeout:    15 * time.Second,
+		CommandFanout:     32,
+		CommandHistory:    1000,
 		HTTPReadTimeout:   10 * time.Second,
 		HTTPWriteTimeout:  15 * time.Second,
 		HTTPIdleTimeout:   30 * time.Second,
+		Storage: StorageConfig{
+			Backend:         "memory",
+			Path:            "data",
+			Partition:       15 * time.Minute,
+			WALSyncInterval: time.Second,
+		},
+		Rollups: []RollupTierConfig{
+			{Resolution: time.Second, Retention: time.Hour},
+			{Resolution: time.Minute, Retention: 7 * 24 * time.Hour},
+			{Resolution: time.Hour, Retention: 90 * 24 * time.Hour},
+		},
+		Exporters: ExportersConfig{
+			OTLP: OTLPConfig{
+				Protocol:          "grpc",
+				ExportQueueConfig: defaultExportQueueConfig(),
+			},
+		},
+		Alerting: AlertingConfig{
+			EvalInterval:      time.Second,
+			ResolvedRetention: 15 * time.Minute,
+		},
+		Reaper: ReaperConfig{
+			HeartbeatInterval: 2 * time.Second,
+			StaleAfter:        5,
+			CheckInterval:     time.Second,
+			EvictAfter:        24 * time.Hour,
+		},
+		OfflineCommands: OfflineCommandsConfig{
+			MaxTTL:     24 * time.Hour,
+			MaxPerNode: 100,
+		},
+		Power: PowerConfig{
+			Interval:       10 * time.Second,
+			MinChangeWatts: 5,
+		},
+		NodeIdentity: NodeIdentityConfig{
+			Mode:     "audit",
+			Template: "{node_id}",
+		},
+		Enrollment: EnrollmentConfig{
+			CertTTL:  30 * 24 * time.Hour,
+			TokenTTL: 24 * time.Hour,
+		},
 		Log: LogConfig{
 			Level:  "info",
 			Format: "console",
@@ -83,6 +360,17 @@ func DefaultServerConfig() ServerConfig {
 	}
 }
 
+func defaultExportQueueConfig() ExportQueueConfig {
+	return ExportQueueConfig{
+		Timeout:       10 * time.Second,
+		QueueSize:     1024,
+		BatchSize:     512,
+		FlushInterval: 5 * time.Second,
+		MaxRetries:    5,
+		RetryBackoff:  time.Second,
+	}
+}
+
 func DefaultAgentConfig() AgentConfig {
 	return AgentConfig{
 		ServerAddress:    "127.0.0.1:9443",
@@ -166,6 +454,12 @@ func applyServerDefaults(cfg *ServerConfig) {
 	if cfg.CommandTimeout <= 0 {
 		cfg.CommandTimeout = d.CommandTimeout
 	}
+	if cfg.CommandFanout <= 0 {
+		cfg.CommandFanout = d.CommandFanout
+	}
+	if cfg.CommandHistory <= 0 {
+		cfg.CommandHistory = d.CommandHistory
+	}
 	if cfg.HTTPReadTimeout <= 0 {
 		cfg.HTTPReadTimeout = d.HTTPReadTimeout
 	}
@@ -175,6 +469,66 @@ func applyServerDefaults(cfg *ServerConfig) {
 	if cfg.HTTPIdleTimeout <= 0 {
 		cfg.HTTPIdleTimeout = d.HTTPIdleTimeout
 	}
+	if cfg.Storage.Backend == "" {
+		cfg.Storage.Backend = d.Storage.Backend
+	}
+	if cfg.Storage.Path == "" {
+		cfg.Storage.Path = d.Storage.Path
+	}
+	if cfg.Storage.Partition <= 0 {
+		cfg.Storage.Partition = d.Storage.Partition
+	}
+	if cfg.Storage.WALSyncInterval <= 0 {
+		cfg.Storage.WALSyncInterval = d.Storage.WALSyncInterval
+	}
+	if len(cfg.Rollups) == 0 {
+		cfg.Rollups = d.Rollups
+	}
+	applyOTLPDefaults(&cfg.Exporters.OTLP, d.Exporters.OTLP)
+	for i := range cfg.Exporters.Sinks {
+		sink := &cfg.Exporters.Sinks[i]
+		if sink.Name == "" {
+			sink.Name = fmt.Sprintf("%s-%d", sink.Type, i)
+		}
+		applyExportQueueDefaults(&sink.ExportQueueConfig)
+	}
+	applyAlertingDefaults(&cfg.Alerting, d.Alerting)
+	if cfg.Reaper.HeartbeatInterval <= 0 {
+		cfg.Reaper.HeartbeatInterval = d.Reaper.HeartbeatInterval
+	}
+	if cfg.Reaper.StaleAfter <= 0 {
+		cfg.Reaper.StaleAfter = d.Reaper.StaleAfter
+	}
+	if cfg.Reaper.CheckInterval <= 0 {
+		cfg.Reaper.CheckInterval = d.Reaper.CheckInterval
+	}
+	if cfg.Reaper.EvictAfter == 0 {
+		cfg.Reaper.EvictAfter = d.Reaper.EvictAfter
+	}
+	if cfg.OfflineCommands.MaxTTL <= 0 {
+		cfg.OfflineCommands.MaxTTL = d.OfflineCommands.MaxTTL
+	}
+	if cfg.OfflineCommands.MaxPerNode <= 0 {
+		cfg.OfflineCommands.MaxPerNode = d.OfflineCommands.MaxPerNode
+	}
+	if cfg.Power.Interval <= 0 {
+		cfg.Power.Interval = d.Power.Interval
+	}
+	if cfg.Power.MinChangeWatts <= 0 {
+		cfg.Power.MinChangeWatts = d.Power.MinChangeWatts
+	}
+	if cfg.NodeIdentity.Mode == "" {
+		cfg.NodeIdentity.Mode = d.NodeIdentity.Mode
+	}
+	if cfg.NodeIdentity.Template == "" {
+		cfg.NodeIdentity.Template = d.NodeIdentity.Template
+	}
+	if cfg.Enrollment.CertTTL <= 0 {
+		cfg.Enrollment.CertTTL = d.Enrollment.CertTTL
+	}
+	if cfg.Enrollment.TokenTTL <= 0 {
+		cfg.Enrollment.TokenTTL = d.Enrollment.TokenTTL
+	}
 	if cfg.Log.Level == "" {
 		cfg.Log.Level = d.Log.Level
 	}
@@ -183,6 +537,85 @@ func applyServerDefaults(cfg *ServerConfig) {
 	}
 }
 
+func applyOTLPDefaults(cfg *OTLPConfig, d OTLPConfig) {
+	if cfg.Protocol == "" {
+		cfg.Protocol = d.Protocol
+	}
+	if cfg.Endpoint == "" {
+		if cfg.Protocol == "http" {
+			cfg.Endpoint = "http://127.0.0.1:4318/v1/metrics"
+		} else {
+			cfg.Endpoint = "127.0.0.1:4317"
+		}
+	}
+	applyExportQueueDefaults(&cfg.ExportQueueConfig)
+}
+
+func applyExportQueueDefaults(cfg *ExportQueueConfig) {
+	d := defaultExportQueueConfig()
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = d.Timeout
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = d.QueueSize
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = d.BatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = d.FlushInterval
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = d.MaxRetries
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = d.RetryBackoff
+	}
+}
+
+func applyAlertingDefaults(cfg *AlertingConfig, d AlertingConfig) {
+	if cfg.EvalInterval <= 0 {
+		cfg.EvalInterval = d.EvalInterval
+	}
+	if cfg.ResolvedRetention <= 0 {
+		cfg.ResolvedRetention = d.ResolvedRetention
+	}
+	for i := range cfg.Webhooks {
+		hook := &cfg.Webhooks[i]
+		if hook.Name == "" {
+			hook.Name = fmt.Sprintf("webhook-%d", i)
+		}
+		if hook.Timeout <= 0 {
+			hook.Timeout = 10 * time.Second
+		}
+		if hook.QueueSize <= 0 {
+			hook.QueueSize = 256
+		}
+		if hook.MaxRetries == 0 {
+			hook.MaxRetries = 5
+		}
+		if hook.RetryBackoff <= 0 {
+			hook.RetryBackoff = time.Second
+		}
+	}
+}
+
+// LoadAlertRules reads a rules file: a YAML document with a top-level "rules"
+// list in the format of AlertingConfig.Rules.
+func LoadAlertRules(path string) ([]AlertRuleConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read alert rules: %w", err)
+	}
+	var doc struct {
+		Rules []AlertRuleConfig `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("parse alert rules: %w", err)
+	}
+	return doc.Rules, nil
+}
+
 func applyAgentDefaults(cfg *AgentConfig) {
 	d := DefaultAgentConfig()
 	if cfg.ServerAddress == "" {
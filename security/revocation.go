@@ -0,0 +1,185 @@
+package security
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// revocationList is the set of revoked certificates: the entries of a CRL,
+// which only apply to certificates of the CRL's issuer, and a plain list of
+// serial numbers, which apply whatever the issuer.
+type revocationList struct {
+	byIssuer map[string]map[string]struct{}
+	serials  map[string]struct{}
+}
+
+func (l *revocationList) len() int {
+	if l == nil {
+		return 0
+	}
+	n := len(l.serials)
+	for _, serials := range l.byIssuer {
+		n += len(serials)
+	}
+	return n
+}
+
+func (l *revocationList) contains(cert *x509.Certificate) bool {
+	if l == nil {
+		return false
+	}
+	serial := serialString(cert.SerialNumber)
+	if _, ok := l.serials[serial]; ok {
+		return true
+	}
+	_, ok := l.byIssuer[string(cert.RawIssuer)][serial]
+	return ok
+}
+
+// serialString formats a serial number the way openssl prints it: upper-case
+// hex without separators.
+func serialString(serial *big.Int) string {
+	if serial == nil {
+		return ""
+	}
+	return strings.ToUpper(serial.Text(16))
+}
+
+// parseSerial accepts a serial number in hex, optionally with a 0x prefix or
+// colon separators.
+func parseSerial(raw string) (string, error) {
+	s := strings.ReplaceAll(strings.TrimSpace(raw), ":", "")
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	serial, ok := new(big.Int).SetString(s, 16)
+	if !ok || serial.Sign() < 0 {
+		return "", fmt.Errorf("invalid serial number %q", raw)
+	}
+	return serialString(serial), nil
+}
+
+func loadRevocationList(crlFile, serialsFile string, caPEM []byte) (*revocationList, error) {
+	if crlFile == "" && serialsFile == "" {
+		return nil, nil
+	}
+	l := &revocationList{
+		byIssuer: make(map[string]map[string]struct{}),
+		serials:  make(map[string]struct{}),
+	}
+	if crlFile != "" {
+		if err := l.loadCRL(crlFile, caPEM); err != nil {
+			return nil, err
+		}
+	}
+	if serialsFile != "" {
+		if err := l.loadSerials(serialsFile); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// loadCRL reads a PEM or DER CRL file. Each CRL must be signed by one of
+// the CA certificates, so that only the CA can revoke its certificates.
+func (l *revocationList) loadCRL(path string, caPEM []byte) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read crl file: %w", err)
+	}
+	cas, err := parseCertificates(caPEM)
+	if err != nil {
+		return err
+	}
+
+	var ders [][]byte
+	for rest := raw; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = [][]byte{raw}
+	}
+
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return fmt.Errorf("parse crl file: %w", err)
+		}
+		signed := false
+		for _, ca := range cas {
+			if crl.CheckSignatureFrom(ca) == nil {
+				signed = true
+				break
+			}
+		}
+		if !signed {
+			return fmt.Errorf("crl of %s is not signed by a certificate in ca_file", crl.Issuer)
+		}
+		serials := l.byIssuer[string(crl.RawIssuer)]
+		if serials == nil {
+			serials = make(map[string]struct{})
+			l.byIssuer[string(crl.RawIssuer)] = serials
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			serials[serialString(entry.SerialNumber)] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// loadSerials reads one hex serial number per line; blank lines and text
+// after # are ignored.
+func (l *revocationList) loadSerials(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read revoked serials file: %w", err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		serial, err := parseSerial(text)
+		if err != nil {
+			return fmt.Errorf("revoked serials file line %d: %w", line, err)
+		}
+		l.serials[serial] = struct{}{}
+	}
+	return scanner.Err()
+}
+
+func parseCertificates(pemData []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for rest := pemData; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse ca certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates in ca_file")
+	}
+	return certs, nil
+}
@@ -3,69 +3,258 @@ package security
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
 
 	"github.com/eWloYW8/Telemetry/config"
 )
 
-func LoadServerTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+// DefaultReloadInterval is how often certificate files are checked for
+// changes when the config does not say.
+const DefaultReloadInterval = 10 * time.Second
+
+// ErrCertificateRevoked is returned for a peer certificate listed in the CRL
+// or the revoked serials file.
+var ErrCertificateRevoked = errors.New("certificate revoked")
+
+// tlsState is one loaded generation of the certificate files.
+type tlsState struct {
+	cert    tls.Certificate
+	pool    *x509.CertPool
+	revoked *revocationList
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// CertReloader keeps the certificate, CA bundle and revocation lists of one
+// side of the connection current. Files are checked for changes at most once
+// per reload interval, on the next handshake or revocation check after it;
+// files that fail to load leave the previous generation in place so that a
+// half-written rotation does not take the listener down.
+type CertReloader struct {
+	cfg        config.TLSConfig
+	side       string
+	clientAuth tls.ClientAuthType
+	interval   time.Duration
+	log        zerolog.Logger
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	stamps    map[string]fileStamp
+	state     *tlsState
+}
+
+// NewServerCertReloader loads the server certificate and the CA that client
+// certificates must chain to.
+func NewServerCertReloader(cfg config.TLSConfig, logger zerolog.Logger) (*CertReloader, error) {
+	return newCertReloader(cfg, "server", logger)
+}
+
+// NewClientCertReloader loads the agent certificate and the CA that the
+// server certificate must chain to.
+func NewClientCertReloader(cfg config.TLSConfig, logger zerolog.Logger) (*CertReloader, error) {
+	return newCertReloader(cfg, "client", logger)
+}
+
+// NewHTTPCertReloader loads the certificate of the HTTP listener and, if
+// cfg.CAFile is set, the CA that browser or API client certificates must
+// chain to, verified as clientAuth asks.
+func NewHTTPCertReloader(cfg config.TLSConfig, clientAuth tls.ClientAuthType, logger zerolog.Logger) (*CertReloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, fmt.Errorf("http tls requires cert_file/key_file")
+	}
+	if cfg.CAFile == "" && clientAuth >= tls.VerifyClientCertIfGiven {
+		return nil, fmt.Errorf("http tls client certificate verification requires ca_file")
+	}
+	return newReloader(cfg, "http", clientAuth, logger)
+}
+
+func newCertReloader(cfg config.TLSConfig, side string, logger zerolog.Logger) (*CertReloader, error) {
 	if cfg.CAFile == "" || cfg.CertFile == "" || cfg.KeyFile == "" {
-		return nil, fmt.Errorf("server tls requires ca_file/cert_file/key_file")
+		return nil, fmt.Errorf("%s tls requires ca_file/cert_file/key_file", side)
 	}
+	return newReloader(cfg, side, tls.RequireAndVerifyClientCert, logger)
+}
 
-	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+func newReloader(cfg config.TLSConfig, side string, clientAuth tls.ClientAuthType, logger zerolog.Logger) (*CertReloader, error) {
+	interval := cfg.ReloadInterval
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+	r := &CertReloader{cfg: cfg, side: side, clientAuth: clientAuth, interval: interval, log: logger}
+	stamps, err := r.statFiles()
 	if err != nil {
-		return nil, fmt.Errorf("load server cert/key: %w", err)
+		return nil, err
 	}
+	state, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	r.state, r.stamps, r.checkedAt = state, stamps, time.Now()
+	return r, nil
+}
 
-	caPEM, err := os.ReadFile(cfg.CAFile)
+func (r *CertReloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.CAFile != "" {
+		files = append(files, r.cfg.CAFile)
+	}
+	if r.cfg.CRLFile != "" {
+		files = append(files, r.cfg.CRLFile)
+	}
+	if r.cfg.RevokedSerialsFile != "" {
+		files = append(files, r.cfg.RevokedSerialsFile)
+	}
+	return files
+}
+
+func (r *CertReloader) statFiles() (map[string]fileStamp, error) {
+	stamps := make(map[string]fileStamp)
+	for _, path := range r.files() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("stat %s tls file: %w", r.side, err)
+		}
+		stamps[path] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	return stamps, nil
+}
+
+func (r *CertReloader) load() (*tlsState, error) {
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
 	if err != nil {
-		return nil, fmt.Errorf("read server ca file: %w", err)
+		return nil, fmt.Errorf("load %s cert/key: %w", r.side, err)
 	}
 
+	if r.cfg.CAFile == "" {
+		return &tlsState{cert: cert}, nil
+	}
+	caPEM, err := os.ReadFile(r.cfg.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("read %s ca file: %w", r.side, err)
+	}
 	pool := x509.NewCertPool()
 	if !pool.AppendCertsFromPEM(caPEM) {
-		return nil, fmt.Errorf("parse server ca pem")
+		return nil, fmt.Errorf("parse %s ca pem", r.side)
 	}
 
-	return &tls.Config{
-		MinVersion:   tls.VersionTLS13,
-		Certificates: []tls.Certificate{cert},
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		ClientCAs:    pool,
-	}, nil
+	revoked, err := loadRevocationList(r.cfg.CRLFile, r.cfg.RevokedSerialsFile, caPEM)
+	if err != nil {
+		return nil, fmt.Errorf("%s tls: %w", r.side, err)
+	}
+	return &tlsState{cert: cert, pool: pool, revoked: revoked}, nil
 }
 
-func LoadClientTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
-	if cfg.CAFile == "" || cfg.CertFile == "" || cfg.KeyFile == "" {
-		return nil, fmt.Errorf("client tls requires ca_file/cert_file/key_file")
+// current returns the loaded generation, reloading it first if the reload
+// interval has passed and any of the files changed.
+func (r *CertReloader) current() *tlsState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if now.Sub(r.checkedAt) < r.interval {
+		return r.state
 	}
+	r.checkedAt = now
 
-	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	stamps, err := r.statFiles()
 	if err != nil {
-		return nil, fmt.Errorf("load client cert/key: %w", err)
+		r.log.Error().Err(err).Msg("check tls files; keeping loaded certificates")
+		return r.state
 	}
-
-	caPEM, err := os.ReadFile(cfg.CAFile)
+	changed := false
+	for path, stamp := range stamps {
+		if prev := r.stamps[path]; !prev.modTime.Equal(stamp.modTime) || prev.size != stamp.size {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return r.state
+	}
+	state, err := r.load()
 	if err != nil {
-		return nil, fmt.Errorf("read client ca file: %w", err)
+		r.log.Error().Err(err).Msg("reload tls files; keeping loaded certificates")
+		return r.state
 	}
+	r.state, r.stamps = state, stamps
+	r.log.Info().Str("cert_file", r.cfg.CertFile).Int("revoked", state.revoked.len()).Msg("tls certificates reloaded")
+	return r.state
+}
 
-	pool := x509.NewCertPool()
-	if !pool.AppendCertsFromPEM(caPEM) {
-		return nil, fmt.Errorf("parse client ca pem")
+// Revoked reports whether a peer certificate is on the current revocation
+// lists.
+func (r *CertReloader) Revoked(cert *x509.Certificate) bool {
+	return cert != nil && r.current().revoked.contains(cert)
+}
+
+// verifyPeer rejects a verified peer whose certificate has been revoked.
+func (r *CertReloader) verifyPeer(state *tlsState) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			if len(chain) > 0 && state.revoked.contains(chain[0]) {
+				serial := serialString(chain[0].SerialNumber)
+				r.log.Warn().Str("subject", chain[0].Subject.String()).Str("serial", serial).Msg("rejected revoked peer certificate")
+				return fmt.Errorf("%w: serial %s", ErrCertificateRevoked, serial)
+			}
+		}
+		return nil
 	}
+}
 
-	tlsCfg := &tls.Config{
-		MinVersion:   tls.VersionTLS13,
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      pool,
+// TLSConfig returns the config for the reloader's side. The server and HTTP
+// configs resolve the certificate, client CAs and revocation lists per
+// handshake; the client config presents the current certificate per
+// handshake and trusts the CA bundle current when it is built, so callers
+// should build one per connection attempt.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	switch r.side {
+	case "server":
+		// gRPC only adds h2 to the outer config.
+		return r.listenerConfig(tls.VersionTLS13, []string{"h2"})
+	case "http":
+		// Browsers still speak TLS 1.2.
+		return r.listenerConfig(tls.VersionTLS12, []string{"h2", "http/1.1"})
 	}
 
-	if cfg.ServerNameOverride != "" {
-		tlsCfg.ServerName = cfg.ServerNameOverride
+	state := r.current()
+	tlsCfg := &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		RootCAs:    state.pool,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert := r.current().cert
+			return &cert, nil
+		},
+		VerifyPeerCertificate: r.verifyPeer(state),
+	}
+	if r.cfg.ServerNameOverride != "" {
+		tlsCfg.ServerName = r.cfg.ServerNameOverride
 	}
+	return tlsCfg
+}
 
-	return tlsCfg, nil
+func (r *CertReloader) listenerConfig(minVersion uint16, nextProtos []string) *tls.Config {
+	return &tls.Config{
+		MinVersion: minVersion,
+		ClientAuth: r.clientAuth,
+		NextProtos: nextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			state := r.current()
+			return &tls.Config{
+				MinVersion:            minVersion,
+				Certificates:          []tls.Certificate{state.cert},
+				ClientAuth:            r.clientAuth,
+				ClientCAs:             state.pool,
+				VerifyPeerCertificate: r.verifyPeer(state),
+				NextProtos:            nextProtos,
+			}, nil
+		},
+	}
 }
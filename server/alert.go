@@ -0,0 +1,513 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/eWloYW8/Telemetry/api"
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+	"github.com/eWloYW8/Telemetry/config"
+)
+
+// Alert states. inactive is only published, when a pending alert clears
+// before it fires; such alerts are dropped rather than kept as resolved.
+const (
+	alertStatePending  = "pending"
+	alertStateFiring   = "firing"
+	alertStateResolved = "resolved"
+	alertStateInactive = "inactive"
+)
+
+var alertOps = map[string]func(value, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+}
+
+type alertRule struct {
+	cfg       config.AlertRuleConfig
+	heartbeat bool
+	compare   func(value, threshold float64) bool
+	clear     float64
+	divideBy  map[string]struct{}
+	nodes     map[string]struct{}
+}
+
+func (r *alertRule) matchesNode(nodeID string) bool {
+	if len(r.nodes) == 0 {
+		return true
+	}
+	_, ok := r.nodes[nodeID]
+	return ok
+}
+
+// newAlertRules validates the inline rules and those of the rules file.
+func newAlertRules(cfg config.AlertingConfig) ([]*alertRule, error) {
+	ruleCfgs := append([]config.AlertRuleConfig(nil), cfg.Rules...)
+	if cfg.RulesFile != "" {
+		fileRules, err := config.LoadAlertRules(cfg.RulesFile)
+		if err != nil {
+			return nil, err
+		}
+		ruleCfgs = append(ruleCfgs, fileRules...)
+	}
+
+	names := make(map[string]struct{}, len(ruleCfgs))
+	rules := make([]*alertRule, 0, len(ruleCfgs))
+	for i, rc := range ruleCfgs {
+		if rc.Name == "" {
+			return nil, fmt.Errorf("alert rule %d: missing name", i)
+		}
+		if _, dup := names[rc.Name]; dup {
+			return nil, fmt.Errorf("alert rule %s: duplicate name", rc.Name)
+		}
+		names[rc.Name] = struct{}{}
+
+		if rc.Op == "" {
+			rc.Op = ">"
+		}
+		if rc.Severity == "" {
+			rc.Severity = "warning"
+		}
+		rule := &alertRule{cfg: rc, compare: alertOps[rc.Op], clear: rc.Threshold}
+		if rule.compare == nil {
+			return nil, fmt.Errorf("alert rule %s: unsupported op %q", rc.Name, rc.Op)
+		}
+		switch rc.Type {
+		case "", "threshold":
+			rule.cfg.Type = "threshold"
+			if rc.Category == "" || rc.Metric == "" {
+				return nil, fmt.Errorf("alert rule %s: category and metric are required", rc.Name)
+			}
+		case "heartbeat":
+			rule.heartbeat = true
+		default:
+			return nil, fmt.Errorf("alert rule %s: unsupported type %q", rc.Name, rc.Type)
+		}
+		if rc.ClearThreshold != nil {
+			// The clear threshold must lie on the normal side of the
+			// threshold, otherwise a firing alert could never resolve.
+			if rule.compare(*rc.ClearThreshold, rc.Threshold) {
+				return nil, fmt.Errorf("alert rule %s: clear_threshold %v must not pass threshold %v", rc.Name, *rc.ClearThreshold, rc.Threshold)
+			}
+			rule.clear = *rc.ClearThreshold
+		}
+		if len(rc.DivideBy) > 0 {
+			rule.divideBy = make(map[string]struct{}, len(rc.DivideBy))
+			for _, metric := range rc.DivideBy {
+				rule.divideBy[metric] = struct{}{}
+			}
+		}
+		if len(rc.Nodes) > 0 {
+			rule.nodes = make(map[string]struct{}, len(rc.Nodes))
+			for _, nodeID := range rc.Nodes {
+				rule.nodes[nodeID] = struct{}{}
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// alertInstance is one series of a rule on one node.
+type alertInstance struct {
+	id     string
+	rule   *alertRule
+	nodeID string
+	labels []metricLabel
+
+	state       string
+	value       float64
+	activeSince int64
+	firedAt     int64
+	resolvedAt  int64
+	updatedAt   int64
+}
+
+func (a *alertInstance) toPB() *pb.Alert {
+	out := &pb.Alert{
+		Id:                  a.id,
+		Rule:                a.rule.cfg.Name,
+		NodeId:              a.nodeID,
+		State:               a.state,
+		Severity:            a.rule.cfg.Severity,
+		Category:            a.rule.cfg.Category,
+		Metric:              a.rule.cfg.Metric,
+		Value:               a.value,
+		Threshold:           a.rule.cfg.Threshold,
+		ActiveSinceUnixNano: a.activeSince,
+		FiredAtUnixNano:     a.firedAt,
+		ResolvedAtUnixNano:  a.resolvedAt,
+		UpdatedAtUnixNano:   a.updatedAt,
+	}
+	if len(a.rule.cfg.Labels)+len(a.labels) > 0 {
+		out.Labels = make(map[string]string, len(a.rule.cfg.Labels)+len(a.labels))
+		for k, v := range a.rule.cfg.Labels {
+			out.Labels[k] = v
+		}
+		for _, l := range a.labels {
+			out.Labels[l.Name] = l.Value
+		}
+	}
+	if len(a.rule.cfg.Annotations) > 0 {
+		out.Annotations = make(map[string]string, len(a.rule.cfg.Annotations))
+		for k, v := range a.rule.cfg.Annotations {
+			out.Annotations[k] = v
+		}
+	}
+	return out
+}
+
+// alertEngine evaluates the rules against ingested samples and node contact
+// times. Threshold rules are evaluated as samples arrive; the periodic tick
+// promotes pending alerts whose for-duration elapsed, evaluates heartbeat
+// rules and forgets resolved alerts after the retention.
+type alertEngine struct {
+	log       zerolog.Logger
+	rules     []*alertRule
+	interval  time.Duration
+	retention time.Duration
+	notifiers []*webhookNotifier
+	publish   func(*pb.Alert)
+
+	mu       sync.Mutex
+	alerts   map[string]map[string]*alertInstance
+	lastSeen map[string]int64
+}
+
+func newAlertEngine(cfg config.AlertingConfig, publish func(*pb.Alert), logger zerolog.Logger) (*alertEngine, error) {
+	rules, err := newAlertRules(cfg)
+	if err != nil {
+		return nil, err
+	}
+	e := &alertEngine{
+		log:       logger,
+		rules:     rules,
+		interval:  cfg.EvalInterval,
+		retention: cfg.ResolvedRetention,
+		publish:   publish,
+		alerts:    make(map[string]map[string]*alertInstance),
+		lastSeen:  make(map[string]int64),
+	}
+	for _, hookCfg := range cfg.Webhooks {
+		n, err := newWebhookNotifier(hookCfg, logger)
+		if err != nil {
+			return nil, err
+		}
+		e.notifiers = append(e.notifiers, n)
+	}
+	return e, nil
+}
+
+func (e *alertEngine) Run(ctx context.Context) {
+	for _, n := range e.notifiers {
+		go n.Run(ctx)
+	}
+	if len(e.rules) == 0 {
+		return
+	}
+	e.log.Info().Int("rules", len(e.rules)).Int("webhooks", len(e.notifiers)).Msg("alert engine started")
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			e.tick(now.UnixNano())
+		}
+	}
+}
+
+// Seen records contact with a node and re-evaluates its heartbeat rules.
+func (e *alertEngine) Seen(nodeID string) {
+	now := time.Now().UnixNano()
+	e.mu.Lock()
+	e.lastSeen[nodeID] = now
+	var changed []*pb.Alert
+	for _, rule := range e.rules {
+		if rule.heartbeat && rule.matchesNode(nodeID) {
+			changed = e.update(changed, rule, nodeID, nil, 0, now)
+		}
+	}
+	e.mu.Unlock()
+	e.emit(changed)
+}
+
+// Forget drops the alerts and contact time of an evicted node. Alerts still
+// pending or firing are published as cleared first.
+func (e *alertEngine) Forget(nodeID string) {
+	now := time.Now().UnixNano()
+	e.mu.Lock()
+	var changed []*pb.Alert
+	for _, inst := range e.alerts[nodeID] {
+		if inst.state != alertStateResolved {
+			changed = e.clearInstance(changed, inst, now)
+		}
+	}
+	delete(e.alerts, nodeID)
+	delete(e.lastSeen, nodeID)
+	e.mu.Unlock()
+	e.emit(changed)
+}
+
+// Observe evaluates the threshold rules against a batch of samples. Series a
+// rule tracked on the node that are missing from a sample of its category
+// no longer hold the condition.
+func (e *alertEngine) Observe(nodeID string, samples []api.MetricSample) {
+	if len(e.rules) == 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	e.mu.Lock()
+	var changed []*pb.Alert
+	for _, sample := range samples {
+		var points []metricPoint
+		flattened := false
+		for _, rule := range e.rules {
+			if rule.heartbeat || api.MetricCategory(rule.cfg.Category) != sample.Category || !rule.matchesNode(nodeID) {
+				continue
+			}
+			if !flattened {
+				points = flattenPayload(sample.Payload)
+				flattened = true
+			}
+			seen := make(map[string]struct{})
+			for _, series := range alertSeries(rule, points) {
+				changed = e.update(changed, rule, nodeID, series.labels, series.value, now)
+				seen[alertID(rule.cfg.Name, nodeID, series.labels)] = struct{}{}
+			}
+			for id, inst := range e.alerts[nodeID] {
+				if _, ok := seen[id]; !ok && inst.rule == rule && inst.state != alertStateResolved {
+					changed = e.clearInstance(changed, inst, now)
+				}
+			}
+		}
+	}
+	e.mu.Unlock()
+	e.emit(changed)
+}
+
+type alertSeriesValue struct {
+	labels []metricLabel
+	value  float64
+}
+
+// alertSeries extracts the rule's metric per device, divided by the sum of
+// the divide_by metrics of the same device when configured.
+func alertSeries(rule *alertRule, points []metricPoint) []alertSeriesValue {
+	var out []alertSeriesValue
+	var denominators map[string]float64
+	if rule.divideBy != nil {
+		denominators = make(map[string]float64)
+		for _, p := range points {
+			if _, ok := rule.divideBy[p.Metric]; ok {
+				denominators[labelsKey(p.Labels)] += p.Value
+			}
+		}
+	}
+	for _, p := range points {
+		if p.Metric != rule.cfg.Metric {
+			continue
+		}
+		value := p.Value
+		if denominators != nil {
+			den := denominators[labelsKey(p.Labels)]
+			if den == 0 {
+				continue
+			}
+			value /= den
+		}
+		out = append(out, alertSeriesValue{labels: p.Labels, value: value})
+	}
+	return out
+}
+
+// update applies one evaluation of a series and appends the alert to changed
+// when its state moved. Callers hold e.mu.
+func (e *alertEngine) update(changed []*pb.Alert, rule *alertRule, nodeID string, labels []metricLabel, value float64, now int64) []*pb.Alert {
+	id := alertID(rule.cfg.Name, nodeID, labels)
+	nodeAlerts := e.alerts[nodeID]
+	inst := nodeAlerts[id]
+	if inst == nil || inst.state == alertStateResolved {
+		if !rule.compare(value, rule.cfg.Threshold) {
+			return changed
+		}
+		if nodeAlerts == nil {
+			nodeAlerts = make(map[string]*alertInstance)
+			e.alerts[nodeID] = nodeAlerts
+		}
+		inst = &alertInstance{
+			id:          id,
+			rule:        rule,
+			nodeID:      nodeID,
+			labels:      labels,
+			state:       alertStatePending,
+			value:       value,
+			activeSince: now,
+			updatedAt:   now,
+		}
+		nodeAlerts[id] = inst
+		if rule.cfg.For <= 0 {
+			e.fire(inst, now)
+		}
+		return append(changed, inst.toPB())
+	}
+
+	inst.value = value
+	inst.updatedAt = now
+	switch inst.state {
+	case alertStatePending:
+		if !rule.compare(value, rule.cfg.Threshold) {
+			return e.clearInstance(changed, inst, now)
+		}
+		if now-inst.activeSince >= int64(rule.cfg.For) {
+			e.fire(inst, now)
+			return append(changed, inst.toPB())
+		}
+	case alertStateFiring:
+		// Hysteresis: stay firing until the value is back past the clear
+		// threshold, not merely below the firing threshold.
+		if !rule.compare(value, rule.clear) {
+			return e.clearInstance(changed, inst, now)
+		}
+	}
+	return changed
+}
+
+func (e *alertEngine) fire(inst *alertInstance, now int64) {
+	inst.state = alertStateFiring
+	inst.firedAt = now
+	e.log.Info().
+		Str("rule", inst.rule.cfg.Name).
+		Str("node_id", inst.nodeID).
+		Str("alert_id", inst.id).
+		Float64("value", inst.value).
+		Msg("alert firing")
+}
+
+// clearInstance resolves a firing alert or drops a pending one. Callers hold
+// e.mu.
+func (e *alertEngine) clearInstance(changed []*pb.Alert, inst *alertInstance, now int64) []*pb.Alert {
+	inst.updatedAt = now
+	if inst.state == alertStatePending {
+		delete(e.alerts[inst.nodeID], inst.id)
+		inst.state = alertStateInactive
+		return append(changed, inst.toPB())
+	}
+	inst.state = alertStateResolved
+	inst.resolvedAt = now
+	e.log.Info().
+		Str("rule", inst.rule.cfg.Name).
+		Str("node_id", inst.nodeID).
+		Str("alert_id", inst.id).
+		Float64("value", inst.value).
+		Msg("alert resolved")
+	return append(changed, inst.toPB())
+}
+
+func (e *alertEngine) tick(now int64) {
+	e.mu.Lock()
+	var changed []*pb.Alert
+	for nodeID, lastSeen := range e.lastSeen {
+		for _, rule := range e.rules {
+			if rule.heartbeat && rule.matchesNode(nodeID) {
+				silence := float64(now-lastSeen) / float64(time.Second)
+				changed = e.update(changed, rule, nodeID, nil, silence, now)
+			}
+		}
+	}
+	for nodeID, nodeAlerts := range e.alerts {
+		for id, inst := range nodeAlerts {
+			switch {
+			case inst.state == alertStatePending && now-inst.activeSince >= int64(inst.rule.cfg.For):
+				inst.updatedAt = now
+				e.fire(inst, now)
+				changed = append(changed, inst.toPB())
+			case inst.state == alertStateResolved && now-inst.resolvedAt >= int64(e.retention):
+				delete(nodeAlerts, id)
+			}
+		}
+		if len(nodeAlerts) == 0 {
+			delete(e.alerts, nodeID)
+		}
+	}
+	e.mu.Unlock()
+	e.emit(changed)
+}
+
+// emit publishes state changes to websocket clients and notifies the
+// webhooks of alerts that fired or resolved.
+func (e *alertEngine) emit(changed []*pb.Alert) {
+	for _, alert := range changed {
+		if e.publish != nil {
+			e.publish(alert)
+		}
+		if alert.GetState() != alertStateFiring && alert.GetState() != alertStateResolved {
+			continue
+		}
+		for _, n := range e.notifiers {
+			n.Notify(alert)
+		}
+	}
+}
+
+// Alerts lists alerts in the given states (all when empty), optionally of a
+// single node, ordered by node, rule and id.
+func (e *alertEngine) Alerts(states map[string]struct{}, nodeID string) []*pb.Alert {
+	e.mu.Lock()
+	var out []*pb.Alert
+	for id, nodeAlerts := range e.alerts {
+		if nodeID != "" && id != nodeID {
+			continue
+		}
+		for _, inst := range nodeAlerts {
+			if _, ok := states[inst.state]; len(states) > 0 && !ok {
+				continue
+			}
+			out = append(out, inst.toPB())
+		}
+	}
+	e.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].GetNodeId() != out[j].GetNodeId() {
+			return out[i].GetNodeId() < out[j].GetNodeId()
+		}
+		if out[i].GetRule() != out[j].GetRule() {
+			return out[i].GetRule() < out[j].GetRule()
+		}
+		return out[i].GetId() < out[j].GetId()
+	})
+	return out
+}
+
+// SwapDropStats returns and resets the webhook notifications dropped on full
+// queues and those that failed after all retries.
+func (e *alertEngine) SwapDropStats() (dropped, failed uint64) {
+	for _, n := range e.notifiers {
+		d, f := n.SwapDropStats()
+		dropped += d
+		failed += f
+	}
+	return dropped, failed
+}
+
+// alertID identifies a series across evaluations: the rule, the node and the
+// device labels.
+func alertID(rule, nodeID string, labels []metricLabel) string {
+	h := fnv.New64a()
+	h.Write([]byte(rule))
+	h.Write([]byte{0})
+	h.Write([]byte(nodeID))
+	h.Write([]byte{0})
+	h.Write([]byte(labelsKey(labels)))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
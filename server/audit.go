@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+)
+
+const (
+	auditFile = "audit.jsonl"
+
+	auditEventIssued   = "issued"
+	auditEventFinished = "finished"
+
+	maxAuditLineBytes = 4 << 20
+)
+
+// commandOrigin identifies who issued a command and through which API.
+// Commands the server issues routinely, such as power caps, set
+// auditFailuresOnly so that only those that do not succeed are audited.
+type commandOrigin struct {
+	source            string
+	user              string
+	remoteAddr        string
+	auditFailuresOnly bool
+}
+
+type commandOriginKey struct{}
+
+func httpCommandOrigin(r *http.Request) commandOrigin {
+	return commandOrigin{source: "http", user: authIdentityFrom(r.Context()).identityName(), remoteAddr: r.RemoteAddr}
+}
+
+func (c *wsClient) commandOrigin() commandOrigin {
+	return commandOrigin{source: "ws", user: c.identity.identityName(), remoteAddr: c.remoteAddr}
+}
+
+func withCommandOrigin(ctx context.Context, origin commandOrigin) context.Context {
+	return context.WithValue(ctx, commandOriginKey{}, origin)
+}
+
+func commandOriginFrom(ctx context.Context) commandOrigin {
+	origin, _ := ctx.Value(commandOriginKey{}).(commandOrigin)
+	return origin
+}
+
+// auditLog appends command audit entries to a JSON Lines file, syncing each
+// entry before returning. Queries scan the file, so the log is the only copy
+// of the history and survives restarts.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	log  zerolog.Logger
+}
+
+func openAuditLog(path string, logger zerolog.Logger) (*auditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("create audit log dir: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	// Terminate a line torn by a crash so that it does not swallow the next
+	// entry.
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			_, _ = file.Write([]byte{'\n'})
+		}
+	}
+	return &auditLog{path: path, file: file, log: logger}, nil
+}
+
+// Append writes an entry. Failures are logged rather than returned: a command
+// is never held back because it could not be audited.
+func (a *auditLog) Append(entry *pb.AuditEntry) {
+	line, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(entry)
+	if err != nil {
+		a.log.Error().Err(err).Str("command_id", entry.GetCommandId()).Msg("encode audit entry")
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(line); err != nil {
+		a.log.Error().Err(err).Str("command_id", entry.GetCommandId()).Msg("write audit entry")
+		return
+	}
+	if err := a.file.Sync(); err != nil {
+		a.log.Error().Err(err).Str("command_id", entry.GetCommandId()).Msg("sync audit entry")
+	}
+}
+
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// auditFilter selects audit entries; empty fields match everything and the
+// time range is inclusive.
+type auditFilter struct {
+	nodeID    string
+	cmdType   string
+	user      string
+	commandID string
+	from, to  int64
+}
+
+func (f auditFilter) matches(entry *pb.AuditEntry) bool {
+	switch {
+	case f.nodeID != "" && entry.GetNodeId() != f.nodeID:
+		return false
+	case f.cmdType != "" && entry.GetType() != f.cmdType:
+		return false
+	case f.user != "" && entry.GetUser() != f.user:
+		return false
+	case f.commandID != "" && entry.GetCommandId() != f.commandID:
+		return false
+	case f.from > 0 && entry.GetTimeUnixNano() < f.from:
+		return false
+	case f.to > 0 && entry.GetTimeUnixNano() > f.to:
+		return false
+	}
+	return true
+}
+
+// Scan calls fn for every matching entry in the order they were written,
+// along with the entry's raw JSON line.
+func (a *auditLog) Scan(filter auditFilter, fn func(entry *pb.AuditEntry, line []byte) error) error {
+	file, err := os.Open(a.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("open audit log: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxAuditLineBytes)
+	unmarshal := protojson.UnmarshalOptions{DiscardUnknown: true}
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var entry pb.AuditEntry
+		if err := unmarshal.Unmarshal(line, &entry); err != nil {
+			// A line torn by a crash mid-write is skipped.
+			a.log.Warn().Err(err).Msg("skipping unreadable audit entry")
+			continue
+		}
+		if !filter.matches(&entry) {
+			continue
+		}
+		if err := fn(&entry, line); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read audit log: %w", err)
+	}
+	return nil
+}
+
+const defaultAuditLimit = 1000
+
+// handleListAudit queries the audit log by node, type, user, command id and
+// time range. Entries come oldest first; limit keeps the most recent ones and
+// defaults to 1000 for protobuf responses. format=jsonl exports the matching
+// log lines as they are stored, without a default limit.
+func (s *Server) handleListAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := strings.ToLower(strings.TrimSpace(query.Get("format")))
+	if format != "" && format != "jsonl" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unsupported format %q (want jsonl)", format))
+		return
+	}
+	from, err := parseTimeQuery(query.Get("from"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid from: %w", err))
+		return
+	}
+	to, err := parseTimeQuery(query.Get("to"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid to: %w", err))
+		return
+	}
+	if from > 0 && to > 0 && from > to {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("from must not be after to"))
+		return
+	}
+	limit := 0
+	if format == "" {
+		limit = defaultAuditLimit
+	}
+	if raw := query.Get("limit"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", raw))
+			return
+		}
+		limit = v
+	}
+	filter := auditFilter{
+		nodeID:    strings.TrimSpace(query.Get("node")),
+		cmdType:   strings.TrimSpace(query.Get("type")),
+		user:      strings.TrimSpace(query.Get("user")),
+		commandID: strings.TrimSpace(query.Get("command")),
+		from:      from,
+		to:        to,
+	}
+
+	if format == "jsonl" && limit == 0 {
+		writeJSONLHeader(w)
+		err := s.audit.Scan(filter, func(_ *pb.AuditEntry, line []byte) error {
+			_, err := w.Write(append(line, '\n'))
+			return err
+		})
+		if err != nil {
+			// The status line is already sent; abort so the client sees a
+			// truncated transfer.
+			s.log.Warn().Err(err).Msg("audit export aborted")
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+
+	entries, lines, err := s.lastAuditEntries(filter, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if format == "jsonl" {
+		writeJSONLHeader(w)
+		for _, line := range lines {
+			_, _ = w.Write(line)
+		}
+		return
+	}
+	writeProto(w, http.StatusOK, &pb.AuditResponse{Entries: entries})
+}
+
+// lastAuditEntries returns the last limit matching entries, oldest first,
+// with their newline-terminated lines.
+func (s *Server) lastAuditEntries(filter auditFilter, limit int) ([]*pb.AuditEntry, [][]byte, error) {
+	var (
+		entries []*pb.AuditEntry
+		lines   [][]byte
+		total   int
+	)
+	err := s.audit.Scan(filter, func(entry *pb.AuditEntry, line []byte) error {
+		line = append(bytes.Clone(line), '\n')
+		if limit == 0 || len(entries) < limit {
+			entries = append(entries, entry)
+			lines = append(lines, line)
+		} else {
+			entries[total%limit] = entry
+			lines[total%limit] = line
+		}
+		total++
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if limit > 0 && total > limit {
+		start := total % limit
+		entries = append(entries[start:], entries[:start]...)
+		lines = append(lines[start:], lines[:start]...)
+	}
+	return entries, lines, nil
+}
+
+func writeJSONLHeader(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="telemetry-audit.jsonl"`)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+}
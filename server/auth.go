@@ -0,0 +1,342 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// tokenReloadInterval is how often the tokens file is checked for changes.
+const tokenReloadInterval = time.Second
+
+// authRole is what a token may do. Each role includes the ones below it.
+type authRole int
+
+const (
+	// roleViewer reads the API and subscribes to the websocket.
+	roleViewer authRole = iota + 1
+	// roleOperator also sends commands and manages schedules.
+	roleOperator
+	// roleAdmin also deletes, cordons and labels nodes.
+	roleAdmin
+)
+
+func parseAuthRole(raw string) (authRole, error) {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "viewer":
+		return roleViewer, nil
+	case "operator":
+		return roleOperator, nil
+	case "admin":
+		return roleAdmin, nil
+	default:
+		return 0, fmt.Errorf("unknown role %q (want viewer, operator or admin)", raw)
+	}
+}
+
+func (r authRole) String() string {
+	switch r {
+	case roleViewer:
+		return "viewer"
+	case roleOperator:
+		return "operator"
+	case roleAdmin:
+		return "admin"
+	default:
+		return "none"
+	}
+}
+
+var (
+	errMissingToken = errors.New("missing API token")
+	errInvalidToken = errors.New("invalid API token")
+
+	errRevokedClientCert = errors.New("client certificate revoked")
+)
+
+// authIdentity is the token or client certificate a request was made with.
+type authIdentity struct {
+	name string
+	role authRole
+	hash [sha256.Size]byte
+	cert *x509.Certificate
+}
+
+type authIdentityKey struct{}
+
+func withAuthIdentity(ctx context.Context, id *authIdentity) context.Context {
+	return context.WithValue(ctx, authIdentityKey{}, id)
+}
+
+// authIdentityFrom returns the identity of a request, or nil when
+// authentication is disabled.
+func authIdentityFrom(ctx context.Context) *authIdentity {
+	id, _ := ctx.Value(authIdentityKey{}).(*authIdentity)
+	return id
+}
+
+// identityName is the user recorded for commands sent with an identity.
+func (id *authIdentity) identityName() string {
+	if id == nil {
+		return ""
+	}
+	return id.name
+}
+
+type tokenFile struct {
+	Tokens []struct {
+		Name   string `yaml:"name"`
+		Role   string `yaml:"role"`
+		SHA256 string `yaml:"sha256"`
+	} `yaml:"tokens"`
+}
+
+// tokenStore holds the API tokens of the tokens file, keyed by the SHA-256
+// of their value so that the file never contains a usable token. The file
+// is re-read when its modification time or size changes; a file that fails
+// to load leaves the previous tokens in place.
+type tokenStore struct {
+	path string
+	log  zerolog.Logger
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	modTime   time.Time
+	size      int64
+	tokens    map[[sha256.Size]byte]*authIdentity
+}
+
+func newTokenStore(path string, logger zerolog.Logger) (*tokenStore, error) {
+	t := &tokenStore{path: path, log: logger}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("stat tokens file: %w", err)
+	}
+	if err := t.loadLocked(info); err != nil {
+		return nil, err
+	}
+	t.checkedAt = time.Now()
+	return t, nil
+}
+
+// Lookup returns the identity of a presented token.
+func (t *tokenStore) Lookup(token string) (*authIdentity, bool) {
+	return t.lookupHash(sha256.Sum256([]byte(token)))
+}
+
+// Refresh re-resolves an identity against the current tokens, so that a
+// long-lived websocket loses access once its token is removed or demoted.
+func (t *tokenStore) Refresh(id *authIdentity) (*authIdentity, bool) {
+	if id == nil {
+		return nil, false
+	}
+	return t.lookupHash(id.hash)
+}
+
+func (t *tokenStore) lookupHash(hash [sha256.Size]byte) (*authIdentity, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reloadLocked()
+	id, ok := t.tokens[hash]
+	return id, ok
+}
+
+func (t *tokenStore) reloadLocked() {
+	now := time.Now()
+	if now.Sub(t.checkedAt) < tokenReloadInterval {
+		return
+	}
+	t.checkedAt = now
+	info, err := os.Stat(t.path)
+	if err != nil {
+		t.log.Error().Err(err).Str("path", t.path).Msg("stat tokens file; keeping previous tokens")
+		return
+	}
+	if info.ModTime().Equal(t.modTime) && info.Size() == t.size {
+		return
+	}
+	if err := t.loadLocked(info); err != nil {
+		t.log.Error().Err(err).Str("path", t.path).Msg("reload tokens file; keeping previous tokens")
+		return
+	}
+	t.log.Info().Str("path", t.path).Int("tokens", len(t.tokens)).Msg("tokens file reloaded")
+}
+
+func (t *tokenStore) loadLocked(info os.FileInfo) error {
+	raw, err := os.ReadFile(t.path)
+	if err != nil {
+		return fmt.Errorf("read tokens file: %w", err)
+	}
+	var file tokenFile
+	if err := yaml.Unmarshal(raw, &file); err != nil {
+		return fmt.Errorf("decode tokens file: %w", err)
+	}
+	tokens := make(map[[sha256.Size]byte]*authIdentity, len(file.Tokens))
+	names := make(map[string]struct{}, len(file.Tokens))
+	for i, entry := range file.Tokens {
+		name := strings.TrimSpace(entry.Name)
+		if name == "" {
+			return fmt.Errorf("tokens[%d]: missing name", i)
+		}
+		if _, dup := names[name]; dup {
+			return fmt.Errorf("tokens[%d]: duplicate name %q", i, name)
+		}
+		names[name] = struct{}{}
+		role, err := parseAuthRole(entry.Role)
+		if err != nil {
+			return fmt.Errorf("token %s: %w", name, err)
+		}
+		sum, err := hex.DecodeString(strings.TrimSpace(entry.SHA256))
+		if err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("token %s: sha256 must be %d hex characters", name, 2*sha256.Size)
+		}
+		id := &authIdentity{name: name, role: role}
+		copy(id.hash[:], sum)
+		if _, dup := tokens[id.hash]; dup {
+			return fmt.Errorf("token %s: same token as another entry", name)
+		}
+		tokens[id.hash] = id
+	}
+	t.tokens = tokens
+	t.modTime = info.ModTime()
+	t.size = info.Size()
+	return nil
+}
+
+// requestToken extracts the API token of a request: a bearer token, or for
+// websocket upgrades, which browsers cannot give headers, the access_token
+// query parameter.
+func requestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, ok := strings.Cut(header, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+// authEnabled reports whether API requests must carry a token or a mapped
+// client certificate.
+func (s *Server) authEnabled() bool {
+	return s.tokens != nil || len(s.certRoles) > 0
+}
+
+// authenticate rejects requests without a valid API token or mapped client
+// certificate and records the identity of the others; a token takes
+// precedence over the certificate. It lets every request through when
+// neither a tokens file nor client roles are configured.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := requestToken(r)
+		if token == "" {
+			if id := s.certIdentity(r); id != nil {
+				next.ServeHTTP(w, r.WithContext(withAuthIdentity(r.Context(), id)))
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="telemetry"`)
+			writeError(w, http.StatusUnauthorized, errMissingToken)
+			return
+		}
+		var (
+			id *authIdentity
+			ok bool
+		)
+		if s.tokens != nil {
+			id, ok = s.tokens.Lookup(token)
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="telemetry", error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, errInvalidToken)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withAuthIdentity(r.Context(), id)))
+	})
+}
+
+// requireRole rejects authenticated requests whose token lacks role.
+func (s *Server) requireRole(role authRole) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := s.authorize(authIdentityFrom(r.Context()), role); err != nil {
+				writeError(w, http.StatusForbidden, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// authorize checks that an identity has at least role. Tokens are
+// re-resolved against the current tokens file and certificates checked
+// against the current revocation lists.
+func (s *Server) authorize(id *authIdentity, role authRole) error {
+	if !s.authEnabled() {
+		return nil
+	}
+	if id != nil && id.cert != nil {
+		if s.httpTLS != nil && s.httpTLS.Revoked(id.cert) {
+			return errRevokedClientCert
+		}
+		if id.role < role {
+			return fmt.Errorf("client certificate %s has role %s; %s required", strings.TrimPrefix(id.name, "cert/"), id.role, role)
+		}
+		return nil
+	}
+	if s.tokens == nil {
+		return errInvalidToken
+	}
+	current, ok := s.tokens.Refresh(id)
+	if !ok {
+		return errInvalidToken
+	}
+	if current.role < role {
+		return fmt.Errorf("token %s has role %s; %s required", current.name, current.role, role)
+	}
+	return nil
+}
+
+// checkWSOrigin accepts websocket upgrades from clients that send no Origin
+// (anything but a browser), from the server's own origin and from the
+// configured allowlist.
+func (s *Server) checkWSOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range s.cfg.Auth.AllowedOrigins {
+		allowed = strings.TrimRight(strings.TrimSpace(allowed), "/")
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	s.log.Warn().Str("origin", origin).Str("remote_addr", r.RemoteAddr).Msg("websocket origin not allowed")
+	return false
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/eWloYW8/Telemetry/api"
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+)
+
+// Command states as reported by the command API.
+const (
+	commandStateQueued     = "queued"
+	commandStateHeld       = "queued_offline"
+	commandStateSent       = "sent"
+	commandStateSucceeded  = "succeeded"
+	commandStateFailed     = "failed"
+	commandStateSuperseded = "superseded"
+	commandStateTimedOut   = "timed_out"
+)
+
+type commandRecord struct {
+	id         string
+	nodeID     string
+	cmdType    api.CommandType
+	state      string
+	err        string
+	createdAt  int64
+	sentAt     int64
+	finishedAt int64
+	deliverBy  int64
+	result     *api.CommandResult
+	origin     commandOrigin
+	// command is kept for origins that only audit failures, whose issued
+	// entry is not written.
+	command *pb.Command
+}
+
+func (r *commandRecord) finished() bool {
+	return r.state != commandStateQueued && r.state != commandStateHeld && r.state != commandStateSent
+}
+
+func (r *commandRecord) toPB() *pb.CommandStatus {
+	out := &pb.CommandStatus{
+		Id:                 r.id,
+		NodeId:             r.nodeID,
+		Type:               string(r.cmdType),
+		State:              r.state,
+		Error:              r.err,
+		CreatedAtUnixNano:  r.createdAt,
+		SentAtUnixNano:     r.sentAt,
+		FinishedAtUnixNano: r.finishedAt,
+		DeliverByUnixNano:  r.deliverBy,
+	}
+	if r.result != nil {
+		out.Result = api.ToPBCommandResult(r.result)
+	}
+	return out
+}
+
+func (r *commandRecord) auditEntry(event string) *pb.AuditEntry {
+	entry := &pb.AuditEntry{
+		TimeUnixNano: r.createdAt,
+		Event:        event,
+		CommandId:    r.id,
+		NodeId:       r.nodeID,
+		Type:         string(r.cmdType),
+		User:         r.origin.user,
+		RemoteAddr:   r.origin.remoteAddr,
+		Source:       r.origin.source,
+		State:        r.state,
+	}
+	if event == auditEventFinished {
+		entry.TimeUnixNano = r.finishedAt
+		entry.Error = r.err
+		entry.Command = r.command
+		if r.result != nil {
+			entry.Result = api.ToPBCommandResult(r.result)
+		}
+	}
+	return entry
+}
+
+// commandTracker keeps the most recent commands, in dispatch order, so that
+// clients can poll a command instead of waiting on it. Beyond the limit the
+// oldest finished records are forgotten; commands still queued, held or sent
+// are kept until they finish. Every command is also
+// written to the audit log when it is tracked and when it finishes, except
+// that commands of an origin with auditFailuresOnly are written only when
+// they finish without succeeding.
+type commandTracker struct {
+	mu      sync.RWMutex
+	limit   int
+	records map[string]*commandRecord
+	order   []string
+	audit   *auditLog
+}
+
+func newCommandTracker(limit int, audit *auditLog) *commandTracker {
+	return &commandTracker{
+		limit:   limit,
+		records: make(map[string]*commandRecord, limit),
+		audit:   audit,
+	}
+}
+
+// Track records a queued command and reports whether it did. Tracking a
+// command that is still in flight keeps its record and returns its status
+// with false; a finished command whose id is reused starts over.
+func (t *commandTracker) Track(cmd *api.Command, origin commandOrigin) (*pb.CommandStatus, bool) {
+	t.mu.Lock()
+	if record, ok := t.records[cmd.ID]; ok {
+		if !record.finished() {
+			t.mu.Unlock()
+			return record.toPB(), false
+		}
+		t.order = slices.DeleteFunc(t.order, func(id string) bool { return id == cmd.ID })
+	}
+	record := t.addLocked(cmd, origin, commandStateQueued)
+	status := record.toPB()
+	if origin.auditFailuresOnly {
+		record.command = api.ToPBCommand(cmd)
+		t.mu.Unlock()
+		return status, true
+	}
+	entry := record.auditEntry(auditEventIssued)
+	t.mu.Unlock()
+
+	entry.Command = api.ToPBCommand(cmd)
+	t.audit.Append(entry)
+	return status, true
+}
+
+// Restore tracks a command held for an offline node across a restart. Its
+// issue was audited when it was first tracked.
+func (t *commandTracker) Restore(cmd *api.Command, origin commandOrigin) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.records[cmd.ID]; !ok {
+		t.addLocked(cmd, origin, commandStateHeld)
+	}
+}
+
+func (t *commandTracker) addLocked(cmd *api.Command, origin commandOrigin, state string) *commandRecord {
+	createdAt := cmd.IssuedAt
+	if createdAt == 0 {
+		createdAt = time.Now().UnixNano()
+	}
+	record := &commandRecord{
+		id:        cmd.ID,
+		nodeID:    cmd.NodeID,
+		cmdType:   cmd.Type,
+		state:     state,
+		createdAt: createdAt,
+		deliverBy: cmd.DeliverBy,
+		origin:    origin,
+	}
+	t.records[cmd.ID] = record
+	t.order = append(t.order, cmd.ID)
+	if over := len(t.order) - t.limit; over > 0 {
+		t.order = slices.DeleteFunc(t.order, func(id string) bool {
+			if over == 0 || !t.records[id].finished() {
+				return false
+			}
+			delete(t.records, id)
+			over--
+			return true
+		})
+	}
+	return record
+}
+
+// MarkHeld records that the command waits for its offline node.
+func (t *commandTracker) MarkHeld(commandID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if record, ok := t.records[commandID]; ok && record.state == commandStateQueued {
+		record.state = commandStateHeld
+	}
+}
+
+// MarkSent records that the command was written to the node's stream.
+func (t *commandTracker) MarkSent(commandID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if record, ok := t.records[commandID]; ok && (record.state == commandStateQueued || record.state == commandStateHeld) {
+		record.state = commandStateSent
+		record.sentAt = time.Now().UnixNano()
+	}
+}
+
+// Complete records a command result. A result arriving after the server gave
+// up waiting still replaces the timed_out state, since the agent did act on
+// the command.
+func (t *commandTracker) Complete(result *api.CommandResult) {
+	t.mu.Lock()
+	record, ok := t.records[result.CommandID]
+	if !ok || (record.finished() && record.state != commandStateTimedOut) {
+		t.mu.Unlock()
+		return
+	}
+	// A late result of a timed-out command corrects an audited failure.
+	audited := record.state == commandStateTimedOut
+	switch {
+	case result.Success:
+		record.state = commandStateSucceeded
+	case result.Error == api.CommandErrorSuperseded:
+		record.state = commandStateSuperseded
+	default:
+		record.state = commandStateFailed
+	}
+	record.err = result.Error
+	record.result = result
+	record.finishedAt = result.FinishedAt
+	if record.finishedAt == 0 {
+		record.finishedAt = time.Now().UnixNano()
+	}
+	if record.origin.auditFailuresOnly && record.state == commandStateSucceeded && !audited {
+		t.mu.Unlock()
+		return
+	}
+	entry := record.auditEntry(auditEventFinished)
+	t.mu.Unlock()
+	t.audit.Append(entry)
+}
+
+// Fail ends a command that never got a result, with state failed or
+// timed_out.
+func (t *commandTracker) Fail(commandID, state string, err error) {
+	t.mu.Lock()
+	record, ok := t.records[commandID]
+	if !ok || record.finished() {
+		t.mu.Unlock()
+		return
+	}
+	record.state = state
+	record.err = err.Error()
+	record.finishedAt = time.Now().UnixNano()
+	entry := record.auditEntry(auditEventFinished)
+	t.mu.Unlock()
+	t.audit.Append(entry)
+}
+
+func (t *commandTracker) Get(commandID string) (*pb.CommandStatus, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	record, ok := t.records[commandID]
+	if !ok {
+		return nil, false
+	}
+	return record.toPB(), true
+}
+
+// List returns matching commands, newest first; empty filters match all and
+// limit <= 0 means no limit.
+func (t *commandTracker) List(nodeID string, cmdType api.CommandType, states map[string]struct{}, limit int) []*pb.CommandStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var out []*pb.CommandStatus
+	for i := len(t.order) - 1; i >= 0; i-- {
+		record := t.records[t.order[i]]
+		if nodeID != "" && record.nodeID != nodeID {
+			continue
+		}
+		if cmdType != "" && record.cmdType != cmdType {
+			continue
+		}
+		if _, ok := states[record.state]; states != nil && !ok {
+			continue
+		}
+		out = append(out, record.toPB())
+		if limit > 0 && len(out) == limit {
+			break
+		}
+	}
+	return out
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	cpupb "github.com/eWloYW8/Telemetry/agent/modules/cpu/pb"
+	infinibandpb "github.com/eWloYW8/Telemetry/agent/modules/infiniband/pb"
+	networkpb "github.com/eWloYW8/Telemetry/agent/modules/network/pb"
+	storagepb "github.com/eWloYW8/Telemetry/agent/modules/storage/pb"
+	"github.com/eWloYW8/Telemetry/api"
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+)
+
+// Derived categories carry rates computed from the counters of their source
+// category; their payload is *pb.DerivedMetrics.
+const (
+	categoryCPUPower       api.MetricCategory = "cpu_power"
+	categoryNetworkRate    api.MetricCategory = "network_rate"
+	categoryStorageRate    api.MetricCategory = "storage_rate"
+	categoryInfiniBandRate api.MetricCategory = "infiniband_rate"
+)
+
+const (
+	// diskSectorBytes is the unit of /proc/diskstats sector counters, which
+	// is 512 bytes regardless of the device's sector size.
+	diskSectorBytes = 512
+
+	// derivedMaxInterval bounds the gap between two samples that is still
+	// turned into a rate. Longer gaps only rebase the counters: RAPL may have
+	// wrapped more than once and an average over minutes is misleading.
+	derivedMaxInterval = 5 * time.Minute
+)
+
+// deriver turns monotonic counters into rates. It keeps the previous counter
+// values per node and device; a counter that goes backwards is unwrapped when
+// its wrap range is known (RAPL max_energy_range_uj) and otherwise treated as
+// a reset, which rebases the device without emitting a rate.
+type deriver struct {
+	mu    sync.Mutex
+	nodes map[string]map[string]counterSnapshot
+}
+
+type counterSnapshot struct {
+	at     int64
+	values []uint64
+}
+
+func newDeriver() *deriver {
+	return &deriver{nodes: make(map[string]map[string]counterSnapshot)}
+}
+
+// Forget drops the counter state of a node, e.g. when its agent registers
+// again after a restart.
+func (d *deriver) Forget(nodeID string) {
+	d.mu.Lock()
+	delete(d.nodes, nodeID)
+	d.mu.Unlock()
+}
+
+// Derive returns the derived samples for a batch of raw samples of a node.
+func (d *deriver) Derive(nodeID string, samples []api.MetricSample) []api.MetricSample {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state := d.nodes[nodeID]
+	if state == nil {
+		state = make(map[string]counterSnapshot)
+		d.nodes[nodeID] = state
+	}
+
+	var out []api.MetricSample
+	for _, sample := range samples {
+		var category api.MetricCategory
+		derived := &pb.DerivedMetrics{}
+		switch payload := sample.Payload.(type) {
+		case *cpupb.UltraMetrics:
+			category = categoryCPUPower
+			derived.Rapl = deriveRAPL(state, sample.At, payload)
+		case *networkpb.Metrics:
+			category = categoryNetworkRate
+			derived.Interfaces = deriveNetwork(state, sample.At, payload)
+		case *storagepb.Metrics:
+			category = categoryStorageRate
+			derived.Disks = deriveStorage(state, sample.At, payload)
+		case *infinibandpb.Metrics:
+			category = categoryInfiniBandRate
+			derived.IbPorts = deriveInfiniband(state, sample.At, payload)
+		default:
+			continue
+		}
+		if len(derived.Rapl)+len(derived.Interfaces)+len(derived.Disks)+len(derived.IbPorts) == 0 {
+			continue
+		}
+		out = append(out, api.MetricSample{Category: category, At: sample.At, Payload: derived})
+	}
+	return out
+}
+
+func deriveRAPL(state map[string]counterSnapshot, at int64, m *cpupb.UltraMetrics) []*pb.PackagePower {
+	var out []*pb.PackagePower
+	for _, rapl := range m.GetRapl() {
+		key := "rapl/" + strconv.Itoa(int(rapl.GetPackageId()))
+		rates, interval, ok := deriveRates(state, key, sampleTime(rapl.GetSampledAtUnixNano(), at),
+			[]uint64{rapl.GetEnergyMicroJ(), rapl.GetDramEnergyMicroJ()},
+			[]uint64{rapl.GetMaxEnergyRangeMicroJ(), rapl.GetDramMaxEnergyRangeMicroJ()})
+		if !ok {
+			continue
+		}
+		out = append(out, &pb.PackagePower{
+			PackageId:        rapl.GetPackageId(),
+			PackageWatts:     rates[0] / 1e6,
+			DramWatts:        rates[1] / 1e6,
+			IntervalUnixNano: interval,
+		})
+	}
+	return out
+}
+
+func deriveNetwork(state map[string]counterSnapshot, at int64, m *networkpb.Metrics) []*pb.InterfaceRate {
+	var out []*pb.InterfaceRate
+	for _, iface := range m.GetInterfaces() {
+		rates, interval, ok := deriveRates(state, "net/"+iface.GetName(), sampleTime(iface.GetSampledAtUnixNano(), at),
+			[]uint64{iface.GetRxBytes(), iface.GetTxBytes(), iface.GetRxPackets(), iface.GetTxPackets()}, nil)
+		if !ok {
+			continue
+		}
+		out = append(out, &pb.InterfaceRate{
+			Name:               iface.GetName(),
+			RxBytesPerSecond:   rates[0],
+			TxBytesPerSecond:   rates[1],
+			RxPacketsPerSecond: rates[2],
+			TxPacketsPerSecond: rates[3],
+			IntervalUnixNano:   interval,
+		})
+	}
+	return out
+}
+
+func deriveStorage(state map[string]counterSnapshot, at int64, m *storagepb.Metrics) []*pb.DiskRate {
+	var out []*pb.DiskRate
+	for _, disk := range m.GetDisks() {
+		rates, interval, ok := deriveRates(state, "disk/"+disk.GetName(), sampleTime(disk.GetSampledAtUnixNano(), at),
+			[]uint64{disk.GetReadSectors(), disk.GetWriteSectors(), disk.GetReadIos(), disk.GetWriteIos()}, nil)
+		if !ok {
+			continue
+		}
+		out = append(out, &pb.DiskRate{
+			Name:                disk.GetName(),
+			ReadBytesPerSecond:  rates[0] * diskSectorBytes,
+			WriteBytesPerSecond: rates[1] * diskSectorBytes,
+			ReadIops:            rates[2],
+			WriteIops:           rates[3],
+			IntervalUnixNano:    interval,
+		})
+	}
+	return out
+}
+
+func deriveInfiniband(state map[string]counterSnapshot, at int64, m *infinibandpb.Metrics) []*pb.IBPortRate {
+	var out []*pb.IBPortRate
+	for _, iface := range m.GetInterfaces() {
+		key := "ib/" + iface.GetIbDevice() + "/" + strconv.FormatUint(uint64(iface.GetPort()), 10) + "/" + iface.GetName()
+		rates, interval, ok := deriveRates(state, key, sampleTime(iface.GetSampledAtUnixNano(), at),
+			[]uint64{iface.GetRxBytes(), iface.GetTxBytes()}, nil)
+		if !ok {
+			continue
+		}
+		out = append(out, &pb.IBPortRate{
+			Name:             iface.GetName(),
+			IbDevice:         iface.GetIbDevice(),
+			Port:             iface.GetPort(),
+			RxBytesPerSecond: rates[0],
+			TxBytesPerSecond: rates[1],
+			IntervalUnixNano: interval,
+		})
+	}
+	return out
+}
+
+// sampleTime prefers the device's own sampling time over the batch sample
+// time, which can lag it by a collection interval.
+func sampleTime(deviceAt, sampleAt int64) int64 {
+	if deviceAt > 0 {
+		return deviceAt
+	}
+	return sampleAt
+}
+
+// deriveRates records the counters of one device and returns their per-second
+// rates since the previous snapshot. wraps holds the wrap range per counter,
+// 0 when unknown. ok is false for the first snapshot, after a reset or gap,
+// and for out-of-order samples, which leave the state untouched.
+func deriveRates(state map[string]counterSnapshot, key string, at int64, values, wraps []uint64) (rates []float64, interval int64, ok bool) {
+	prev, seen := state[key]
+	if seen && at <= prev.at {
+		return nil, 0, false
+	}
+	state[key] = counterSnapshot{at: at, values: values}
+	if !seen || len(prev.values) != len(values) {
+		return nil, 0, false
+	}
+	interval = at - prev.at
+	if interval > int64(derivedMaxInterval) {
+		return nil, 0, false
+	}
+
+	seconds := float64(interval) / float64(time.Second)
+	rates = make([]float64, len(values))
+	for i, cur := range values {
+		var wrap uint64
+		if i < len(wraps) {
+			wrap = wraps[i]
+		}
+		delta, ok := counterDelta(prev.values[i], cur, wrap)
+		if !ok {
+			return nil, 0, false
+		}
+		rates[i] = float64(delta) / seconds
+	}
+	return rates, interval, true
+}
+
+// counterDelta returns cur-prev for a monotonic counter. A decrease is a wrap
+// when the counter's range is known and prev lies within it; otherwise it is
+// a reset (agent or driver restart, device replaced) and reported as !ok.
+func counterDelta(prev, cur, wrap uint64) (uint64, bool) {
+	if cur >= prev {
+		return cur - prev, true
+	}
+	if wrap > 0 && prev <= wrap {
+		return wrap - prev + cur, true
+	}
+	return 0, false
+}
@@ -0,0 +1,74 @@
+package diskstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Records are framed as uvarint(len) | payload | crc32c(payload). The same
+// framing is used by WAL files and by segment files.
+
+const maxRecordBytes = 16 << 20
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errCorruptRecord = errors.New("corrupt record")
+
+func appendRecord(dst, payload []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(payload)))
+	dst = append(dst, payload...)
+	return binary.LittleEndian.AppendUint32(dst, crc32.Checksum(payload, crcTable))
+}
+
+type recordReader struct {
+	r      *bufio.Reader
+	offset int64
+	buf    []byte
+}
+
+func newRecordReader(r io.Reader) *recordReader {
+	return &recordReader{r: bufio.NewReaderSize(r, 64<<10)}
+}
+
+// next returns the next record payload. The returned slice is only valid
+// until the following call. io.EOF is returned on a clean end of stream and
+// errCorruptRecord on a torn or damaged record.
+func (rr *recordReader) next() ([]byte, error) {
+	size, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("%w: %v", errCorruptRecord, err)
+	}
+	if size > maxRecordBytes {
+		return nil, fmt.Errorf("%w: record size %d exceeds limit", errCorruptRecord, size)
+	}
+	need := int(size) + 4
+	if cap(rr.buf) < need {
+		rr.buf = make([]byte, need)
+	}
+	buf := rr.buf[:need]
+	if _, err := io.ReadFull(rr.r, buf); err != nil {
+		return nil, fmt.Errorf("%w: %v", errCorruptRecord, err)
+	}
+	payload := buf[:size]
+	if binary.LittleEndian.Uint32(buf[size:]) != crc32.Checksum(payload, crcTable) {
+		return nil, fmt.Errorf("%w: checksum mismatch", errCorruptRecord)
+	}
+	rr.offset += int64(uvarintLen(size) + need)
+	return payload, nil
+}
+
+func uvarintLen(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
@@ -0,0 +1,581 @@
+// Package diskstore is an embedded, append-only sample store.
+//
+// Samples are first appended to a per-partition write-ahead log and kept in
+// memory until their time partition closes. Closed partitions are sealed into
+// gzip-compressed segment files laid out as
+//
+//	<dir>/segments/<partition start>/<node>/<category>.<seal time>.seg
+//
+// after which the WAL of the partition is removed. On startup the remaining
+// WAL files are replayed, so nothing acknowledged by a WAL sync is lost.
+package diskstore
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/eWloYW8/Telemetry/api"
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+)
+
+const (
+	defaultPartition    = 15 * time.Minute
+	defaultSyncInterval = time.Second
+
+	// sealDelay keeps a partition open for late samples after it ends.
+	sealDelay = time.Minute
+
+	walSuffix     = ".wal"
+	segmentSuffix = ".seg"
+	latestFile    = "latest.pb"
+)
+
+type Options struct {
+	Dir          string
+	Partition    time.Duration
+	SyncInterval time.Duration
+}
+
+type seriesKey struct {
+	nodeID   string
+	category api.MetricCategory
+}
+
+type partition struct {
+	start    int64
+	wal      *walWriter
+	replayed []string
+	series   map[seriesKey][]api.MetricSample
+}
+
+type Store struct {
+	dir          string
+	walDir       string
+	segmentDir   string
+	partition    int64
+	syncInterval time.Duration
+
+	mu      sync.Mutex
+	open    map[int64]*partition
+	sealing map[*partition]struct{}
+	latest  map[seriesKey]api.MetricSample
+	syncErr error
+	closed  bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func Open(opts Options) (*Store, error) {
+	if opts.Dir == "" {
+		return nil, fmt.Errorf("diskstore requires a directory")
+	}
+	if opts.Partition <= 0 {
+		opts.Partition = defaultPartition
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = defaultSyncInterval
+	}
+	s := &Store{
+		dir:          opts.Dir,
+		walDir:       filepath.Join(opts.Dir, "wal"),
+		segmentDir:   filepath.Join(opts.Dir, "segments"),
+		partition:    int64(opts.Partition),
+		syncInterval: opts.SyncInterval,
+		open:         make(map[int64]*partition),
+		sealing:      make(map[*partition]struct{}),
+		latest:       make(map[seriesKey]api.MetricSample),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	for _, dir := range []string{s.walDir, s.segmentDir} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("create %s: %w", dir, err)
+		}
+	}
+	if err := s.loadLatest(); err != nil {
+		return nil, err
+	}
+	if err := s.recoverWAL(); err != nil {
+		return nil, err
+	}
+	go s.syncLoop()
+	return s, nil
+}
+
+func (s *Store) partitionStart(at int64) int64 {
+	start := at - at%s.partition
+	if at < 0 && at%s.partition != 0 {
+		start -= s.partition
+	}
+	return start
+}
+
+func (s *Store) recoverWAL() error {
+	entries, err := os.ReadDir(s.walDir)
+	if err != nil {
+		return fmt.Errorf("list wal: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, walSuffix) {
+			continue
+		}
+		startRaw, _, _ := strings.Cut(strings.TrimSuffix(name, walSuffix), "-")
+		start, err := strconv.ParseInt(startRaw, 10, 64)
+		if err != nil {
+			continue
+		}
+		part := s.openPartitionLocked(start)
+		path := filepath.Join(s.walDir, name)
+		part.replayed = append(part.replayed, path)
+		if err := replayWAL(path, func(rec *pb.TimedSample) {
+			sample := api.FromPBMetricSample(rec.GetSample())
+			s.addLocked(part, rec.GetNodeId(), sample)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) openPartitionLocked(start int64) *partition {
+	part, ok := s.open[start]
+	if !ok {
+		part = &partition{
+			start:  start,
+			series: make(map[seriesKey][]api.MetricSample),
+		}
+		s.open[start] = part
+	}
+	return part
+}
+
+func (s *Store) addLocked(part *partition, nodeID string, sample api.MetricSample) {
+	key := seriesKey{nodeID: nodeID, category: sample.Category}
+	part.series[key] = append(part.series[key], sample)
+	if prev, ok := s.latest[key]; !ok || sample.At >= prev.At {
+		s.latest[key] = sample
+	}
+}
+
+func (s *Store) Append(nodeID string, samples []api.MetricSample) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("diskstore is closed")
+	}
+	if err := s.syncErr; err != nil {
+		s.syncErr = nil
+		return err
+	}
+	for _, sample := range samples {
+		if sample.Category == "" {
+			continue
+		}
+		part := s.openPartitionLocked(s.partitionStart(sample.At))
+		if part.wal == nil {
+			wal, err := openWAL(filepath.Join(s.walDir, fmt.Sprintf("%d-%d%s", part.start, time.Now().UnixNano(), walSuffix)))
+			if err != nil {
+				return err
+			}
+			part.wal = wal
+		}
+		if err := part.wal.append(&pb.TimedSample{NodeId: nodeID, Sample: api.ToPBMetricSample(sample)}); err != nil {
+			return err
+		}
+		s.addLocked(part, nodeID, sample)
+	}
+	return nil
+}
+
+// Query returns the samples of a node within [from, to] ordered by time. An
+// empty category selects all categories; non-positive bounds are open.
+func (s *Store) Query(nodeID string, category api.MetricCategory, from, to int64) ([]api.MetricSample, error) {
+	inRange := func(at int64) bool {
+		return at >= from && (to <= 0 || at <= to)
+	}
+	out := make([]api.MetricSample, 0, 256)
+
+	// In-memory partitions are copied before segment files are listed, so a
+	// partition sealed in between is seen twice rather than not at all.
+	s.mu.Lock()
+	parts := make([]*partition, 0, len(s.open)+len(s.sealing))
+	for _, part := range s.open {
+		parts = append(parts, part)
+	}
+	for part := range s.sealing {
+		parts = append(parts, part)
+	}
+	for _, part := range parts {
+		for key, samples := range part.series {
+			if key.nodeID != nodeID || (category != "" && key.category != category) {
+				continue
+			}
+			for _, sample := range samples {
+				if inRange(sample.At) {
+					out = append(out, sample)
+				}
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	starts, err := s.segmentPartitions()
+	if err != nil {
+		return nil, err
+	}
+	for _, start := range starts {
+		if start+s.partition <= from || (to > 0 && start > to) {
+			continue
+		}
+		files, err := s.segmentFiles(start, nodeID, category)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range files {
+			if err := readSegment(path, func(sample api.MetricSample) {
+				if inRange(sample.At) {
+					out = append(out, sample)
+				}
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].At < out[j].At
+	})
+	return dedupe(out), nil
+}
+
+// dedupe drops samples repeated by a crash between sealing a partition and
+// removing its WAL. Input must be ordered by time.
+func dedupe(samples []api.MetricSample) []api.MetricSample {
+	if len(samples) < 2 {
+		return samples
+	}
+	out := samples[:1]
+	for _, sample := range samples[1:] {
+		dup := false
+		for i := len(out) - 1; i >= 0 && out[i].At == sample.At; i-- {
+			if out[i].Category == sample.Category {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			out = append(out, sample)
+		}
+	}
+	return out
+}
+
+func (s *Store) segmentPartitions() ([]int64, error) {
+	entries, err := os.ReadDir(s.segmentDir)
+	if err != nil {
+		return nil, fmt.Errorf("list segments: %w", err)
+	}
+	out := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		start, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		out = append(out, start)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out, nil
+}
+
+func (s *Store) segmentFiles(start int64, nodeID string, category api.MetricCategory) ([]string, error) {
+	dir := filepath.Join(s.segmentDir, strconv.FormatInt(start, 10), escapeName(nodeID))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("list segments of %s: %w", dir, err)
+	}
+	prefix := ""
+	if category != "" {
+		prefix = escapeName(string(category)) + "."
+	}
+	out := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		out = append(out, filepath.Join(dir, name))
+	}
+	return out, nil
+}
+
+// Latest returns the most recent sample of every node and category known to
+// the store, including those recovered from a previous run.
+func (s *Store) Latest() (map[string][]api.MetricSample, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string][]api.MetricSample)
+	for key, sample := range s.latest {
+		out[key.nodeID] = append(out[key.nodeID], sample)
+	}
+	return out, nil
+}
+
+// DeleteNode drops a node from the latest-sample index. Its segments stay
+// until they age out.
+func (s *Store) DeleteNode(nodeID string) error {
+	s.mu.Lock()
+	for key := range s.latest {
+		if key.nodeID == nodeID {
+			delete(s.latest, key)
+		}
+	}
+	s.mu.Unlock()
+	return s.saveLatest()
+}
+
+// Prune seals partitions that ended more than sealDelay ago and removes all
+// data that ends before cutoff.
+func (s *Store) Prune(now time.Time, cutoff int64) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	var seal []*partition
+	var expired []*partition
+	for start, part := range s.open {
+		end := start + s.partition
+		switch {
+		case end <= cutoff:
+			expired = append(expired, part)
+			delete(s.open, start)
+		case end+int64(sealDelay) <= now.UnixNano():
+			seal = append(seal, part)
+			delete(s.open, start)
+			s.sealing[part] = struct{}{}
+		}
+	}
+	for key, sample := range s.latest {
+		if sample.At < cutoff {
+			delete(s.latest, key)
+		}
+	}
+	s.mu.Unlock()
+
+	var errs []error
+	for _, part := range expired {
+		errs = append(errs, part.removeWAL())
+	}
+	for _, part := range seal {
+		errs = append(errs, s.seal(part))
+	}
+	if len(seal) > 0 {
+		errs = append(errs, s.saveLatest())
+	}
+
+	starts, err := s.segmentPartitions()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, start := range starts {
+		if start+s.partition > cutoff {
+			break
+		}
+		if err := os.RemoveAll(filepath.Join(s.segmentDir, strconv.FormatInt(start, 10))); err != nil {
+			errs = append(errs, fmt.Errorf("remove expired partition %d: %w", start, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Store) seal(part *partition) (err error) {
+	if part.wal != nil {
+		err = part.wal.close()
+		part.replayed = append(part.replayed, part.wal.path)
+		part.wal = nil
+	}
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.sealing, part)
+		if err != nil {
+			s.requeueLocked(part)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	sealedAt := time.Now().UnixNano()
+	partDir := filepath.Join(s.segmentDir, strconv.FormatInt(part.start, 10))
+	for key, samples := range part.series {
+		if len(samples) == 0 {
+			continue
+		}
+		// Queries may still read part.series while it is being sealed.
+		samples = append([]api.MetricSample(nil), samples...)
+		sort.SliceStable(samples, func(i, j int) bool {
+			return samples[i].At < samples[j].At
+		})
+		nodeDir := filepath.Join(partDir, escapeName(key.nodeID))
+		if err := os.MkdirAll(nodeDir, 0o755); err != nil {
+			return fmt.Errorf("create segment dir %s: %w", nodeDir, err)
+		}
+		name := fmt.Sprintf("%s.%d%s", escapeName(string(key.category)), sealedAt, segmentSuffix)
+		if err := writeSegment(filepath.Join(nodeDir, name), samples); err != nil {
+			return err
+		}
+	}
+	return part.removeWAL()
+}
+
+// requeueLocked returns a partition that failed to seal to the open set so
+// that the next Prune retries it. Its WAL files stay on disk meanwhile.
+func (s *Store) requeueLocked(part *partition) {
+	current, ok := s.open[part.start]
+	if !ok {
+		s.open[part.start] = part
+		return
+	}
+	current.replayed = append(current.replayed, part.replayed...)
+	for key, samples := range part.series {
+		current.series[key] = append(samples, current.series[key]...)
+	}
+}
+
+func (p *partition) removeWAL() error {
+	paths := append([]string(nil), p.replayed...)
+	if p.wal != nil {
+		_ = p.wal.file.Close()
+		paths = append(paths, p.wal.path)
+	}
+	var errs []error
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("remove wal %s: %w", path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Store) syncLoop() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			for _, part := range s.open {
+				if part.wal == nil {
+					continue
+				}
+				if err := part.wal.sync(); err != nil && s.syncErr == nil {
+					s.syncErr = err
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// loadLatest restores the latest-sample index written by the previous run.
+func (s *Store) loadLatest() error {
+	raw, err := os.ReadFile(filepath.Join(s.dir, latestFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read latest index: %w", err)
+	}
+	var msg pb.SamplesResponse
+	if err := proto.Unmarshal(raw, &msg); err != nil {
+		return nil
+	}
+	for _, rec := range msg.GetSamples() {
+		sample := api.FromPBMetricSample(rec.GetSample())
+		key := seriesKey{nodeID: rec.GetNodeId(), category: sample.Category}
+		if prev, ok := s.latest[key]; !ok || sample.At >= prev.At {
+			s.latest[key] = sample
+		}
+	}
+	return nil
+}
+
+func (s *Store) saveLatest() error {
+	s.mu.Lock()
+	msg := &pb.SamplesResponse{Samples: make([]*pb.TimedSample, 0, len(s.latest))}
+	for key, sample := range s.latest {
+		msg.Samples = append(msg.Samples, &pb.TimedSample{NodeId: key.nodeID, Sample: api.ToPBMetricSample(sample)})
+	}
+	s.mu.Unlock()
+
+	raw, err := proto.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("encode latest index: %w", err)
+	}
+	path := filepath.Join(s.dir, latestFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return fmt.Errorf("write latest index: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("rename latest index: %w", err)
+	}
+	return nil
+}
+
+// Close syncs all WAL files. Open partitions are not sealed; their WAL is
+// replayed on the next Open.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.stop)
+	<-s.done
+
+	s.mu.Lock()
+	var errs []error
+	for _, part := range s.open {
+		if part.wal != nil {
+			errs = append(errs, part.wal.close())
+		}
+	}
+	s.mu.Unlock()
+	errs = append(errs, s.saveLatest())
+	return errors.Join(errs...)
+}
+
+// escapeName turns a node ID or category into a single safe path element.
+func escapeName(v string) string {
+	escaped := url.PathEscape(v)
+	if strings.HasPrefix(escaped, ".") {
+		escaped = "%2E" + escaped[1:]
+	}
+	return escaped
+}
@@ -0,0 +1,99 @@
+package diskstore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+)
+
+// walWriter appends pb.TimedSample records to the write-ahead log of one
+// partition. Writes are buffered; sync flushes and fsyncs them.
+type walWriter struct {
+	path  string
+	file  *os.File
+	w     *bufio.Writer
+	buf   []byte
+	dirty bool
+}
+
+func openWAL(path string) (*walWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open wal %s: %w", path, err)
+	}
+	return &walWriter{
+		path: path,
+		file: f,
+		w:    bufio.NewWriterSize(f, 256<<10),
+	}, nil
+}
+
+func (w *walWriter) append(rec *pb.TimedSample) error {
+	payload, err := proto.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encode wal record: %w", err)
+	}
+	w.buf = appendRecord(w.buf[:0], payload)
+	if _, err := w.w.Write(w.buf); err != nil {
+		return fmt.Errorf("write wal %s: %w", w.path, err)
+	}
+	w.dirty = true
+	return nil
+}
+
+func (w *walWriter) sync() error {
+	if !w.dirty {
+		return nil
+	}
+	if err := w.w.Flush(); err != nil {
+		return fmt.Errorf("flush wal %s: %w", w.path, err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("sync wal %s: %w", w.path, err)
+	}
+	w.dirty = false
+	return nil
+}
+
+func (w *walWriter) close() error {
+	err := w.sync()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// replayWAL decodes every intact record of a WAL file. A torn tail left by a
+// crash is truncated so that subsequent appends start on a record boundary.
+func replayWAL(path string, fn func(*pb.TimedSample)) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("open wal %s: %w", path, err)
+	}
+	defer f.Close()
+
+	rr := newRecordReader(f)
+	for {
+		payload, err := rr.next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			if terr := f.Truncate(rr.offset); terr != nil {
+				return fmt.Errorf("truncate wal %s: %w", path, terr)
+			}
+			return nil
+		}
+		var rec pb.TimedSample
+		if err := proto.Unmarshal(payload, &rec); err != nil {
+			continue
+		}
+		fn(&rec)
+	}
+}
@@ -0,0 +1,516 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+	"github.com/eWloYW8/Telemetry/config"
+)
+
+const (
+	enrollmentTokensFile = "enrollment_tokens.pb"
+
+	enrollmentTokenActive  = "active"
+	enrollmentTokenUsed    = "used"
+	enrollmentTokenExpired = "expired"
+
+	auditEventEnrolled = "enrolled"
+	auditEventRenewed  = "renewed"
+
+	// certBackdate covers clock skew between the server and new agents.
+	certBackdate = 5 * time.Minute
+)
+
+var (
+	errEnrollmentDisabled         = errors.New("enrollment is not configured")
+	errEnrollmentTokenNotFound    = errors.New("enrollment token not found")
+	errInvalidEnrollmentToken     = errors.New("invalid enrollment token")
+	errEnrollmentTokenUsed        = errors.New("enrollment token already used")
+	errEnrollmentTokenExpired     = errors.New("enrollment token expired")
+	errEnrollmentTokenWrongNode   = errors.New("enrollment token is for another node")
+	errEnrollmentTokenUnbound     = errors.New("node is known; enroll it with a token bound to its node_id")
+	errEnrollmentNodeConnected    = errors.New("node is connected; renew its certificate instead")
+	errEnrollmentExpiryOutOfRange = errors.New("expires_at must be in the future")
+)
+
+// certIssuer signs node certificates with the enrollment CA.
+type certIssuer struct {
+	cert     *x509.Certificate
+	chainPEM []byte
+	key      crypto.Signer
+	ttl      time.Duration
+	template string
+}
+
+func newCertIssuer(cfg config.EnrollmentConfig, identityTemplate string) (*certIssuer, error) {
+	pair, err := tls.LoadX509KeyPair(cfg.CACertFile, cfg.CAKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load enrollment ca: %w", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse enrollment ca: %w", err)
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("enrollment ca %s is not a CA certificate", cert.Subject)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("enrollment ca key cannot sign")
+	}
+	var chain []byte
+	for _, der := range pair.Certificate {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return &certIssuer{cert: cert, chainPEM: chain, key: key, ttl: cfg.CertTTL, template: identityTemplate}, nil
+}
+
+// issued reports whether the CA signed a certificate.
+func (c *certIssuer) issued(cert *x509.Certificate) bool {
+	return cert != nil && cert.CheckSignatureFrom(c.cert) == nil
+}
+
+// parseCSR decodes a PEM certificate request and checks its signature.
+func parseCSR(csrPEM string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("csr_pem is not a PEM certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse csr: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("csr signature: %w", err)
+	}
+	return csr, nil
+}
+
+// sign issues a client certificate for a node to the key of a CSR. Only the
+// CSR's public key is used: the subject and names come from the node ID, as
+// the node identity policy expects them.
+func (c *certIssuer) sign(csr *x509.CertificateRequest, nodeID string, now time.Time) ([]byte, time.Time, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("generate serial: %w", err)
+	}
+	notAfter := now.Add(c.ttl)
+	if notAfter.After(c.cert.NotAfter) {
+		notAfter = c.cert.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: nodeID},
+		NotBefore:    now.Add(-certBackdate),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	name := strings.ReplaceAll(c.template, nodeIDPlaceholder, nodeID)
+	if u, err := url.Parse(name); err == nil && u.Scheme != "" {
+		tmpl.URIs = []*url.URL{u}
+	} else {
+		tmpl.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.cert, csr.PublicKey, c.key)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("sign certificate: %w", err)
+	}
+	out := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return append(out, c.chainPEM...), notAfter, nil
+}
+
+type enrollmentToken struct {
+	token *pb.EnrollmentToken
+	hash  [sha256.Size]byte
+}
+
+// enrollmentTokens holds the bootstrap tokens by their SHA-256, persisted so
+// that tokens handed out survive a restart.
+type enrollmentTokens struct {
+	mu     sync.Mutex
+	path   string
+	ttl    time.Duration
+	tokens map[string]*enrollmentToken
+}
+
+func newEnrollmentTokens(dir string, ttl time.Duration) (*enrollmentTokens, error) {
+	t := &enrollmentTokens{ttl: ttl, tokens: make(map[string]*enrollmentToken)}
+	if dir != "" {
+		t.path = filepath.Join(dir, enrollmentTokensFile)
+		if err := t.load(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func tokenState(tok *pb.EnrollmentToken, now time.Time) string {
+	switch {
+	case tok.GetUsedAtUnixNano() > 0:
+		return enrollmentTokenUsed
+	case tok.GetExpiresAtUnixNano() <= now.UnixNano():
+		return enrollmentTokenExpired
+	default:
+		return enrollmentTokenActive
+	}
+}
+
+// Create issues a token and returns it with its secret, which is not kept.
+func (t *enrollmentTokens) Create(req *pb.CreateEnrollmentTokenRequest, createdBy string, now time.Time) (*pb.EnrollmentToken, error) {
+	expiresAt := req.GetExpiresAtUnixNano()
+	if expiresAt == 0 {
+		expiresAt = now.Add(t.ttl).UnixNano()
+	}
+	if expiresAt <= now.UnixNano() {
+		return nil, errEnrollmentExpiryOutOfRange
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("generate token: %w", err)
+	}
+	value := hex.EncodeToString(secret)
+	entry := &enrollmentToken{
+		token: &pb.EnrollmentToken{
+			Id:                uuid.NewString(),
+			NodeId:            strings.TrimSpace(req.GetNodeId()),
+			CreatedBy:         createdBy,
+			CreatedAtUnixNano: now.UnixNano(),
+			ExpiresAtUnixNano: expiresAt,
+		},
+		hash: sha256.Sum256([]byte(value)),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens[entry.token.GetId()] = entry
+	if err := t.saveLocked(); err != nil {
+		delete(t.tokens, entry.token.GetId())
+		return nil, err
+	}
+	out := t.viewLocked(entry, now)
+	out.Token = value
+	return out, nil
+}
+
+// List returns every token, newest first, without secrets.
+func (t *enrollmentTokens) List(now time.Time) []*pb.EnrollmentToken {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]*pb.EnrollmentToken, 0, len(t.tokens))
+	for _, entry := range t.tokens {
+		out = append(out, t.viewLocked(entry, now))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].GetCreatedAtUnixNano() > out[j].GetCreatedAtUnixNano() })
+	return out
+}
+
+// Revoke deletes a token, used or not.
+func (t *enrollmentTokens) Revoke(id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.tokens[id]
+	if !ok {
+		return fmt.Errorf("token %s: %w", id, errEnrollmentTokenNotFound)
+	}
+	delete(t.tokens, id)
+	if err := t.saveLocked(); err != nil {
+		t.tokens[id] = entry
+		return err
+	}
+	return nil
+}
+
+// Redeem marks the token with the given secret used by a node. The check
+// and the marking happen under one lock, so a token enrolls one node only.
+// A node the server already knows can only be enrolled with a token bound to
+// it, so that an unbound token cannot take over an existing node's identity.
+func (t *enrollmentTokens) Redeem(value, nodeID string, known bool, now time.Time) (*pb.EnrollmentToken, error) {
+	hash := sha256.Sum256([]byte(value))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var entry *enrollmentToken
+	for _, candidate := range t.tokens {
+		if candidate.hash == hash {
+			entry = candidate
+			break
+		}
+	}
+	if entry == nil {
+		return nil, errInvalidEnrollmentToken
+	}
+	switch tokenState(entry.token, now) {
+	case enrollmentTokenUsed:
+		return nil, fmt.Errorf("token %s: %w", entry.token.GetId(), errEnrollmentTokenUsed)
+	case enrollmentTokenExpired:
+		return nil, fmt.Errorf("token %s: %w", entry.token.GetId(), errEnrollmentTokenExpired)
+	}
+	bound := entry.token.GetNodeId()
+	if bound != "" && bound != nodeID {
+		return nil, fmt.Errorf("token %s: %w", entry.token.GetId(), errEnrollmentTokenWrongNode)
+	}
+	if bound == "" && known {
+		return nil, fmt.Errorf("token %s: node %s: %w", entry.token.GetId(), nodeID, errEnrollmentTokenUnbound)
+	}
+
+	prev := entry.token
+	entry.token = proto.Clone(prev).(*pb.EnrollmentToken)
+	entry.token.UsedAtUnixNano = now.UnixNano()
+	entry.token.UsedBy = nodeID
+	if err := t.saveLocked(); err != nil {
+		entry.token = prev
+		return nil, err
+	}
+	return t.viewLocked(entry, now), nil
+}
+
+func (t *enrollmentTokens) viewLocked(entry *enrollmentToken, now time.Time) *pb.EnrollmentToken {
+	out := proto.Clone(entry.token).(*pb.EnrollmentToken)
+	out.State = tokenState(out, now)
+	return out
+}
+
+func (t *enrollmentTokens) saveLocked() error {
+	if t.path == "" {
+		return nil
+	}
+	ids := make([]string, 0, len(t.tokens))
+	for id := range t.tokens {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	snapshot := &pb.EnrollmentTokenSnapshot{}
+	for _, id := range ids {
+		entry := t.tokens[id]
+		snapshot.Tokens = append(snapshot.Tokens, &pb.EnrollmentTokenRecord{Token: entry.token, Sha256: entry.hash[:]})
+	}
+
+	raw, err := proto.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("encode enrollment tokens: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0o755); err != nil {
+		return fmt.Errorf("create enrollment tokens dir: %w", err)
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		return fmt.Errorf("write enrollment tokens: %w", err)
+	}
+	if err := os.Rename(tmp, t.path); err != nil {
+		return fmt.Errorf("rename enrollment tokens: %w", err)
+	}
+	return nil
+}
+
+func (t *enrollmentTokens) load() error {
+	raw, err := os.ReadFile(t.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read enrollment tokens: %w", err)
+	}
+	var snapshot pb.EnrollmentTokenSnapshot
+	if err := proto.Unmarshal(raw, &snapshot); err != nil {
+		return fmt.Errorf("decode enrollment tokens: %w", err)
+	}
+	for _, record := range snapshot.GetTokens() {
+		if record.GetToken().GetId() == "" || len(record.GetSha256()) != sha256.Size {
+			continue
+		}
+		entry := &enrollmentToken{token: record.GetToken()}
+		copy(entry.hash[:], record.GetSha256())
+		t.tokens[entry.token.GetId()] = entry
+	}
+	return nil
+}
+
+func (s *Server) auditEnrollment(event, nodeID, user, source, remoteAddr string, err error) {
+	entry := &pb.AuditEntry{
+		TimeUnixNano: time.Now().UnixNano(),
+		Event:        event,
+		NodeId:       nodeID,
+		User:         user,
+		RemoteAddr:   remoteAddr,
+		Source:       source,
+		State:        "issued",
+	}
+	if err != nil {
+		entry.State = "rejected"
+		entry.Error = err.Error()
+	}
+	s.audit.Append(entry)
+}
+
+func (s *Server) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	if s.issuer == nil {
+		writeError(w, http.StatusNotFound, errEnrollmentDisabled)
+		return
+	}
+	var req pb.EnrollRequest
+	if err := decodeProto(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	nodeID := strings.TrimSpace(req.GetNodeId())
+	if nodeID == "" {
+		writeError(w, http.StatusBadRequest, errMissingCommandNodeID)
+		return
+	}
+	reject := func(code int, tokenID string, err error) {
+		s.log.Warn().Err(err).Str("node_id", nodeID).Str("remote_addr", r.RemoteAddr).Msg("enrollment rejected")
+		s.auditEnrollment(auditEventEnrolled, nodeID, tokenID, "http", r.RemoteAddr, err)
+		writeError(w, code, err)
+	}
+	if _, ok := s.getSession(nodeID); ok {
+		reject(http.StatusConflict, "", fmt.Errorf("node %s: %w", nodeID, errEnrollmentNodeConnected))
+		return
+	}
+
+	// Check the CSR before the token is spent on it.
+	csr, err := parseCSR(req.GetCsrPem())
+	if err != nil {
+		reject(http.StatusBadRequest, "", err)
+		return
+	}
+	now := time.Now()
+	token, err := s.enrollTokens.Redeem(req.GetToken(), nodeID, s.store.NodeKnown(nodeID), now)
+	switch {
+	case errors.Is(err, errEnrollmentTokenWrongNode), errors.Is(err, errEnrollmentTokenUnbound):
+		reject(http.StatusForbidden, "", err)
+		return
+	case errors.Is(err, errInvalidEnrollmentToken), errors.Is(err, errEnrollmentTokenUsed), errors.Is(err, errEnrollmentTokenExpired):
+		reject(http.StatusUnauthorized, "", err)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	certPEM, notAfter, err := s.issuer.sign(csr, nodeID, now)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	caPEM, err := os.ReadFile(s.cfg.TLS.CAFile)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("read server ca file: %w", err))
+		return
+	}
+
+	s.auditEnrollment(auditEventEnrolled, nodeID, token.GetId(), "http", r.RemoteAddr, nil)
+	s.log.Info().
+		Str("node_id", nodeID).
+		Str("token_id", token.GetId()).
+		Time("expires_at", notAfter).
+		Str("remote_addr", r.RemoteAddr).
+		Msg("node enrolled")
+	writeProto(w, http.StatusOK, &pb.EnrollResponse{
+		CertificatePem:    string(certPEM),
+		CaPem:             string(caPEM),
+		ExpiresAtUnixNano: notAfter.UnixNano(),
+	})
+}
+
+// RenewCertificate issues a new certificate for the node of the calling
+// agent's certificate, which must come from the enrollment CA.
+func (s *Server) RenewCertificate(ctx context.Context, req *pb.RenewCertificateRequest) (*pb.RenewCertificateResponse, error) {
+	if s.issuer == nil {
+		return nil, status.Error(codes.FailedPrecondition, errEnrollmentDisabled.Error())
+	}
+	cert := peerCertificate(ctx)
+	remoteAddr := peerIPFromContext(ctx)
+	if !s.issuer.issued(cert) {
+		err := errors.New("client certificate was not issued by enrollment")
+		var subject string
+		if cert != nil {
+			subject = cert.Subject.String()
+		}
+		s.auditEnrollment(auditEventRenewed, "", subject, "grpc", remoteAddr, err)
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	nodeID := cert.Subject.CommonName
+	csr, err := parseCSR(req.GetCsrPem())
+	if err != nil {
+		s.auditEnrollment(auditEventRenewed, nodeID, cert.Subject.String(), "grpc", remoteAddr, err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	certPEM, notAfter, err := s.issuer.sign(csr, nodeID, time.Now())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	s.auditEnrollment(auditEventRenewed, nodeID, cert.Subject.String(), "grpc", remoteAddr, nil)
+	s.log.Info().Str("node_id", nodeID).Time("expires_at", notAfter).Msg("node certificate renewed")
+	return &pb.RenewCertificateResponse{CertificatePem: string(certPEM), ExpiresAtUnixNano: notAfter.UnixNano()}, nil
+}
+
+func (s *Server) handleListEnrollmentTokens(w http.ResponseWriter, _ *http.Request) {
+	writeProto(w, http.StatusOK, &pb.EnrollmentTokensResponse{Tokens: s.enrollTokens.List(time.Now())})
+}
+
+func (s *Server) handleCreateEnrollmentToken(w http.ResponseWriter, r *http.Request) {
+	if s.issuer == nil {
+		writeError(w, http.StatusNotFound, errEnrollmentDisabled)
+		return
+	}
+	var req pb.CreateEnrollmentTokenRequest
+	if err := decodeOptionalProto(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	token, err := s.enrollTokens.Create(&req, authIdentityFrom(r.Context()).identityName(), time.Now())
+	switch {
+	case errors.Is(err, errEnrollmentExpiryOutOfRange):
+		writeError(w, http.StatusBadRequest, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.log.Info().
+		Str("token_id", token.GetId()).
+		Str("node_id", token.GetNodeId()).
+		Str("created_by", token.GetCreatedBy()).
+		Time("expires_at", time.Unix(0, token.GetExpiresAtUnixNano())).
+		Msg("enrollment token created")
+	writeProto(w, http.StatusCreated, token)
+}
+
+func (s *Server) handleRevokeEnrollmentToken(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "tokenID")
+	err := s.enrollTokens.Revoke(id)
+	switch {
+	case errors.Is(err, errEnrollmentTokenNotFound):
+		writeError(w, http.StatusNotFound, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.log.Info().Str("token_id", id).Msg("enrollment token revoked")
+	writeProto(w, http.StatusNoContent, nil)
+}
@@ -0,0 +1,640 @@
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	cpupb "github.com/eWloYW8/Telemetry/agent/modules/cpu/pb"
+	gpupb "github.com/eWloYW8/Telemetry/agent/modules/gpu/pb"
+	infinibandpb "github.com/eWloYW8/Telemetry/agent/modules/infiniband/pb"
+	memorypb "github.com/eWloYW8/Telemetry/agent/modules/memory/pb"
+	networkpb "github.com/eWloYW8/Telemetry/agent/modules/network/pb"
+	processpb "github.com/eWloYW8/Telemetry/agent/modules/process/pb"
+	storagepb "github.com/eWloYW8/Telemetry/agent/modules/storage/pb"
+	"github.com/eWloYW8/Telemetry/api"
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+)
+
+const (
+	// exportWindow bounds how much history of one node is loaded at a time;
+	// rows are written and flushed after every window.
+	exportWindow       = 15 * time.Minute
+	exportWriteTimeout = time.Minute
+)
+
+// exportCategories lists the exportable categories in output order with the
+// payload message of each.
+var exportCategories = []struct {
+	category api.MetricCategory
+	message  proto.Message
+}{
+	{"cpu_ultra_fast", (*cpupb.UltraMetrics)(nil)},
+	{"cpu_medium", (*cpupb.MediumMetrics)(nil)},
+	{"gpu_fast", (*gpupb.FastMetrics)(nil)},
+	{"amdgpu_fast", (*gpupb.FastMetrics)(nil)},
+	{"memory", (*memorypb.Metrics)(nil)},
+	{"storage", (*storagepb.Metrics)(nil)},
+	{"network", (*networkpb.Metrics)(nil)},
+	{"infiniband", (*infinibandpb.Metrics)(nil)},
+	{"process", (*processpb.Metrics)(nil)},
+	{categoryCPUPower, (*pb.DerivedMetrics)(nil)},
+	{categoryNetworkRate, (*pb.DerivedMetrics)(nil)},
+	{categoryStorageRate, (*pb.DerivedMetrics)(nil)},
+	{categoryInfiniBandRate, (*pb.DerivedMetrics)(nil)},
+}
+
+type exportKind int
+
+const (
+	exportKindInt exportKind = iota
+	exportKindFloat
+	exportKindBool
+	exportKindString
+)
+
+type exportColumn struct {
+	name string
+	kind exportKind
+}
+
+// exportValue is one cell; set is false for columns that do not apply to the
+// row's record.
+type exportValue struct {
+	set bool
+	i   int64
+	f   float64
+	b   bool
+	s   string
+}
+
+// Fixed leading columns of every export.
+const (
+	exportColNode = iota
+	exportColCategory
+	exportColTimestamp
+	exportColRecord
+)
+
+// exportField maps a payload field to its column. Singular nested messages
+// are flattened into sub with an underscore-joined prefix.
+type exportField struct {
+	fd  protoreflect.FieldDescriptor
+	col int
+	sub []exportField
+}
+
+// exportRecord describes how one payload list becomes rows: each element of
+// list is a row named after the list field. A record with a nil list holds
+// the payload's top-level scalars and yields one row per sample.
+type exportRecord struct {
+	list   protoreflect.FieldDescriptor
+	name   string
+	fields []exportField
+}
+
+// exportSchema is the flat table layout of an export, derived from the
+// payload descriptors before any row is written so every format can emit its
+// header up front.
+type exportSchema struct {
+	columns []exportColumn
+	index   map[string]int
+	records map[api.MetricCategory][]exportRecord
+}
+
+func newExportSchema(categories []api.MetricCategory) *exportSchema {
+	s := &exportSchema{
+		columns: []exportColumn{
+			exportColNode:      {name: "node_id", kind: exportKindString},
+			exportColCategory:  {name: "category", kind: exportKindString},
+			exportColTimestamp: {name: "timestamp_unix_nano", kind: exportKindInt},
+			exportColRecord:    {name: "record", kind: exportKindString},
+		},
+		index:   make(map[string]int),
+		records: make(map[api.MetricCategory][]exportRecord, len(categories)),
+	}
+	for i, col := range s.columns {
+		s.index[col.name] = i
+	}
+
+	for _, category := range categories {
+		desc := exportCategoryMessage(category).ProtoReflect().Descriptor()
+		top := exportRecord{}
+		var lists []exportRecord
+		fields := desc.Fields()
+		for i := 0; i < fields.Len(); i++ {
+			fd := fields.Get(i)
+			if fd.IsList() && fd.Kind() == protoreflect.MessageKind {
+				lists = append(lists, exportRecord{
+					list:   fd,
+					name:   string(fd.Name()),
+					fields: s.addFields(fd.Message(), ""),
+				})
+				continue
+			}
+			top.fields = append(top.fields, s.addField(fd, "")...)
+		}
+		if len(top.fields) > 0 {
+			lists = append([]exportRecord{top}, lists...)
+		}
+		s.records[category] = lists
+	}
+	return s
+}
+
+func (s *exportSchema) addFields(desc protoreflect.MessageDescriptor, prefix string) []exportField {
+	var out []exportField
+	fields := desc.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		out = append(out, s.addField(fields.Get(i), prefix)...)
+	}
+	return out
+}
+
+// addField registers the column of fd and returns its mapping. Repeated
+// messages and maps below the record level are not exported.
+func (s *exportSchema) addField(fd protoreflect.FieldDescriptor, prefix string) []exportField {
+	name := prefix + string(fd.Name())
+	switch {
+	case fd.IsMap(), fd.IsList() && fd.Kind() == protoreflect.MessageKind:
+		return nil
+	case fd.Kind() == protoreflect.MessageKind:
+		sub := s.addFields(fd.Message(), name+"_")
+		if len(sub) == 0 {
+			return nil
+		}
+		return []exportField{{fd: fd, col: -1, sub: sub}}
+	}
+
+	kind := exportFieldKind(fd)
+	col, ok := s.index[name]
+	if !ok {
+		col = len(s.columns)
+		s.columns = append(s.columns, exportColumn{name: name, kind: kind})
+		s.index[name] = col
+	} else {
+		s.columns[col].kind = unifyExportKind(s.columns[col].kind, kind)
+	}
+	return []exportField{{fd: fd, col: col}}
+}
+
+func exportFieldKind(fd protoreflect.FieldDescriptor) exportKind {
+	if fd.IsList() {
+		// Repeated scalars such as core_ids or ips are joined with commas.
+		return exportKindString
+	}
+	switch fd.Kind() {
+	case protoreflect.Int32Kind, protoreflect.Int64Kind, protoreflect.Sint32Kind, protoreflect.Sint64Kind,
+		protoreflect.Sfixed32Kind, protoreflect.Sfixed64Kind,
+		protoreflect.Uint32Kind, protoreflect.Uint64Kind, protoreflect.Fixed32Kind, protoreflect.Fixed64Kind:
+		return exportKindInt
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return exportKindFloat
+	case protoreflect.BoolKind:
+		return exportKindBool
+	default:
+		return exportKindString
+	}
+}
+
+// unifyExportKind picks a column type that holds values of both kinds when
+// categories disagree on a field of the same name.
+func unifyExportKind(a, b exportKind) exportKind {
+	switch {
+	case a == b:
+		return a
+	case (a == exportKindInt && b == exportKindFloat) || (a == exportKindFloat && b == exportKindInt):
+		return exportKindFloat
+	default:
+		return exportKindString
+	}
+}
+
+func exportCategoryMessage(category api.MetricCategory) proto.Message {
+	for _, c := range exportCategories {
+		if c.category == category {
+			return c.message
+		}
+	}
+	return nil
+}
+
+// writeRows emits the rows of one sample. row is reused between calls.
+func (s *exportSchema) writeRows(w exportWriter, row []exportValue, sample api.TimedSample) error {
+	records := s.records[sample.Category]
+	msg, ok := sample.Payload.(proto.Message)
+	if len(records) == 0 || !ok || msg == nil {
+		return nil
+	}
+	m := msg.ProtoReflect()
+	if !m.IsValid() {
+		return nil
+	}
+
+	emit := func(record exportRecord, elem protoreflect.Message) error {
+		clear(row)
+		row[exportColNode] = exportValue{set: true, s: sample.NodeID}
+		row[exportColCategory] = exportValue{set: true, s: string(sample.Category)}
+		row[exportColTimestamp] = exportValue{set: true, i: sample.At}
+		row[exportColRecord] = exportValue{set: true, s: record.name}
+		s.fill(row, record.fields, elem)
+		return w.WriteRow(row)
+	}
+	for _, record := range records {
+		if record.list == nil {
+			if err := emit(record, m); err != nil {
+				return err
+			}
+			continue
+		}
+		list := m.Get(record.list).List()
+		for i := 0; i < list.Len(); i++ {
+			if err := emit(record, list.Get(i).Message()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *exportSchema) fill(row []exportValue, fields []exportField, m protoreflect.Message) {
+	for _, f := range fields {
+		if f.sub != nil {
+			if m.Has(f.fd) {
+				s.fill(row, f.sub, m.Get(f.fd).Message())
+			}
+			continue
+		}
+		row[f.col] = exportFieldValue(f.fd, m.Get(f.fd), s.columns[f.col].kind)
+	}
+}
+
+func exportFieldValue(fd protoreflect.FieldDescriptor, v protoreflect.Value, kind exportKind) exportValue {
+	if fd.IsList() {
+		list := v.List()
+		parts := make([]string, list.Len())
+		for i := range parts {
+			parts[i] = exportScalarString(fd, list.Get(i))
+		}
+		return exportValue{set: true, s: strings.Join(parts, ",")}
+	}
+	switch kind {
+	case exportKindInt:
+		switch fd.Kind() {
+		case protoreflect.Uint32Kind, protoreflect.Uint64Kind, protoreflect.Fixed32Kind, protoreflect.Fixed64Kind:
+			return exportValue{set: true, i: int64(v.Uint())}
+		default:
+			return exportValue{set: true, i: v.Int()}
+		}
+	case exportKindFloat:
+		f, _ := numericValue(fd, v)
+		return exportValue{set: true, f: f}
+	case exportKindBool:
+		return exportValue{set: true, b: v.Bool()}
+	default:
+		return exportValue{set: true, s: exportScalarString(fd, v)}
+	}
+}
+
+func exportScalarString(fd protoreflect.FieldDescriptor, v protoreflect.Value) string {
+	switch fd.Kind() {
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return strconv.Itoa(int(v.Enum()))
+	case protoreflect.BytesKind:
+		return string(v.Bytes())
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	default:
+		return v.String()
+	}
+}
+
+// exportWriter encodes rows in one output format. Flush pushes everything
+// that can be written so far to the underlying writer; Close completes the
+// output.
+type exportWriter interface {
+	WriteRow(row []exportValue) error
+	Flush() error
+	Close() error
+}
+
+type csvExportWriter struct {
+	w      *csv.Writer
+	kinds  []exportKind
+	record []string
+}
+
+func newCSVExportWriter(w io.Writer, columns []exportColumn) (*csvExportWriter, error) {
+	cw := &csvExportWriter{
+		w:      csv.NewWriter(w),
+		kinds:  make([]exportKind, len(columns)),
+		record: make([]string, len(columns)),
+	}
+	for i, col := range columns {
+		cw.kinds[i] = col.kind
+		cw.record[i] = col.name
+	}
+	if err := cw.w.Write(cw.record); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *csvExportWriter) WriteRow(row []exportValue) error {
+	for i, v := range row {
+		cw.record[i] = formatExportValue(v, cw.kinds[i])
+	}
+	return cw.w.Write(cw.record)
+}
+
+func (cw *csvExportWriter) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+func (cw *csvExportWriter) Close() error {
+	return cw.Flush()
+}
+
+func formatExportValue(v exportValue, kind exportKind) string {
+	if !v.set {
+		return ""
+	}
+	switch kind {
+	case exportKindInt:
+		return strconv.FormatInt(v.i, 10)
+	case exportKindFloat:
+		return strconv.FormatFloat(v.f, 'g', -1, 64)
+	case exportKindBool:
+		return strconv.FormatBool(v.b)
+	default:
+		return v.s
+	}
+}
+
+// jsonlExportWriter writes one JSON object per row, omitting columns that do
+// not apply to the row's record.
+type jsonlExportWriter struct {
+	w       *bufio.Writer
+	columns []exportColumn
+	keys    [][]byte
+	buf     []byte
+}
+
+func newJSONLExportWriter(w io.Writer, columns []exportColumn) *jsonlExportWriter {
+	jw := &jsonlExportWriter{
+		w:       bufio.NewWriterSize(w, 64<<10),
+		columns: columns,
+		keys:    make([][]byte, len(columns)),
+	}
+	for i, col := range columns {
+		key, _ := json.Marshal(col.name)
+		jw.keys[i] = append(key, ':')
+	}
+	return jw
+}
+
+func (jw *jsonlExportWriter) WriteRow(row []exportValue) error {
+	b := append(jw.buf[:0], '{')
+	first := true
+	for i, v := range row {
+		if !v.set {
+			continue
+		}
+		if !first {
+			b = append(b, ',')
+		}
+		first = false
+		b = append(b, jw.keys[i]...)
+		switch jw.columns[i].kind {
+		case exportKindInt:
+			b = strconv.AppendInt(b, v.i, 10)
+		case exportKindFloat:
+			if math.IsNaN(v.f) || math.IsInf(v.f, 0) {
+				b = append(b, "null"...)
+			} else {
+				b = strconv.AppendFloat(b, v.f, 'g', -1, 64)
+			}
+		case exportKindBool:
+			b = strconv.AppendBool(b, v.b)
+		default:
+			s, _ := json.Marshal(v.s)
+			b = append(b, s...)
+		}
+	}
+	b = append(b, '}', '\n')
+	jw.buf = b
+	_, err := jw.w.Write(b)
+	return err
+}
+
+func (jw *jsonlExportWriter) Flush() error {
+	return jw.w.Flush()
+}
+
+func (jw *jsonlExportWriter) Close() error {
+	return jw.w.Flush()
+}
+
+var exportFormats = map[string]struct {
+	contentType string
+	extension   string
+}{
+	"csv":     {"text/csv; charset=utf-8", "csv"},
+	"jsonl":   {"application/x-ndjson", "jsonl"},
+	"parquet": {"application/vnd.apache.parquet", "parquet"},
+}
+
+func newExportWriter(format string, w io.Writer, columns []exportColumn) (exportWriter, error) {
+	switch format {
+	case "csv":
+		return newCSVExportWriter(w, columns)
+	case "jsonl":
+		return newJSONLExportWriter(w, columns), nil
+	case "parquet":
+		return newParquetWriter(w, columns)
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+}
+
+// handleExport streams the history of the selected nodes and categories as
+// flat rows, one per device per sample. History is read one window per node
+// at a time and flushed to the client as it is encoded, so the response is
+// never held in memory.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	format := strings.ToLower(strings.TrimSpace(query.Get("format")))
+	if format == "" {
+		format = "csv"
+	}
+	spec, ok := exportFormats[format]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unsupported format %q (want csv, jsonl or parquet)", format))
+		return
+	}
+
+	var categories []api.MetricCategory
+	if raw := splitQueryList(query.Get("categories")); len(raw) > 0 {
+		for _, c := range raw {
+			if exportCategoryMessage(api.MetricCategory(c)) == nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("unknown category %q", c))
+				return
+			}
+		}
+		for _, c := range exportCategories {
+			for _, want := range raw {
+				if string(c.category) == want {
+					categories = append(categories, c.category)
+					break
+				}
+			}
+		}
+	} else {
+		for _, c := range exportCategories {
+			categories = append(categories, c.category)
+		}
+	}
+
+	nodes := splitQueryList(query.Get("nodes"))
+	if len(nodes) == 0 {
+		for _, snapshot := range s.store.ListNodeSnapshots() {
+			nodes = append(nodes, snapshot.NodeID)
+		}
+	} else {
+		for _, nodeID := range nodes {
+			if _, err := s.store.GetNodeSnapshot(nodeID); err != nil {
+				writeError(w, http.StatusNotFound, err)
+				return
+			}
+		}
+	}
+
+	from, err := parseTimeQuery(query.Get("from"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid from: %w", err))
+		return
+	}
+	to, err := parseTimeQuery(query.Get("to"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid to: %w", err))
+		return
+	}
+	now := time.Now()
+	if to <= 0 {
+		to = now.UnixNano()
+	}
+	if cutoff := s.store.retentionCutoff(now); from < cutoff {
+		from = cutoff
+	}
+	if from <= 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("from is required when retention is unlimited"))
+		return
+	}
+	if from > to {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("from must not be after to"))
+		return
+	}
+
+	schema := newExportSchema(categories)
+	w.Header().Set("Content-Type", spec.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="telemetry-export-%s.%s"`,
+		time.Unix(0, from).UTC().Format("20060102T150405Z"), spec.extension))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(now.Add(exportWriteTimeout))
+	out, err := newExportWriter(format, w, schema.columns)
+	if err == nil {
+		err = s.streamExport(r, rc, out, schema, nodes, categories, from, to)
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		// The status line is already sent; abort the connection so clients
+		// see a truncated transfer instead of a complete-looking file.
+		s.log.Warn().Err(err).Str("format", format).Msg("export aborted")
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (s *Server) streamExport(r *http.Request, rc *http.ResponseController, out exportWriter, schema *exportSchema,
+	nodes []string, categories []api.MetricCategory, from, to int64) error {
+	row := make([]exportValue, len(schema.columns))
+	window := int64(exportWindow)
+	for _, nodeID := range nodes {
+		for start := from; start <= to; start += window {
+			if err := r.Context().Err(); err != nil {
+				return err
+			}
+			end := min(start+window-1, to)
+			samples, err := s.queryExportSamples(nodeID, categories, start, end)
+			if err != nil {
+				return err
+			}
+			for _, sample := range samples {
+				if err := schema.writeRows(out, row, sample); err != nil {
+					return err
+				}
+			}
+			if len(samples) == 0 {
+				continue
+			}
+			if err := out.Flush(); err != nil {
+				return err
+			}
+			_ = rc.Flush()
+			_ = rc.SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+		}
+	}
+	return nil
+}
+
+// queryExportSamples reads one window of a node, merging per-category
+// queries in time order when only some categories are selected.
+func (s *Server) queryExportSamples(nodeID string, categories []api.MetricCategory, from, to int64) ([]api.TimedSample, error) {
+	if len(categories) == len(exportCategories) {
+		return s.store.QuerySamples(nodeID, "", from, to)
+	}
+	var out []api.TimedSample
+	for _, category := range categories {
+		samples, err := s.store.QuerySamples(nodeID, category, from, to)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, samples...)
+	}
+	if len(categories) > 1 {
+		sort.SliceStable(out, func(i, j int) bool { return out[i].At < out[j].At })
+	}
+	return out, nil
+}
+
+// splitQueryList parses a comma separated query parameter, dropping empty
+// entries.
+func splitQueryList(raw string) []string {
+	var out []string
+	for _, part := range strings.Split(raw, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
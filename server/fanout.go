@@ -0,0 +1,361 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/eWloYW8/Telemetry/api"
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+)
+
+// Fan-out outcomes per node.
+const (
+	fanoutStatusOK       = "ok"
+	fanoutStatusFailed   = "failed"
+	fanoutStatusInvalid  = "invalid"
+	fanoutStatusQueued   = "queued"
+	fanoutStatusOffline  = "offline"
+	fanoutStatusCordoned = "cordoned"
+	fanoutStatusTimeout  = "timeout"
+	fanoutStatusCanceled = "canceled"
+	fanoutStatusPending  = "pending"
+)
+
+// fanoutJob is a validated fan-out request.
+type fanoutJob struct {
+	id          string
+	nodes       []string
+	command     *api.Command
+	concurrency int
+	dryRun      bool
+	// cmds are the per-node commands, in node order, once prepareFanout
+	// has tracked them.
+	cmds []*api.Command
+}
+
+// newFanoutJob resolves the target nodes of a request and decodes its
+// command. Listed nodes are kept even when unknown so that they show up as
+// offline; a selector picks from the nodes the server knows.
+func (s *Server) newFanoutJob(req *pb.FanoutCommandRequest) (*fanoutJob, error) {
+	if req == nil || req.GetCommand() == nil {
+		return nil, fmt.Errorf("missing command")
+	}
+	commandType := api.CommandType(strings.TrimSpace(req.GetCommand().GetType()))
+	if commandType == "" {
+		return nil, fmt.Errorf("missing command type")
+	}
+	cmd := api.FromPBCommand(req.GetCommand())
+	if cmd == nil {
+		return nil, fmt.Errorf("invalid command payload")
+	}
+	cmd.Type = commandType
+
+	listed := sliceToSet(req.GetNodes())
+	selector, err := parseLabelSelector(req.GetSelector())
+	if err != nil {
+		return nil, err
+	}
+	if listed == nil && selector == nil {
+		return nil, fmt.Errorf("nodes or selector required")
+	}
+
+	var nodes []string
+	if selector == nil {
+		nodes = setToSortedSlice(listed)
+	} else {
+		for _, snapshot := range s.store.ListNodeSnapshots() {
+			if _, ok := listed[snapshot.NodeID]; listed != nil && !ok {
+				continue
+			}
+			if selector.Matches(snapshot.Labels) {
+				nodes = append(nodes, snapshot.NodeID)
+			}
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes match")
+	}
+
+	concurrency := int(req.GetConcurrency())
+	if concurrency <= 0 {
+		concurrency = s.cfg.CommandFanout
+	}
+	concurrency = min(concurrency, len(nodes))
+
+	id := strings.TrimSpace(req.GetId())
+	if id == "" {
+		id = uuid.NewString()
+	}
+	return &fanoutJob{id: id, nodes: nodes, command: cmd, concurrency: concurrency, dryRun: req.GetDryRun()}, nil
+}
+
+// prepareFanout gives every node of the job its own command and tracks them
+// all as queued, so that each can be polled before its turn comes. Dry runs
+// track nothing.
+func (s *Server) prepareFanout(ctx context.Context, job *fanoutJob) {
+	if job.dryRun || job.cmds != nil {
+		return
+	}
+	job.cmds = make([]*api.Command, len(job.nodes))
+	for i, nodeID := range job.nodes {
+		cmd := &api.Command{Type: job.command.Type, DeliverBy: job.command.DeliverBy, Payload: job.command.Payload}
+		s.prepareCommand(ctx, nodeID, cmd)
+		job.cmds[i] = cmd
+	}
+}
+
+// pendingFanout is the answer to a fan-out that has only been started:
+// every node pending with its command id.
+func pendingFanout(job *fanoutJob) *pb.FanoutCommandResponse {
+	resp := &pb.FanoutCommandResponse{FanoutId: job.id, Results: make([]*pb.FanoutNodeResult, len(job.nodes))}
+	for i, nodeID := range job.nodes {
+		resp.Results[i] = &pb.FanoutNodeResult{
+			FanoutId: job.id,
+			NodeId:   nodeID,
+			Status:   fanoutStatusPending,
+			Result:   &pb.CommandResult{CommandId: job.cmds[i].ID, NodeId: nodeID, Type: string(job.command.Type)},
+		}
+	}
+	return resp
+}
+
+// runFanout dispatches the job's command to every node, at most concurrency
+// at a time, each with its own command id and timeout. onResult is called
+// once per node as results arrive, never concurrently. The returned response
+// lists the results in node order. Once ctx is done no further nodes are
+// started and they are reported as canceled; commands already sent still
+// run to completion.
+func (s *Server) runFanout(ctx context.Context, job *fanoutJob, onResult func(*pb.FanoutNodeResult)) *pb.FanoutCommandResponse {
+	s.log.Info().
+		Str("fanout_id", job.id).
+		Str("command_type", string(job.command.Type)).
+		Int("nodes", len(job.nodes)).
+		Int("concurrency", job.concurrency).
+		Bool("dry_run", job.dryRun).
+		Msg("fanning out command")
+
+	s.prepareFanout(ctx, job)
+	results := make([]*pb.FanoutNodeResult, len(job.nodes))
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		sem = make(chan struct{}, job.concurrency)
+	)
+	dispatchCtx := context.WithoutCancel(ctx)
+	for i, nodeID := range job.nodes {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			commandID := ""
+			if job.cmds != nil {
+				commandID = job.cmds[i].ID
+				s.commands.Fail(commandID, commandStateFailed, ctx.Err())
+			}
+			results[i] = &pb.FanoutNodeResult{
+				FanoutId: job.id,
+				NodeId:   nodeID,
+				Status:   fanoutStatusCanceled,
+				Result:   api.ToPBCommandResult(wsCommandErrorResult(nodeID, commandID, job.command.Type, ctx.Err())),
+			}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result := s.fanoutNode(dispatchCtx, job, i)
+			mu.Lock()
+			results[i] = result
+			if onResult != nil {
+				onResult(result)
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	resp := &pb.FanoutCommandResponse{FanoutId: job.id, Results: results}
+	for _, result := range results {
+		switch result.GetStatus() {
+		case fanoutStatusOK:
+			resp.Succeeded++
+		case fanoutStatusQueued:
+			resp.Queued++
+		default:
+			resp.Failed++
+		}
+	}
+	s.log.Info().
+		Str("fanout_id", job.id).
+		Uint32("succeeded", resp.Succeeded).
+		Uint32("queued", resp.Queued).
+		Uint32("failed", resp.Failed).
+		Msg("fan-out finished")
+	return resp
+}
+
+func (s *Server) fanoutNode(ctx context.Context, job *fanoutJob, i int) *pb.FanoutNodeResult {
+	if s.cfg.CommandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.CommandTimeout)
+		defer cancel()
+	}
+	nodeID := job.nodes[i]
+	var (
+		cmd *api.Command
+		res *api.CommandResult
+		err error
+	)
+	if job.dryRun {
+		cmd = &api.Command{Type: job.command.Type, DeliverBy: job.command.DeliverBy, Payload: job.command.Payload}
+		res, err = s.checkCommand(nodeID, cmd)
+	} else {
+		cmd = job.cmds[i]
+		res, err = s.deliverCommand(ctx, nodeID, cmd)
+	}
+
+	var invalid *commandValidationError
+	status := fanoutStatusOK
+	switch {
+	case err == nil:
+	case errors.As(err, &invalid):
+		status = fanoutStatusInvalid
+	case errors.Is(err, errCommandHeld):
+		status = fanoutStatusQueued
+	case errors.Is(err, errNodeOffline):
+		status = fanoutStatusOffline
+	case errors.Is(err, errNodeCordoned):
+		status = fanoutStatusCordoned
+	case errors.Is(err, context.DeadlineExceeded):
+		status = fanoutStatusTimeout
+	default:
+		status = fanoutStatusFailed
+	}
+	if res == nil {
+		if err == nil {
+			err = errInvalidCommandPayload
+		}
+		res = wsCommandErrorResult(nodeID, cmd.ID, cmd.Type, err)
+	}
+	return &pb.FanoutNodeResult{
+		FanoutId: job.id,
+		NodeId:   nodeID,
+		Status:   status,
+		Result:   api.ToPBCommandResult(res),
+	}
+}
+
+// checkCommand is the dry run of dispatchCommand: it reports whether the
+// command would be sent, without sending or tracking it.
+func (s *Server) checkCommand(nodeID string, cmd *api.Command) (*api.CommandResult, error) {
+	if err := validateCommand(s.store.NodeRegistration(nodeID), cmd); err != nil {
+		return nil, err
+	}
+	if _, err := s.commandSession(nodeID); err != nil {
+		if errors.Is(err, errNodeOffline) && cmd.DeliverBy > 0 && s.store.NodeKnown(nodeID) {
+			return nil, fmt.Errorf("node %s: %w", nodeID, errCommandHeld)
+		}
+		return nil, err
+	}
+	return &api.CommandResult{NodeID: nodeID, Type: cmd.Type, Success: true, FinishedAt: time.Now().UnixNano()}, nil
+}
+
+// handleFanoutCommand starts a fan-out and answers 202 right away with the
+// fan-out id and every node's command id, which can be polled at
+// /api/commands/{id}. With wait=true, and for dry runs, it responds once
+// every node finished instead. Like single-node commands the fan-out
+// completes even if the client goes away.
+func (s *Server) handleFanoutCommand(w http.ResponseWriter, r *http.Request) {
+	var req pb.FanoutCommandRequest
+	if err := decodeProto(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	wait, err := parseBoolQuery(r.URL.Query().Get("wait"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid wait: %w", err))
+		return
+	}
+	dryRun, err := parseBoolQuery(r.URL.Query().Get("dry_run"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid dry_run: %w", err))
+		return
+	}
+	if dryRun {
+		req.DryRun = true
+	}
+	deliverBy, err := parseDeliverBy(r.URL.Query().Get("deliver_by"), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid deliver_by: %w", err))
+		return
+	}
+	if deliverBy > 0 && req.GetCommand() != nil {
+		req.Command.DeliverByUnixNano = deliverBy
+	}
+	job, err := s.newFanoutJob(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := withCommandOrigin(context.WithoutCancel(r.Context()), httpCommandOrigin(r))
+	if !wait && !job.dryRun {
+		s.prepareFanout(ctx, job)
+		go s.runFanout(ctx, job, nil)
+		writeProto(w, http.StatusAccepted, pendingFanout(job))
+		return
+	}
+
+	// The fan-out may outlast the server's write timeout: allow each wave
+	// of concurrent nodes a full command timeout.
+	waves := (len(job.nodes) + job.concurrency - 1) / job.concurrency
+	deadline := time.Now().Add(time.Duration(waves)*s.cfg.CommandTimeout + s.cfg.HTTPWriteTimeout)
+	_ = http.NewResponseController(w).SetWriteDeadline(deadline)
+	writeProto(w, http.StatusOK, s.runFanout(ctx, job, nil))
+}
+
+// handleWSFanout streams a fan-out to a websocket client: one fanout_result
+// message per node as it finishes, then a fanout_done summary without the
+// per-node results.
+func (s *Server) handleWSFanout(client *wsClient, req *pb.FanoutCommandRequest) {
+	job, err := s.newFanoutJob(req)
+	if err != nil {
+		s.sendWSError(client, fmt.Errorf("fanout: %w", err))
+		return
+	}
+	go func() {
+		// Stop starting nodes once the client is gone: nobody reads the
+		// results any more.
+		ctx, cancel := context.WithCancel(withCommandOrigin(context.Background(), client.commandOrigin()))
+		defer cancel()
+		go func() {
+			select {
+			case <-client.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		resp := s.runFanout(ctx, job, func(result *pb.FanoutNodeResult) {
+			s.sendWSMessage(client, &pb.WSOutgoingMessage{Type: "fanout_result", FanoutResult: result})
+		})
+		s.sendWSMessage(client, &pb.WSOutgoingMessage{
+			Type: "fanout_done",
+			FanoutDone: &pb.FanoutCommandResponse{
+				FanoutId:  resp.GetFanoutId(),
+				Succeeded: resp.GetSucceeded(),
+				Failed:    resp.GetFailed(),
+				Queued:    resp.GetQueued(),
+			},
+		})
+	}()
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+type metricLabel struct {
+	Name  string
+	Value string
+}
+
+// metricPoint is one numeric field of a payload. Metric is the dotted field
+// path (e.g. "cores.utilization"); Labels identify the device the value
+// belongs to (e.g. core_id=3, package_id=0).
+type metricPoint struct {
+	Metric string
+	Labels []metricLabel
+	Value  float64
+}
+
+// deviceLabelFields are the fields that identify an element of a repeated
+// device list rather than carry a measurement.
+var deviceLabelFields = map[protoreflect.Name]struct{}{
+	"core_id":    {},
+	"package_id": {},
+	"index":      {},
+	"name":       {},
+	"ib_device":  {},
+	"port":       {},
+	"pid":        {},
+}
+
+// flattenPayload walks a metric payload and returns all of its numeric
+// fields. Timestamps, strings and repeated scalars are skipped.
+func flattenPayload(payload any) []metricPoint {
+	msg, ok := payload.(proto.Message)
+	if !ok || msg == nil {
+		return nil
+	}
+	m := msg.ProtoReflect()
+	if !m.IsValid() {
+		return nil
+	}
+	out := make([]metricPoint, 0, 32)
+	flattenMessage(m, "", nil, &out)
+	return out
+}
+
+func flattenMessage(m protoreflect.Message, prefix string, labels []metricLabel, out *[]metricPoint) {
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if _, isLabel := deviceLabelFields[fd.Name()]; isLabel && len(labels) > 0 {
+			continue
+		}
+		if strings.HasSuffix(string(fd.Name()), "_unix_nano") {
+			continue
+		}
+		name := prefix + string(fd.Name())
+		switch {
+		case fd.IsList() && fd.Kind() == protoreflect.MessageKind:
+			list := m.Get(fd).List()
+			for j := 0; j < list.Len(); j++ {
+				elem := list.Get(j).Message()
+				flattenMessage(elem, name+".", appendDeviceLabels(labels, elem), out)
+			}
+		case fd.IsList() || fd.IsMap():
+		case fd.Kind() == protoreflect.MessageKind:
+			if m.Has(fd) {
+				flattenMessage(m.Get(fd).Message(), name+".", labels, out)
+			}
+		default:
+			if v, ok := numericValue(fd, m.Get(fd)); ok {
+				*out = append(*out, metricPoint{Metric: name, Labels: labels, Value: v})
+			}
+		}
+	}
+}
+
+func appendDeviceLabels(parent []metricLabel, m protoreflect.Message) []metricLabel {
+	out := append([]metricLabel(nil), parent...)
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if _, ok := deviceLabelFields[fd.Name()]; !ok || fd.IsList() {
+			continue
+		}
+		v := m.Get(fd)
+		var value string
+		switch fd.Kind() {
+		case protoreflect.StringKind:
+			value = v.String()
+		case protoreflect.Int32Kind, protoreflect.Int64Kind, protoreflect.Sint32Kind, protoreflect.Sint64Kind:
+			value = strconv.FormatInt(v.Int(), 10)
+		case protoreflect.Uint32Kind, protoreflect.Uint64Kind:
+			value = strconv.FormatUint(v.Uint(), 10)
+		default:
+			continue
+		}
+		out = append(out, metricLabel{Name: string(fd.Name()), Value: value})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func numericValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) (float64, bool) {
+	switch fd.Kind() {
+	case protoreflect.Int32Kind, protoreflect.Int64Kind, protoreflect.Sint32Kind, protoreflect.Sint64Kind,
+		protoreflect.Sfixed32Kind, protoreflect.Sfixed64Kind:
+		return float64(v.Int()), true
+	case protoreflect.Uint32Kind, protoreflect.Uint64Kind, protoreflect.Fixed32Kind, protoreflect.Fixed64Kind:
+		return float64(v.Uint()), true
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return v.Float(), true
+	case protoreflect.BoolKind:
+		if v.Bool() {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// labelsKey renders labels in a canonical form usable as a map key.
+func labelsKey(labels []metricLabel) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.Name)
+		b.WriteByte('=')
+		b.WriteString(l.Value)
+	}
+	return b.String()
+}
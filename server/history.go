@@ -0,0 +1,414 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eWloYW8/Telemetry/api"
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+	"github.com/eWloYW8/Telemetry/config"
+	"github.com/eWloYW8/Telemetry/server/diskstore"
+)
+
+// SampleBackend keeps the metric history behind Store.
+type SampleBackend interface {
+	Append(nodeID string, samples []api.MetricSample) error
+	// Query returns samples of a node within [from, to] ordered by time. An
+	// empty category selects all categories; non-positive bounds are open.
+	Query(nodeID string, category api.MetricCategory, from, to int64) ([]api.MetricSample, error)
+	// Latest returns the most recent sample per category of every node the
+	// backend knows about. It is used to restore state on startup.
+	Latest() (map[string][]api.MetricSample, error)
+	// Prune drops samples older than cutoff. Backends may also use the call
+	// for periodic housekeeping.
+	Prune(now time.Time, cutoff int64) error
+	// DeleteNode forgets a node so that Latest no longer reports it. Stored
+	// history may be dropped right away or left to age out with retention.
+	DeleteNode(nodeID string) error
+	Close() error
+}
+
+func newSampleBackend(cfg config.ServerConfig) (SampleBackend, error) {
+	switch cfg.Storage.Backend {
+	case "", "memory":
+		return newMemoryBackend(cfg.MaxSamplesPerNode), nil
+	case "disk":
+		store, err := diskstore.Open(diskstore.Options{
+			Dir:          cfg.Storage.Path,
+			Partition:    cfg.Storage.Partition,
+			SyncInterval: cfg.Storage.WALSyncInterval,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("open disk storage: %w", err)
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unsupported storage backend %q", cfg.Storage.Backend)
+	}
+}
+
+const sampleRingMinCapacity = 64
+
+// sampleRing is a growable FIFO of samples for one node/category pair.
+// Capacity is bounded by the owning node, not by the ring itself.
+type sampleRing struct {
+	buf  []api.MetricSample
+	head int
+	size int
+}
+
+func (r *sampleRing) Len() int {
+	return r.size
+}
+
+func (r *sampleRing) at(i int) api.MetricSample {
+	return r.buf[(r.head+i)%len(r.buf)]
+}
+
+func (r *sampleRing) front() (api.MetricSample, bool) {
+	if r.size == 0 {
+		return api.MetricSample{}, false
+	}
+	return r.buf[r.head], true
+}
+
+func (r *sampleRing) push(sample api.MetricSample) {
+	if r.size == len(r.buf) {
+		r.grow()
+	}
+	r.buf[(r.head+r.size)%len(r.buf)] = sample
+	r.size++
+}
+
+func (r *sampleRing) popFront() {
+	if r.size == 0 {
+		return
+	}
+	r.buf[r.head] = api.MetricSample{}
+	r.head = (r.head + 1) % len(r.buf)
+	r.size--
+	if r.size == 0 {
+		r.head = 0
+	}
+}
+
+func (r *sampleRing) grow() {
+	capacity := len(r.buf) * 2
+	if capacity < sampleRingMinCapacity {
+		capacity = sampleRingMinCapacity
+	}
+	buf := make([]api.MetricSample, capacity)
+	for i := 0; i < r.size; i++ {
+		buf[i] = r.at(i)
+	}
+	r.buf = buf
+	r.head = 0
+}
+
+type nodeHistory struct {
+	mu     sync.RWMutex
+	series map[api.MetricCategory]*sampleRing
+	size   int
+}
+
+// memoryBackend keeps a bounded ring of samples per node and category. Once a
+// node holds maxSamplesPerNode samples, its oldest sample across all
+// categories is evicted first.
+type memoryBackend struct {
+	maxSamplesPerNode int
+
+	mu    sync.RWMutex
+	nodes map[string]*nodeHistory
+}
+
+func newMemoryBackend(maxSamplesPerNode int) *memoryBackend {
+	return &memoryBackend{
+		maxSamplesPerNode: maxSamplesPerNode,
+		nodes:             make(map[string]*nodeHistory),
+	}
+}
+
+func (b *memoryBackend) node(nodeID string, create bool) *nodeHistory {
+	b.mu.RLock()
+	h, ok := b.nodes[nodeID]
+	b.mu.RUnlock()
+	if ok || !create {
+		return h
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if h, ok = b.nodes[nodeID]; !ok {
+		h = &nodeHistory{series: make(map[api.MetricCategory]*sampleRing, 8)}
+		b.nodes[nodeID] = h
+	}
+	return h
+}
+
+func (b *memoryBackend) Append(nodeID string, samples []api.MetricSample) error {
+	h := b.node(nodeID, true)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, sample := range samples {
+		if sample.Category == "" {
+			continue
+		}
+		ring, ok := h.series[sample.Category]
+		if !ok {
+			ring = &sampleRing{}
+			h.series[sample.Category] = ring
+		}
+		ring.push(sample)
+		h.size++
+	}
+	for b.maxSamplesPerNode > 0 && h.size > b.maxSamplesPerNode {
+		if !h.evictOldestLocked() {
+			break
+		}
+	}
+	return nil
+}
+
+func (b *memoryBackend) Query(nodeID string, category api.MetricCategory, from, to int64) ([]api.MetricSample, error) {
+	h := b.node(nodeID, false)
+	if h == nil {
+		return nil, nil
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	out := make([]api.MetricSample, 0, 256)
+	collect := func(ring *sampleRing) {
+		for i := 0; i < ring.Len(); i++ {
+			sample := ring.at(i)
+			if sample.At < from || (to > 0 && sample.At > to) {
+				continue
+			}
+			out = append(out, sample)
+		}
+	}
+	if category != "" {
+		if ring, ok := h.series[category]; ok {
+			collect(ring)
+		}
+	} else {
+		for _, ring := range h.series {
+			collect(ring)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].At < out[j].At
+	})
+	return out, nil
+}
+
+func (b *memoryBackend) Latest() (map[string][]api.MetricSample, error) {
+	return nil, nil
+}
+
+func (b *memoryBackend) Prune(_ time.Time, cutoff int64) error {
+	b.mu.RLock()
+	nodes := make([]*nodeHistory, 0, len(b.nodes))
+	for _, h := range b.nodes {
+		nodes = append(nodes, h)
+	}
+	b.mu.RUnlock()
+
+	for _, h := range nodes {
+		h.mu.Lock()
+		h.evictOlderThanLocked(cutoff)
+		h.mu.Unlock()
+	}
+	return nil
+}
+
+func (b *memoryBackend) DeleteNode(nodeID string) error {
+	b.mu.Lock()
+	delete(b.nodes, nodeID)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
+
+func (h *nodeHistory) evictOlderThanLocked(cutoff int64) {
+	for _, ring := range h.series {
+		for {
+			oldest, ok := ring.front()
+			if !ok || oldest.At >= cutoff {
+				break
+			}
+			ring.popFront()
+			h.size--
+		}
+	}
+}
+
+// evictOldestLocked drops the oldest sample across all categories of the node.
+func (h *nodeHistory) evictOldestLocked() bool {
+	var victim *sampleRing
+	var victimAt int64
+	for _, ring := range h.series {
+		oldest, ok := ring.front()
+		if !ok {
+			continue
+		}
+		if victim == nil || oldest.At < victimAt {
+			victim = ring
+			victimAt = oldest.At
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	victim.popFront()
+	h.size--
+	return true
+}
+
+func (s *Store) retentionCutoff(now time.Time) int64 {
+	if s.retention <= 0 {
+		return 0
+	}
+	return now.Add(-s.retention).UnixNano()
+}
+
+// AppendSamples records the latest sample per category of a node and hands
+// the samples to the history backend.
+func (s *Store) AppendSamples(nodeID string, samples []api.MetricSample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	n := s.ensureNode(nodeID)
+	n.mu.Lock()
+	if n.latest == nil {
+		n.latest = make(map[api.MetricCategory]api.MetricSample, 8)
+	}
+	for _, sample := range samples {
+		if sample.Category == "" {
+			continue
+		}
+		if prev, ok := n.latest[sample.Category]; !ok || sample.At >= prev.At {
+			n.latest[sample.Category] = sample
+		}
+	}
+	n.mu.Unlock()
+
+	s.rollups.Add(nodeID, samples)
+
+	cutoff := s.retentionCutoff(time.Now())
+	kept := samples
+	if cutoff > 0 {
+		kept = make([]api.MetricSample, 0, len(samples))
+		for _, sample := range samples {
+			if sample.At >= cutoff {
+				kept = append(kept, sample)
+			}
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return s.backend.Append(nodeID, kept)
+}
+
+// nodeListed reports whether a node has an entry, i.e. has not been evicted
+// or deleted.
+func (s *Store) nodeListed(nodeID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.nodes[nodeID]
+	return ok
+}
+
+// QuerySamples returns samples of a node within [from, to] ordered by time.
+// An empty category selects all categories; non-positive bounds are open.
+// Evicted nodes are answered from the backend as long as it still holds
+// samples of theirs in the window.
+func (s *Store) QuerySamples(nodeID string, category api.MetricCategory, from, to int64) ([]api.TimedSample, error) {
+	if cutoff := s.retentionCutoff(time.Now()); from < cutoff {
+		from = cutoff
+	}
+	samples, err := s.backend.Query(nodeID, category, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(samples) == 0 && !s.nodeListed(nodeID) {
+		return nil, fmt.Errorf("node %s not found", nodeID)
+	}
+	out := make([]api.TimedSample, 0, len(samples))
+	for _, sample := range samples {
+		out = append(out, api.TimedSample{
+			NodeID:   nodeID,
+			Category: sample.Category,
+			At:       sample.At,
+			Payload:  sample.Payload,
+		})
+	}
+	return out, nil
+}
+
+// QueryRollups returns rollup buckets of a node from the coarsest tier that
+// satisfies resolution. An empty metric selects all metrics; a metric prefix
+// such as "cores" selects all fields below it. Like QuerySamples it answers
+// for evicted nodes whose buckets have not expired yet.
+func (s *Store) QueryRollups(nodeID string, category api.MetricCategory, metric string, from, to int64, resolution time.Duration) (*pb.RollupsResponse, error) {
+	out, err := s.rollups.Query(nodeID, category, metric, from, to, resolution)
+	if err != nil {
+		return nil, err
+	}
+	if len(out.GetSeries()) == 0 && !s.nodeListed(nodeID) {
+		return nil, fmt.Errorf("node %s not found", nodeID)
+	}
+	return out, nil
+}
+
+const rollupSaveInterval = 10 * time.Minute
+
+// Prune drops samples that fell out of the retention window, including those
+// of nodes that stopped reporting, and expires rollup buckets per tier.
+func (s *Store) Prune(now time.Time) error {
+	s.rollups.Prune(now)
+	var errs []error
+	if now.Sub(s.lastRollupSave) >= rollupSaveInterval {
+		s.lastRollupSave = now
+		errs = append(errs, s.rollups.Save())
+	}
+	errs = append(errs, s.backend.Prune(now, s.retentionCutoff(now)))
+	return errors.Join(errs...)
+}
+
+// restore seeds offline node entries and their latest samples from the
+// backend, so a restarted server knows about previously seen nodes.
+func (s *Store) restore() error {
+	latest, err := s.backend.Latest()
+	if err != nil {
+		return err
+	}
+	for nodeID, samples := range latest {
+		n := s.ensureNode(nodeID)
+		n.mu.Lock()
+		if n.latest == nil {
+			n.latest = make(map[api.MetricCategory]api.MetricSample, len(samples))
+		}
+		for _, sample := range samples {
+			n.latest[sample.Category] = sample
+			if sample.At > n.lastSeen {
+				n.lastSeen = sample.At
+			}
+		}
+		// Restored nodes count as last heard from at their newest sample so
+		// that eviction applies to them as well.
+		n.lastContact = n.lastSeen
+		n.labels = nodeLabels(nil, s.meta.Get(nodeID).labels)
+		n.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *Store) Close() error {
+	return errors.Join(s.rollups.Save(), s.backend.Close())
+}
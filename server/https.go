@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/eWloYW8/Telemetry/config"
+)
+
+// parseHTTPClientAuth resolves http_tls.client_auth: without a CA no client
+// certificates are asked for, and with one they are optional by default.
+func parseHTTPClientAuth(cfg config.HTTPTLSConfig) (tls.ClientAuthType, error) {
+	mode := strings.ToLower(strings.TrimSpace(cfg.ClientAuth))
+	if mode == "" {
+		mode = "none"
+		if cfg.CAFile != "" {
+			mode = "optional"
+		}
+	}
+	var clientAuth tls.ClientAuthType
+	switch mode {
+	case "none":
+		clientAuth = tls.NoClientCert
+	case "optional":
+		clientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return 0, fmt.Errorf("http_tls: unknown client_auth %q (want none, optional or require)", cfg.ClientAuth)
+	}
+	if clientAuth != tls.NoClientCert && cfg.CAFile == "" {
+		return 0, fmt.Errorf("http_tls: client_auth %s requires ca_file", mode)
+	}
+	return clientAuth, nil
+}
+
+// parseClientRoles validates http_tls.client_roles.
+func parseClientRoles(cfg config.HTTPTLSConfig, clientAuth tls.ClientAuthType) (map[string]authRole, error) {
+	if len(cfg.ClientRoles) == 0 {
+		return nil, nil
+	}
+	if clientAuth == tls.NoClientCert {
+		return nil, fmt.Errorf("http_tls: client_roles need client certificates (ca_file and client_auth)")
+	}
+	roles := make(map[string]authRole, len(cfg.ClientRoles))
+	for name, raw := range cfg.ClientRoles {
+		role, err := parseAuthRole(raw)
+		if err != nil {
+			return nil, fmt.Errorf("http_tls: client_roles %s: %w", name, err)
+		}
+		roles[name] = role
+	}
+	return roles, nil
+}
+
+// certIdentity returns the identity of a request's verified client
+// certificate, with the highest role any of its names is mapped to.
+func (s *Server) certIdentity(r *http.Request) *authIdentity {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	var id *authIdentity
+	for _, name := range append(certNames(cert), cert.EmailAddresses...) {
+		role, ok := s.certRoles[name]
+		if ok && (id == nil || role > id.role) {
+			id = &authIdentity{name: "cert/" + name, role: role, cert: cert}
+		}
+	}
+	return id
+}
+
+// hstsMiddleware tells browsers to keep to HTTPS.
+func (s *Server) hstsMiddleware(next http.Handler) http.Handler {
+	value := "max-age=" + strconv.FormatInt(int64(s.cfg.HTTPTLS.HSTSMaxAge.Seconds()), 10)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same URL on the HTTPS
+// listener.
+func (s *Server) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(s.cfg.HTTPListen); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+	"github.com/eWloYW8/Telemetry/config"
+	"github.com/eWloYW8/Telemetry/security"
+)
+
+const (
+	nodeIdentityEnforce = "enforce"
+	nodeIdentityAudit   = "audit"
+	nodeIdentityOff     = "off"
+
+	nodeIDPlaceholder = "{node_id}"
+
+	auditEventIdentityMismatch = "identity_mismatch"
+)
+
+// nodeIdentityPolicy decides which node IDs a client certificate may
+// register.
+type nodeIdentityPolicy struct {
+	mode     string
+	template string
+	allow    map[string][]string
+}
+
+func newNodeIdentityPolicy(cfg config.NodeIdentityConfig) (*nodeIdentityPolicy, error) {
+	mode := strings.ToLower(strings.TrimSpace(cfg.Mode))
+	switch mode {
+	case nodeIdentityEnforce, nodeIdentityAudit, nodeIdentityOff:
+	default:
+		return nil, fmt.Errorf("node_identity: unknown mode %q (want enforce, audit or off)", cfg.Mode)
+	}
+	if !strings.Contains(cfg.Template, nodeIDPlaceholder) {
+		return nil, fmt.Errorf("node_identity: template %q does not contain %s", cfg.Template, nodeIDPlaceholder)
+	}
+	for name, patterns := range cfg.Allow {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("node_identity: allow %s: bad pattern %q: %w", name, pattern, err)
+			}
+		}
+	}
+	return &nodeIdentityPolicy{mode: mode, template: cfg.Template, allow: cfg.Allow}, nil
+}
+
+// certNames returns the names a certificate vouches for: its CN, DNS SANs
+// and URI SANs.
+func certNames(cert *x509.Certificate) []string {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	return names
+}
+
+// check returns an error unless one of the certificate's names is the
+// node's expected name or is allowed to register the node.
+func (p *nodeIdentityPolicy) check(cert *x509.Certificate, nodeID string) error {
+	if cert == nil {
+		return fmt.Errorf("no client certificate to bind node %s to", nodeID)
+	}
+	names := certNames(cert)
+	want := strings.ReplaceAll(p.template, nodeIDPlaceholder, nodeID)
+	if slices.ContainsFunc(names, func(name string) bool { return strings.EqualFold(name, want) }) {
+		return nil
+	}
+	for _, name := range names {
+		for _, pattern := range p.allow[name] {
+			if ok, _ := path.Match(pattern, nodeID); ok {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("client certificate %s does not match node %s (want %q)", strings.Join(names, ", "), nodeID, want)
+}
+
+// peerCertificate returns the verified client certificate of a gRPC peer.
+func peerCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p == nil {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return nil
+	}
+	return info.State.PeerCertificates[0]
+}
+
+// checkNodeIdentity applies the node identity policy to a registering agent.
+// A mismatch is logged and audited; in enforce mode it also rejects the
+// stream.
+func (s *Server) checkNodeIdentity(ctx context.Context, nodeID string) error {
+	if s.identity.mode == nodeIdentityOff {
+		return nil
+	}
+	cert := peerCertificate(ctx)
+	err := s.identity.check(cert, nodeID)
+	if err == nil {
+		return nil
+	}
+
+	var subject string
+	if cert != nil {
+		subject = cert.Subject.String()
+	}
+	enforced := s.identity.mode == nodeIdentityEnforce
+	s.log.Warn().
+		Err(err).
+		Str("node_id", nodeID).
+		Str("cert_subject", subject).
+		Str("source_ip", peerIPFromContext(ctx)).
+		Bool("rejected", enforced).
+		Msg("node identity mismatch")
+	entry := &pb.AuditEntry{
+		TimeUnixNano: time.Now().UnixNano(),
+		Event:        auditEventIdentityMismatch,
+		NodeId:       nodeID,
+		User:         subject,
+		RemoteAddr:   peerIPFromContext(ctx),
+		Source:       "grpc",
+		State:        "rejected",
+		Error:        err.Error(),
+	}
+	if !enforced {
+		entry.State = "allowed"
+	}
+	s.audit.Append(entry)
+	if !enforced {
+		return nil
+	}
+	return status.Error(codes.PermissionDenied, err.Error())
+}
+
+// revokedSessionsLoop closes the streams of agents whose certificate was
+// revoked after they connected; the TLS handshake keeps them from coming
+// back.
+func (s *Server) revokedSessionsLoop(ctx context.Context) {
+	interval := s.cfg.TLS.ReloadInterval
+	if interval <= 0 {
+		interval = security.DefaultReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sessionsMu.RLock()
+			var revoked []*nodeSession
+			for _, session := range s.sessions {
+				if s.tls.Revoked(session.cert) {
+					revoked = append(revoked, session)
+				}
+			}
+			s.sessionsMu.RUnlock()
+			for _, session := range revoked {
+				s.log.Warn().
+					Str("node_id", session.nodeID).
+					Str("serial", fmt.Sprintf("%X", session.cert.SerialNumber)).
+					Msg("client certificate revoked, closing session")
+				session.close(errSessionRevoked)
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"crypto/tls"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/eWloYW8/Telemetry/config"
+)
+
+// influxWriter writes InfluxDB line protocol with nanosecond timestamps. Each
+// metric family becomes a measurement with a single "value" field; node and
+// device labels become tags.
+type influxWriter struct {
+	*httpSinkSender
+}
+
+func newInfluxWriter(cfg config.SinkConfig, tlsCfg *tls.Config) *influxWriter {
+	sender := newHTTPSinkSender(cfg.URL, cfg.Headers, cfg.Timeout, tlsCfg)
+	sender.contentType = "text/plain; charset=utf-8"
+	return &influxWriter{httpSinkSender: sender}
+}
+
+func (w *influxWriter) Encode(batch []nodeMetrics) ([]byte, error) {
+	buf := make([]byte, 0, 64<<10)
+	var tags []metricLabel
+	for _, nm := range batch {
+		for _, f := range nm.metrics.sorted() {
+			for _, v := range f.values {
+				// Line protocol has no representation for NaN or infinities.
+				if math.IsNaN(v.value) || math.IsInf(v.value, 0) {
+					continue
+				}
+				buf = appendInfluxEscaped(buf, f.name, influxMeasurementEscaper)
+				tags = append(tags[:0], v.labels...)
+				sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+				for _, tag := range tags {
+					// Empty tag values are not allowed.
+					if tag.Value == "" {
+						continue
+					}
+					buf = append(buf, ',')
+					buf = appendInfluxEscaped(buf, tag.Name, influxTagEscaper)
+					buf = append(buf, '=')
+					buf = appendInfluxEscaped(buf, tag.Value, influxTagEscaper)
+				}
+				buf = append(buf, " value="...)
+				buf = strconv.AppendFloat(buf, v.value, 'g', -1, 64)
+				buf = append(buf, ' ')
+				buf = strconv.AppendInt(buf, v.at, 10)
+				buf = append(buf, '\n')
+			}
+		}
+	}
+	return buf, nil
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+func appendInfluxEscaped(buf []byte, s string, escaper *strings.Replacer) []byte {
+	return append(buf, escaper.Replace(s)...)
+}
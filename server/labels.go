@@ -0,0 +1,254 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/eWloYW8/Telemetry/api"
+)
+
+// nodeLabels merges the label sources of a node. Labels derived from the
+// registration come first, the agent's configured labels override them and
+// server-side overrides win over both; an override with an empty value hides
+// the label.
+func nodeLabels(reg *api.Registration, overrides map[string]string) map[string]string {
+	out := make(map[string]string, 8)
+	if reg != nil {
+		for k, v := range derivedNodeLabels(reg) {
+			out[k] = v
+		}
+		for k, v := range reg.Labels {
+			out[k] = v
+		}
+	}
+	for k, v := range overrides {
+		if v == "" {
+			delete(out, k)
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+func derivedNodeLabels(reg *api.Registration) map[string]string {
+	out := map[string]string{
+		"has_gpu":        "false",
+		"has_infiniband": "false",
+	}
+	if v := labelValue(reg.Basic.Arch); v != "" {
+		out["arch"] = v
+	}
+	if v := labelValue(reg.Basic.OS); v != "" {
+		out["os"] = v
+	}
+	if v := labelValue(reg.Basic.HardwareModel); v != "" {
+		out["hardware_model"] = v
+	}
+	if v := labelValue(reg.Basic.HardwareVendor); v != "" {
+		out["hardware_vendor"] = v
+	}
+	for name := range reg.Modules {
+		switch name {
+		case "gpu", "amdgpu":
+			out["has_gpu"] = "true"
+		case "infiniband":
+			out["has_infiniband"] = "true"
+		}
+	}
+	return out
+}
+
+// labelValue turns free-form hardware strings into selector-friendly values:
+// runs of characters other than letters, digits, '.', '-' and '_' become a
+// single '_'.
+func labelValue(raw string) string {
+	var b strings.Builder
+	pendingSep := false
+	for _, r := range strings.TrimSpace(raw) {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+			if pendingSep && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			pendingSep = false
+			b.WriteRune(r)
+			continue
+		}
+		pendingSep = true
+	}
+	return b.String()
+}
+
+// labelSelector is a conjunction of Kubernetes-style label requirements:
+// key=value, key==value, key!=value, key in (a,b), key notin (a,b), key and
+// !key. Negative requirements also match nodes without the label.
+type labelSelector []labelRequirement
+
+type labelRequirement struct {
+	key    string
+	op     string
+	values []string
+}
+
+const (
+	selectorOpIn        = "in"
+	selectorOpNotIn     = "notin"
+	selectorOpExists    = "exists"
+	selectorOpNotExists = "!"
+)
+
+// parseLabelSelector parses a selector; an empty string yields nil, which
+// matches every node.
+func parseLabelSelector(raw string) (labelSelector, error) {
+	terms, err := splitSelectorTerms(raw)
+	if err != nil {
+		return nil, err
+	}
+	var out labelSelector
+	for _, term := range terms {
+		req, err := parseLabelRequirement(term)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector term %q: %w", term, err)
+		}
+		out = append(out, req)
+	}
+	return out, nil
+}
+
+// splitSelectorTerms splits on commas outside of parentheses.
+func splitSelectorTerms(raw string) ([]string, error) {
+	var terms []string
+	depth, start := 0, 0
+	for i, r := range raw {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unbalanced parentheses in selector %q", raw)
+			}
+		case ',':
+			if depth == 0 {
+				terms = append(terms, raw[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced parentheses in selector %q", raw)
+	}
+	terms = append(terms, raw[start:])
+
+	out := terms[:0]
+	for _, term := range terms {
+		if term = strings.TrimSpace(term); term != "" {
+			out = append(out, term)
+		}
+	}
+	return out, nil
+}
+
+func parseLabelRequirement(term string) (labelRequirement, error) {
+	if strings.HasPrefix(term, "!") {
+		key := strings.TrimSpace(term[1:])
+		return labelRequirement{key: key, op: selectorOpNotExists}, validateLabelKey(key)
+	}
+	if open := strings.IndexByte(term, '('); open >= 0 {
+		if !strings.HasSuffix(term, ")") {
+			return labelRequirement{}, fmt.Errorf("missing closing parenthesis")
+		}
+		fields := strings.Fields(term[:open])
+		if len(fields) != 2 || (fields[1] != selectorOpIn && fields[1] != selectorOpNotIn) {
+			return labelRequirement{}, fmt.Errorf("expected \"key in (...)\" or \"key notin (...)\"")
+		}
+		req := labelRequirement{key: fields[0], op: fields[1]}
+		for _, v := range strings.Split(term[open+1:len(term)-1], ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				req.values = append(req.values, v)
+			}
+		}
+		if len(req.values) == 0 {
+			return labelRequirement{}, fmt.Errorf("empty value set")
+		}
+		sort.Strings(req.values)
+		return req, validateLabelKey(req.key)
+	}
+	for _, op := range []string{"!=", "==", "="} {
+		if i := strings.Index(term, op); i >= 0 {
+			key := strings.TrimSpace(term[:i])
+			value := strings.TrimSpace(term[i+len(op):])
+			if op == "==" {
+				op = "="
+			}
+			return labelRequirement{key: key, op: op, values: []string{value}}, validateLabelKey(key)
+		}
+	}
+	return labelRequirement{key: term, op: selectorOpExists}, validateLabelKey(term)
+}
+
+func validateLabelKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("empty label key")
+	}
+	if strings.ContainsAny(key, " \t=!(),") {
+		return fmt.Errorf("invalid label key %q", key)
+	}
+	return nil
+}
+
+func (s labelSelector) Matches(labels map[string]string) bool {
+	for _, req := range s {
+		value, ok := labels[req.key]
+		switch req.op {
+		case "=":
+			if !ok || value != req.values[0] {
+				return false
+			}
+		case "!=":
+			if ok && value == req.values[0] {
+				return false
+			}
+		case selectorOpIn:
+			if !ok || !containsSorted(req.values, value) {
+				return false
+			}
+		case selectorOpNotIn:
+			if ok && containsSorted(req.values, value) {
+				return false
+			}
+		case selectorOpExists:
+			if !ok {
+				return false
+			}
+		case selectorOpNotExists:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s labelSelector) String() string {
+	parts := make([]string, 0, len(s))
+	for _, req := range s {
+		switch req.op {
+		case selectorOpIn, selectorOpNotIn:
+			parts = append(parts, req.key+" "+req.op+" ("+strings.Join(req.values, ",")+")")
+		case selectorOpExists:
+			parts = append(parts, req.key)
+		case selectorOpNotExists:
+			parts = append(parts, "!"+req.key)
+		default:
+			parts = append(parts, req.key+req.op+req.values[0])
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func containsSorted(values []string, v string) bool {
+	i := sort.SearchStrings(values, v)
+	return i < len(values) && values[i] == v
+}
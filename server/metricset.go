@@ -0,0 +1,296 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+
+	cpupb "github.com/eWloYW8/Telemetry/agent/modules/cpu/pb"
+	gpupb "github.com/eWloYW8/Telemetry/agent/modules/gpu/pb"
+	infinibandpb "github.com/eWloYW8/Telemetry/agent/modules/infiniband/pb"
+	memorypb "github.com/eWloYW8/Telemetry/agent/modules/memory/pb"
+	networkpb "github.com/eWloYW8/Telemetry/agent/modules/network/pb"
+	processpb "github.com/eWloYW8/Telemetry/agent/modules/process/pb"
+	storagepb "github.com/eWloYW8/Telemetry/agent/modules/storage/pb"
+	"github.com/eWloYW8/Telemetry/api"
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+)
+
+const (
+	metricGauge   = "gauge"
+	metricCounter = "counter"
+)
+
+type metricValue struct {
+	labels []metricLabel
+	value  float64
+	at     int64
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	values []metricValue
+}
+
+// metricSet translates module payloads into named metric families shared by
+// all exposition formats. Values added while at is set carry that timestamp.
+type metricSet struct {
+	families map[string]*metricFamily
+	at       int64
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{families: make(map[string]*metricFamily)}
+}
+
+func (r *metricSet) add(name, kind, help string, value float64, labels ...metricLabel) {
+	f, ok := r.families[name]
+	if !ok {
+		f = &metricFamily{name: name, help: help, kind: kind}
+		r.families[name] = f
+	}
+	f.values = append(f.values, metricValue{labels: labels, value: value, at: r.at})
+}
+
+func (r *metricSet) gauge(name, help string, value float64, labels ...metricLabel) {
+	r.add(name, metricGauge, help, value, labels...)
+}
+
+func (r *metricSet) counter(name, help string, value float64, labels ...metricLabel) {
+	r.add(name, metricCounter, help, value, labels...)
+}
+
+// sorted returns the families ordered by name with their values ordered by
+// labels, so the output of a set is deterministic.
+func (r *metricSet) sorted() []*metricFamily {
+	out := make([]*metricFamily, 0, len(r.families))
+	for _, f := range r.families {
+		sort.SliceStable(f.values, func(i, j int) bool {
+			return labelsKey(f.values[i].labels) < labelsKey(f.values[j].labels)
+		})
+		out = append(out, f)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out
+}
+
+func label(name, value string) metricLabel {
+	return metricLabel{Name: name, Value: value}
+}
+
+func intLabel(name string, value int64) metricLabel {
+	return metricLabel{Name: name, Value: strconv.FormatInt(value, 10)}
+}
+
+func boolValue(v bool) float64 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// collectNodeMetrics translates the node status and the latest sample per
+// category of a node. Every series carries a node label; device labels follow
+// the naming of the payload that produced them.
+func collectNodeMetrics(reg *metricSet, node api.NodeSnapshot) {
+	nodeLabel := label("node", node.NodeID)
+	reg.gauge("telemetry_node_connected", "Whether the agent currently holds a stream to the server.", boolValue(node.Connected), nodeLabel)
+	reg.gauge("telemetry_node_cordoned", "Whether control commands to the node are rejected.", boolValue(node.Cordoned), nodeLabel)
+	reg.gauge("telemetry_node_stale", "Whether the node went silent while its stream was still open.", boolValue(node.Stale), nodeLabel)
+	if node.LastSeen > 0 {
+		reg.gauge("telemetry_node_last_seen_timestamp_seconds", "Unix time of the last message received from the node.", float64(node.LastSeen)/1e9, nodeLabel)
+	}
+
+	var modules map[string]any
+	if node.Registration != nil {
+		modules = node.Registration.Modules
+		collectRegistrationMetrics(reg, nodeLabel, modules)
+	}
+
+	for _, sample := range node.Latest {
+		collectSampleMetrics(reg, nodeLabel, sample.Category, sample.Payload, modules)
+	}
+}
+
+// collectSampleMetrics translates one module payload. modules is the node's
+// registration, used to enrich device labels; it may be nil.
+func collectSampleMetrics(reg *metricSet, nodeLabel metricLabel, category api.MetricCategory, payload any, modules map[string]any) {
+	switch payload := payload.(type) {
+	case *cpupb.UltraMetrics:
+		collectCPUUltraMetrics(reg, nodeLabel, payload)
+	case *cpupb.MediumMetrics:
+		collectCPUMediumMetrics(reg, nodeLabel, payload)
+	case *gpupb.FastMetrics:
+		prefix, module := "telemetry_gpu", "gpu"
+		if category == "amdgpu_fast" {
+			prefix, module = "telemetry_amdgpu", "amdgpu"
+		}
+		collectGPUMetrics(reg, prefix, nodeLabel, payload, gpuUUIDs(modules[module]))
+	case *memorypb.Metrics:
+		collectMemoryMetrics(reg, nodeLabel, payload)
+	case *storagepb.Metrics:
+		collectStorageMetrics(reg, nodeLabel, payload)
+	case *networkpb.Metrics:
+		collectNetworkMetrics(reg, nodeLabel, payload)
+	case *infinibandpb.Metrics:
+		collectInfinibandMetrics(reg, nodeLabel, payload)
+	case *processpb.Metrics:
+		reg.gauge("telemetry_process_count", "Number of processes reported by the node.", float64(len(payload.GetProcesses())), nodeLabel)
+	case *pb.DerivedMetrics:
+		collectDerivedMetrics(reg, nodeLabel, payload)
+	}
+}
+
+func collectRegistrationMetrics(reg *metricSet, nodeLabel metricLabel, modules map[string]any) {
+	if v, ok := modules["memory"].(*memorypb.ModuleRegistration); ok && v.GetStatic() != nil {
+		reg.gauge("telemetry_memory_total_bytes", "Total physical memory.", float64(v.GetStatic().GetTotalBytes()), nodeLabel)
+	}
+	if v, ok := modules["storage"].(*storagepb.ModuleRegistration); ok {
+		for _, disk := range v.GetStaticDisks() {
+			reg.gauge("telemetry_disk_total_bytes", "Filesystem capacity.", float64(disk.GetTotalBytes()),
+				nodeLabel, label("disk", disk.GetName()), label("mountpoint", disk.GetMountpoint()), label("fstype", disk.GetFilesystem()))
+		}
+	}
+}
+
+func collectCPUUltraMetrics(reg *metricSet, nodeLabel metricLabel, m *cpupb.UltraMetrics) {
+	for _, core := range m.GetPerCore() {
+		labels := []metricLabel{nodeLabel, intLabel("core", int64(core.GetCoreId())), intLabel("package", int64(core.GetPackageId()))}
+		reg.gauge("telemetry_cpu_core_scaling_min_khz", "Minimum scaling frequency of the core.", float64(core.GetScalingMinKhz()), labels...)
+		reg.gauge("telemetry_cpu_core_scaling_max_khz", "Maximum scaling frequency of the core.", float64(core.GetScalingMaxKhz()), labels...)
+		if core.GetCurrentGovernor() != "" {
+			reg.gauge("telemetry_cpu_core_governor_info", "Active cpufreq governor and driver of the core.", 1,
+				append(labels, label("governor", core.GetCurrentGovernor()), label("driver", core.GetScalingDriver()))...)
+		}
+	}
+	for _, rapl := range m.GetRapl() {
+		pkg := intLabel("package", int64(rapl.GetPackageId()))
+		reg.counter("telemetry_cpu_package_energy_microjoules_total", "RAPL package energy counter.", float64(rapl.GetEnergyMicroJ()), nodeLabel, pkg)
+		reg.counter("telemetry_cpu_dram_energy_microjoules_total", "RAPL DRAM energy counter.", float64(rapl.GetDramEnergyMicroJ()), nodeLabel, pkg)
+		reg.gauge("telemetry_cpu_package_power_cap_microwatts", "RAPL package power limit.", float64(rapl.GetPowerCapMicroW()), nodeLabel, pkg)
+		reg.gauge("telemetry_cpu_dram_power_cap_microwatts", "RAPL DRAM power limit.", float64(rapl.GetDramPowerCapMicroW()), nodeLabel, pkg)
+	}
+	for _, uncore := range m.GetUncore() {
+		pkg := intLabel("package", int64(uncore.GetPackageId()))
+		reg.gauge("telemetry_cpu_uncore_frequency_khz", "Current uncore frequency.", float64(uncore.GetCurrentKhz()), nodeLabel, pkg)
+		reg.gauge("telemetry_cpu_uncore_min_khz", "Minimum uncore frequency.", float64(uncore.GetMinKhz()), nodeLabel, pkg)
+		reg.gauge("telemetry_cpu_uncore_max_khz", "Maximum uncore frequency.", float64(uncore.GetMaxKhz()), nodeLabel, pkg)
+	}
+}
+
+func collectCPUMediumMetrics(reg *metricSet, nodeLabel metricLabel, m *cpupb.MediumMetrics) {
+	for _, core := range m.GetCores() {
+		labels := []metricLabel{nodeLabel, intLabel("core", int64(core.GetCoreId())), intLabel("package", int64(core.GetPackageId()))}
+		reg.gauge("telemetry_cpu_core_utilization", "Core utilization ratio between 0 and 1.", core.GetUtilization(), labels...)
+		reg.gauge("telemetry_cpu_core_frequency_khz", "Current scaling frequency of the core.", float64(core.GetScalingCurKhz()), labels...)
+	}
+	for _, temp := range m.GetTemperatures() {
+		reg.gauge("telemetry_cpu_package_temperature_millicelsius", "Package temperature.", float64(temp.GetMilliC()),
+			nodeLabel, intLabel("package", int64(temp.GetPackageId())))
+	}
+}
+
+// gpuUUIDs maps device indexes to UUIDs from a GPU module registration.
+func gpuUUIDs(registration any) map[int32]string {
+	v, ok := registration.(*gpupb.ModuleRegistration)
+	if !ok {
+		return nil
+	}
+	out := make(map[int32]string, len(v.GetStatic()))
+	for _, info := range v.GetStatic() {
+		out[info.GetIndex()] = info.GetUuid()
+	}
+	return out
+}
+
+func collectGPUMetrics(reg *metricSet, prefix string, nodeLabel metricLabel, m *gpupb.FastMetrics, uuids map[int32]string) {
+	for _, dev := range m.GetDevices() {
+		labels := []metricLabel{nodeLabel, intLabel("index", int64(dev.GetIndex())), label("uuid", uuids[dev.GetIndex()])}
+		reg.gauge(prefix+"_utilization_percent", "GPU core utilization.", float64(dev.GetUtilizationGpu()), labels...)
+		reg.gauge(prefix+"_memory_utilization_percent", "GPU memory controller utilization.", float64(dev.GetUtilizationMem()), labels...)
+		reg.gauge(prefix+"_memory_used_bytes", "GPU memory in use.", float64(dev.GetMemoryUsedBytes()), labels...)
+		reg.gauge(prefix+"_temperature_celsius", "GPU temperature.", float64(dev.GetTemperatureC()), labels...)
+		reg.gauge(prefix+"_power_milliwatts", "GPU power draw.", float64(dev.GetPowerUsageMilliwatt()), labels...)
+		reg.gauge(prefix+"_power_limit_milliwatts", "GPU power limit.", float64(dev.GetPowerLimitMilliwatt()), labels...)
+		reg.gauge(prefix+"_graphics_clock_mhz", "GPU graphics clock.", float64(dev.GetGraphicsClockMhz()), labels...)
+		reg.gauge(prefix+"_memory_clock_mhz", "GPU memory clock.", float64(dev.GetMemoryClockMhz()), labels...)
+		reg.gauge(prefix+"_sm_clock_min_mhz", "Locked minimum SM clock.", float64(dev.GetSmClockMinMhz()), labels...)
+		reg.gauge(prefix+"_sm_clock_max_mhz", "Locked maximum SM clock.", float64(dev.GetSmClockMaxMhz()), labels...)
+		reg.gauge(prefix+"_mem_clock_min_mhz", "Locked minimum memory clock.", float64(dev.GetMemClockMinMhz()), labels...)
+		reg.gauge(prefix+"_mem_clock_max_mhz", "Locked maximum memory clock.", float64(dev.GetMemClockMaxMhz()), labels...)
+	}
+}
+
+func collectMemoryMetrics(reg *metricSet, nodeLabel metricLabel, m *memorypb.Metrics) {
+	reg.gauge("telemetry_memory_used_bytes", "Memory in use.", float64(m.GetUsedBytes()), nodeLabel)
+	reg.gauge("telemetry_memory_free_bytes", "Unused memory.", float64(m.GetFreeBytes()), nodeLabel)
+	reg.gauge("telemetry_memory_available_bytes", "Memory available for new allocations.", float64(m.GetAvailableBytes()), nodeLabel)
+	reg.gauge("telemetry_memory_cached_bytes", "Page cache size.", float64(m.GetCachedBytes()), nodeLabel)
+	reg.gauge("telemetry_memory_buffers_bytes", "Buffer cache size.", float64(m.GetBuffersBytes()), nodeLabel)
+}
+
+func collectStorageMetrics(reg *metricSet, nodeLabel metricLabel, m *storagepb.Metrics) {
+	for _, disk := range m.GetDisks() {
+		labels := []metricLabel{nodeLabel, label("disk", disk.GetName())}
+		reg.gauge("telemetry_disk_used_bytes", "Filesystem space in use.", float64(disk.GetUsedBytes()), labels...)
+		reg.gauge("telemetry_disk_free_bytes", "Filesystem space left.", float64(disk.GetFreeBytes()), labels...)
+		reg.counter("telemetry_disk_read_sectors_total", "Sectors read from the device.", float64(disk.GetReadSectors()), labels...)
+		reg.counter("telemetry_disk_write_sectors_total", "Sectors written to the device.", float64(disk.GetWriteSectors()), labels...)
+		reg.counter("telemetry_disk_reads_total", "Completed read I/Os.", float64(disk.GetReadIos()), labels...)
+		reg.counter("telemetry_disk_writes_total", "Completed write I/Os.", float64(disk.GetWriteIos()), labels...)
+	}
+}
+
+func collectNetworkMetrics(reg *metricSet, nodeLabel metricLabel, m *networkpb.Metrics) {
+	for _, iface := range m.GetInterfaces() {
+		labels := []metricLabel{nodeLabel, label("interface", iface.GetName())}
+		reg.counter("telemetry_network_rx_bytes_total", "Bytes received by the interface.", float64(iface.GetRxBytes()), labels...)
+		reg.counter("telemetry_network_tx_bytes_total", "Bytes sent by the interface.", float64(iface.GetTxBytes()), labels...)
+		reg.counter("telemetry_network_rx_packets_total", "Packets received by the interface.", float64(iface.GetRxPackets()), labels...)
+		reg.counter("telemetry_network_tx_packets_total", "Packets sent by the interface.", float64(iface.GetTxPackets()), labels...)
+	}
+}
+
+func collectDerivedMetrics(reg *metricSet, nodeLabel metricLabel, m *pb.DerivedMetrics) {
+	for _, rapl := range m.GetRapl() {
+		pkg := intLabel("package", int64(rapl.GetPackageId()))
+		reg.gauge("telemetry_cpu_package_power_watts", "RAPL package power derived from the energy counter.", rapl.GetPackageWatts(), nodeLabel, pkg)
+		reg.gauge("telemetry_cpu_dram_power_watts", "RAPL DRAM power derived from the energy counter.", rapl.GetDramWatts(), nodeLabel, pkg)
+	}
+	for _, iface := range m.GetInterfaces() {
+		labels := []metricLabel{nodeLabel, label("interface", iface.GetName())}
+		reg.gauge("telemetry_network_rx_bytes_per_second", "Receive throughput of the interface.", iface.GetRxBytesPerSecond(), labels...)
+		reg.gauge("telemetry_network_tx_bytes_per_second", "Transmit throughput of the interface.", iface.GetTxBytesPerSecond(), labels...)
+		reg.gauge("telemetry_network_rx_packets_per_second", "Packets received per second.", iface.GetRxPacketsPerSecond(), labels...)
+		reg.gauge("telemetry_network_tx_packets_per_second", "Packets sent per second.", iface.GetTxPacketsPerSecond(), labels...)
+	}
+	for _, disk := range m.GetDisks() {
+		labels := []metricLabel{nodeLabel, label("disk", disk.GetName())}
+		reg.gauge("telemetry_disk_read_bytes_per_second", "Read throughput of the device.", disk.GetReadBytesPerSecond(), labels...)
+		reg.gauge("telemetry_disk_write_bytes_per_second", "Write throughput of the device.", disk.GetWriteBytesPerSecond(), labels...)
+		reg.gauge("telemetry_disk_read_iops", "Completed read I/Os per second.", disk.GetReadIops(), labels...)
+		reg.gauge("telemetry_disk_write_iops", "Completed write I/Os per second.", disk.GetWriteIops(), labels...)
+	}
+	for _, port := range m.GetIbPorts() {
+		labels := []metricLabel{nodeLabel, label("device", port.GetIbDevice()), intLabel("port", int64(port.GetPort()))}
+		reg.gauge("telemetry_ib_rx_bytes_per_second", "Receive throughput of the port.", port.GetRxBytesPerSecond(), labels...)
+		reg.gauge("telemetry_ib_tx_bytes_per_second", "Transmit throughput of the port.", port.GetTxBytesPerSecond(), labels...)
+	}
+}
+
+func collectInfinibandMetrics(reg *metricSet, nodeLabel metricLabel, m *infinibandpb.Metrics) {
+	for _, iface := range m.GetInterfaces() {
+		labels := []metricLabel{nodeLabel, label("device", iface.GetIbDevice()), intLabel("port", int64(iface.GetPort()))}
+		reg.counter("telemetry_ib_rx_bytes_total", "Bytes received on the port.", float64(iface.GetRxBytes()), labels...)
+		reg.counter("telemetry_ib_tx_bytes_total", "Bytes sent on the port.", float64(iface.GetTxBytes()), labels...)
+		reg.gauge("telemetry_ib_mtu_bytes", "MTU of the IPoIB interface.", float64(iface.GetMtu()), labels...)
+		reg.gauge("telemetry_ib_port_info", "Link state of the port.", 1,
+			append(labels,
+				label("interface", iface.GetName()),
+				label("state", iface.GetLinkState()),
+				label("physical_state", iface.GetPhysicalState()),
+				label("rate", iface.GetRate()),
+			)...)
+	}
+}
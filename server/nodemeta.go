@@ -0,0 +1,152 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+)
+
+const nodeMetaFile = "nodes.pb"
+
+// nodeMeta is the administrative state of a node: cordon, annotations and
+// label overrides.
+type nodeMeta struct {
+	cordoned     bool
+	cordonReason string
+	cordonedAt   int64
+	annotations  map[string]string
+	labels       map[string]string
+}
+
+func (m nodeMeta) empty() bool {
+	return !m.cordoned && len(m.annotations) == 0 && len(m.labels) == 0
+}
+
+// nodeMetaStore keeps node metadata apart from the node buffers so that it
+// outlives evictions. Every change is written through to a snapshot file;
+// changes that cannot be persisted are rolled back.
+type nodeMetaStore struct {
+	mu    sync.RWMutex
+	path  string
+	nodes map[string]nodeMeta
+}
+
+func newNodeMetaStore(dir string) (*nodeMetaStore, error) {
+	m := &nodeMetaStore{nodes: make(map[string]nodeMeta)}
+	if dir != "" {
+		m.path = filepath.Join(dir, nodeMetaFile)
+		if err := m.load(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *nodeMetaStore) Get(nodeID string) nodeMeta {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.nodes[nodeID]
+}
+
+// Update applies fn to a copy of the node's metadata and persists the result.
+func (m *nodeMetaStore) Update(nodeID string, fn func(*nodeMeta)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev, existed := m.nodes[nodeID]
+	next := prev
+	next.annotations = maps.Clone(prev.annotations)
+	next.labels = maps.Clone(prev.labels)
+	fn(&next)
+	if next.empty() {
+		delete(m.nodes, nodeID)
+	} else {
+		m.nodes[nodeID] = next
+	}
+	if err := m.saveLocked(); err != nil {
+		if existed {
+			m.nodes[nodeID] = prev
+		} else {
+			delete(m.nodes, nodeID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (m *nodeMetaStore) Delete(nodeID string) error {
+	return m.Update(nodeID, func(meta *nodeMeta) { *meta = nodeMeta{} })
+}
+
+func (m *nodeMetaStore) saveLocked() error {
+	if m.path == "" {
+		return nil
+	}
+	ids := make([]string, 0, len(m.nodes))
+	for id := range m.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	snapshot := &pb.NodeMetaSnapshot{Nodes: make([]*pb.NodeMeta, 0, len(ids))}
+	for _, id := range ids {
+		meta := m.nodes[id]
+		snapshot.Nodes = append(snapshot.Nodes, &pb.NodeMeta{
+			NodeId:             id,
+			Cordoned:           meta.cordoned,
+			CordonReason:       meta.cordonReason,
+			CordonedAtUnixNano: meta.cordonedAt,
+			Annotations:        meta.annotations,
+			Labels:             meta.labels,
+		})
+	}
+
+	raw, err := proto.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("encode node metadata: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0o755); err != nil {
+		return fmt.Errorf("create node metadata dir: %w", err)
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return fmt.Errorf("write node metadata: %w", err)
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return fmt.Errorf("rename node metadata: %w", err)
+	}
+	return nil
+}
+
+func (m *nodeMetaStore) load() error {
+	raw, err := os.ReadFile(m.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read node metadata: %w", err)
+	}
+	var snapshot pb.NodeMetaSnapshot
+	if err := proto.Unmarshal(raw, &snapshot); err != nil {
+		return fmt.Errorf("decode node metadata: %w", err)
+	}
+	for _, node := range snapshot.GetNodes() {
+		meta := nodeMeta{
+			cordoned:     node.GetCordoned(),
+			cordonReason: node.GetCordonReason(),
+			cordonedAt:   node.GetCordonedAtUnixNano(),
+			annotations:  node.GetAnnotations(),
+			labels:       node.GetLabels(),
+		}
+		if node.GetNodeId() != "" && !meta.empty() {
+			m.nodes[node.GetNodeId()] = meta
+		}
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/eWloYW8/Telemetry/api"
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+	"github.com/eWloYW8/Telemetry/config"
+)
+
+const (
+	offlineCommandsFile = "offline_commands.pb"
+
+	offlineCheckInterval = time.Second
+)
+
+var (
+	errCommandHeld      = errors.New("node is offline; command held until it reconnects")
+	errDeliverByPassed  = errors.New("not delivered before deliver_by")
+	errDeliverByTooFar  = errors.New("deliver_by is beyond offline_commands.max_ttl")
+	errOfflineQueueFull = errors.New("offline command queue of node is full")
+	errHeldNodeDeleted  = errors.New("node was deleted before it reconnected")
+)
+
+// heldCommand is a command waiting for its node to reconnect.
+type heldCommand struct {
+	cmd    *api.Command
+	origin commandOrigin
+}
+
+// offlineQueue holds commands for offline nodes until they reconnect or their
+// deliver_by passes, persisted so that a server restart does not lose them.
+// Each node's commands are kept in the order they were issued.
+type offlineQueue struct {
+	mu         sync.Mutex
+	path       string
+	maxTTL     time.Duration
+	maxPerNode int
+	nodes      map[string][]heldCommand
+	log        zerolog.Logger
+}
+
+func newOfflineQueue(dir string, cfg config.OfflineCommandsConfig, logger zerolog.Logger) (*offlineQueue, error) {
+	q := &offlineQueue{
+		maxTTL:     cfg.MaxTTL,
+		maxPerNode: cfg.MaxPerNode,
+		nodes:      make(map[string][]heldCommand),
+		log:        logger,
+	}
+	if dir != "" {
+		q.path = filepath.Join(dir, offlineCommandsFile)
+		if err := q.load(); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// Hold queues a command for its offline node.
+func (q *offlineQueue) Hold(cmd *api.Command, origin commandOrigin, now time.Time) error {
+	switch {
+	case cmd.DeliverBy <= now.UnixNano():
+		return errDeliverByPassed
+	case cmd.DeliverBy > now.Add(q.maxTTL).UnixNano():
+		return fmt.Errorf("%w (%s)", errDeliverByTooFar, q.maxTTL)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	prev := q.nodes[cmd.NodeID]
+	if len(prev) >= q.maxPerNode {
+		return fmt.Errorf("node %s: %w (%d commands)", cmd.NodeID, errOfflineQueueFull, q.maxPerNode)
+	}
+	q.nodes[cmd.NodeID] = append(slices.Clip(prev), heldCommand{cmd: cmd, origin: origin})
+	if err := q.saveLocked(); err != nil {
+		q.setLocked(cmd.NodeID, prev)
+		return err
+	}
+	return nil
+}
+
+// Next returns the oldest command held for a node.
+func (q *offlineQueue) Next(nodeID string) (heldCommand, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	held := q.nodes[nodeID]
+	if len(held) == 0 {
+		return heldCommand{}, false
+	}
+	return held[0], true
+}
+
+// Remove drops a held command and reports whether it was still held.
+func (q *offlineQueue) Remove(nodeID, commandID string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	prev := q.nodes[nodeID]
+	i := slices.IndexFunc(prev, func(h heldCommand) bool { return h.cmd.ID == commandID })
+	if i < 0 {
+		return false
+	}
+	q.setLocked(nodeID, slices.Delete(slices.Clone(prev), i, i+1))
+	if err := q.saveLocked(); err != nil {
+		// The command is handed out regardless; at worst it is delivered a
+		// second time after a restart.
+		q.log.Error().Err(err).Str("node_id", nodeID).Str("command_id", commandID).Msg("save offline commands")
+	}
+	return true
+}
+
+// Expire drops and returns the commands whose deliver_by has passed.
+func (q *offlineQueue) Expire(now time.Time) []heldCommand {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var expired []heldCommand
+	for nodeID, held := range q.nodes {
+		kept := slices.DeleteFunc(slices.Clone(held), func(h heldCommand) bool {
+			if h.cmd.DeliverBy > now.UnixNano() {
+				return false
+			}
+			expired = append(expired, h)
+			return true
+		})
+		if len(kept) != len(held) {
+			q.setLocked(nodeID, kept)
+		}
+	}
+	if len(expired) > 0 {
+		if err := q.saveLocked(); err != nil {
+			q.log.Error().Err(err).Msg("save offline commands")
+		}
+	}
+	return expired
+}
+
+// DropNode drops and returns every command held for a node.
+func (q *offlineQueue) DropNode(nodeID string) []heldCommand {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	held, ok := q.nodes[nodeID]
+	if !ok {
+		return nil
+	}
+	delete(q.nodes, nodeID)
+	if err := q.saveLocked(); err != nil {
+		q.log.Error().Err(err).Str("node_id", nodeID).Msg("save offline commands")
+	}
+	return held
+}
+
+// All returns every held command, oldest first.
+func (q *offlineQueue) All() []heldCommand {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var out []heldCommand
+	for _, held := range q.nodes {
+		out = append(out, held...)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].cmd.IssuedAt < out[j].cmd.IssuedAt })
+	return out
+}
+
+func (q *offlineQueue) setLocked(nodeID string, held []heldCommand) {
+	if len(held) == 0 {
+		delete(q.nodes, nodeID)
+		return
+	}
+	q.nodes[nodeID] = held
+}
+
+func (q *offlineQueue) saveLocked() error {
+	if q.path == "" {
+		return nil
+	}
+	ids := make([]string, 0, len(q.nodes))
+	for id := range q.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	snapshot := &pb.OfflineCommandSnapshot{}
+	for _, id := range ids {
+		for _, h := range q.nodes[id] {
+			snapshot.Commands = append(snapshot.Commands, &pb.OfflineCommand{
+				Command:    api.ToPBCommand(h.cmd),
+				Source:     h.origin.source,
+				User:       h.origin.user,
+				RemoteAddr: h.origin.remoteAddr,
+			})
+		}
+	}
+
+	raw, err := proto.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("encode offline commands: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(q.path), 0o755); err != nil {
+		return fmt.Errorf("create offline commands dir: %w", err)
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return fmt.Errorf("write offline commands: %w", err)
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return fmt.Errorf("rename offline commands: %w", err)
+	}
+	return nil
+}
+
+func (q *offlineQueue) load() error {
+	raw, err := os.ReadFile(q.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read offline commands: %w", err)
+	}
+	var snapshot pb.OfflineCommandSnapshot
+	if err := proto.Unmarshal(raw, &snapshot); err != nil {
+		return fmt.Errorf("decode offline commands: %w", err)
+	}
+	for _, held := range snapshot.GetCommands() {
+		cmd := api.FromPBCommand(held.GetCommand())
+		if cmd == nil || cmd.ID == "" || cmd.NodeID == "" {
+			continue
+		}
+		q.nodes[cmd.NodeID] = append(q.nodes[cmd.NodeID], heldCommand{
+			cmd: cmd,
+			origin: commandOrigin{
+				source:     held.GetSource(),
+				user:       held.GetUser(),
+				remoteAddr: held.GetRemoteAddr(),
+			},
+		})
+	}
+	return nil
+}
+
+// holdCommand keeps a command for an offline node that asked for delayed
+// delivery, and returns errCommandHeld once it is queued.
+func (s *Server) holdCommand(ctx context.Context, cmd *api.Command, offline error) error {
+	if !s.store.NodeKnown(cmd.NodeID) {
+		// Only nodes the server has seen can come back.
+		return offline
+	}
+	if err := s.offline.Hold(cmd, commandOriginFrom(ctx), time.Now()); err != nil {
+		return err
+	}
+	s.commands.MarkHeld(cmd.ID)
+	s.log.Info().
+		Str("node_id", cmd.NodeID).
+		Str("command_id", cmd.ID).
+		Str("command_type", string(cmd.Type)).
+		Time("deliver_by", time.Unix(0, cmd.DeliverBy)).
+		Msg("holding command for offline node")
+	return fmt.Errorf("node %s: %w", cmd.NodeID, errCommandHeld)
+}
+
+// deliverHeld sends the commands held for a node into its new session, one at
+// a time and in the order they were issued. Commands not yet sent when the
+// session ends stay held for the next one.
+func (s *Server) deliverHeld(ctx context.Context, session *nodeSession) {
+	for ctx.Err() == nil {
+		held, ok := s.offline.Next(session.nodeID)
+		if !ok {
+			return
+		}
+		if !s.offline.Remove(session.nodeID, held.cmd.ID) {
+			continue
+		}
+		cmd := held.cmd
+		if cmd.DeliverBy <= time.Now().UnixNano() {
+			s.commands.Fail(cmd.ID, commandStateFailed, errDeliverByPassed)
+			continue
+		}
+		if err := validateCommand(s.store.NodeRegistration(session.nodeID), cmd); err != nil {
+			// The node may have come back with different hardware.
+			s.commands.Fail(cmd.ID, commandStateFailed, err)
+			continue
+		}
+		if s.store.NodeCordoned(session.nodeID) {
+			s.commands.Fail(cmd.ID, commandStateFailed, fmt.Errorf("node %s: %w", session.nodeID, errNodeCordoned))
+			continue
+		}
+		cmdCtx, cancel := context.WithTimeout(ctx, s.cfg.CommandTimeout)
+		_, _ = s.sendCommand(cmdCtx, session, cmd)
+		cancel()
+	}
+}
+
+// expireHeldLoop fails held commands once their deliver_by passes.
+func (s *Server) expireHeldLoop(ctx context.Context) {
+	ticker := time.NewTicker(offlineCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, held := range s.offline.Expire(now) {
+				s.log.Warn().
+					Str("node_id", held.cmd.NodeID).
+					Str("command_id", held.cmd.ID).
+					Str("command_type", string(held.cmd.Type)).
+					Msg("held command expired before its node reconnected")
+				s.commands.Fail(held.cmd.ID, commandStateFailed, errDeliverByPassed)
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/eWloYW8/Telemetry/config"
+)
+
+const otlpGRPCExportMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// otlpWriter encodes batches as OTLP ExportMetricsServiceRequest and sends
+// them over OTLP/gRPC or OTLP/HTTP (protobuf).
+type otlpWriter struct {
+	send  func(ctx context.Context, body []byte) error
+	close func() error
+}
+
+func newOTLPWriter(cfg config.OTLPConfig) (*otlpWriter, error) {
+	tlsCfg, err := exportTLSConfig(cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.Protocol {
+	case "grpc":
+		creds := credentials.NewTLS(tlsCfg)
+		if cfg.Insecure {
+			creds = insecure.NewCredentials()
+		}
+		sender, err := newOTLPGRPCSender(cfg.Endpoint, cfg.Headers, cfg.Timeout, creds)
+		if err != nil {
+			return nil, err
+		}
+		return &otlpWriter{send: sender.Send, close: sender.Close}, nil
+	case "http":
+		sender := newHTTPSinkSender(cfg.Endpoint, cfg.Headers, cfg.Timeout, tlsCfg)
+		sender.contentType = "application/x-protobuf"
+		sender.checkBody = checkOTLPPartialSuccess
+		return &otlpWriter{send: sender.Send, close: sender.Close}, nil
+	default:
+		return nil, fmt.Errorf("unsupported otlp protocol %q", cfg.Protocol)
+	}
+}
+
+// Encode builds one OTLP resource per node.
+func (w *otlpWriter) Encode(batch []nodeMetrics) ([]byte, error) {
+	resources := make([]otlpResource, 0, len(batch))
+	for _, nm := range batch {
+		attributes := []metricLabel{
+			label("service.name", "telemetry"),
+			label("telemetry.node_id", nm.nodeID),
+		}
+		if nm.hostname != "" {
+			attributes = append(attributes, label("host.name", nm.hostname))
+		}
+		resources = append(resources, otlpResource{attributes: attributes, metrics: nm.metrics})
+	}
+	return appendOTLPRequest(make([]byte, 0, 64<<10), resources), nil
+}
+
+func (w *otlpWriter) Send(ctx context.Context, body []byte) error {
+	return w.send(ctx, body)
+}
+
+func (w *otlpWriter) Close() error {
+	return w.close()
+}
+
+type otlpGRPCSender struct {
+	conn    *grpc.ClientConn
+	headers metadata.MD
+	timeout time.Duration
+}
+
+func newOTLPGRPCSender(endpoint string, headers map[string]string, timeout time.Duration, creds credentials.TransportCredentials) (*otlpGRPCSender, error) {
+	conn, err := grpc.NewClient(endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("create otlp grpc client: %w", err)
+	}
+	return &otlpGRPCSender{
+		conn:    conn,
+		headers: metadata.New(headers),
+		timeout: timeout,
+	}, nil
+}
+
+func (s *otlpGRPCSender) Send(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(ctx, s.headers), s.timeout)
+	defer cancel()
+	var resp []byte
+	err := s.conn.Invoke(ctx, otlpGRPCExportMethod, &body, &resp, grpc.ForceCodec(otlpRawCodec{}))
+	if err != nil {
+		switch status.Code(err) {
+		case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted,
+			codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+			return &sinkError{err: fmt.Errorf("otlp grpc export: %w", err), retryable: true}
+		default:
+			return &sinkError{err: fmt.Errorf("otlp grpc export: %w", err)}
+		}
+	}
+	return checkOTLPPartialSuccess(resp)
+}
+
+func (s *otlpGRPCSender) Close() error {
+	return s.conn.Close()
+}
+
+// otlpRawCodec passes pre-encoded protobuf messages through gRPC.
+type otlpRawCodec struct{}
+
+func (otlpRawCodec) Marshal(v any) ([]byte, error) {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("otlp codec: unexpected message type %T", v)
+	}
+	return *b, nil
+}
+
+func (otlpRawCodec) Unmarshal(data []byte, v any) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("otlp codec: unexpected message type %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (otlpRawCodec) Name() string {
+	return "proto"
+}
+
+// checkOTLPPartialSuccess reports data points the collector rejected while
+// accepting the rest of the request.
+func checkOTLPPartialSuccess(resp []byte) error {
+	rejected, message := parseOTLPPartialSuccess(resp)
+	if rejected == 0 && message == "" {
+		return nil
+	}
+	return &sinkError{
+		err:     fmt.Errorf("otlp collector rejected %d data points: %s", rejected, message),
+		partial: true,
+	}
+}
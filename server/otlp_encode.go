@@ -0,0 +1,199 @@
+package server
+
+import (
+	"math"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The OTLP messages are encoded by hand with protowire so the server does not
+// need the generated opentelemetry-proto packages. Field numbers follow
+// opentelemetry/proto/collector/metrics/v1 and opentelemetry/proto/metrics/v1.
+const (
+	otlpRequestResourceMetrics = 1
+
+	otlpResourceMetricsResource = 1
+	otlpResourceMetricsScope    = 2
+
+	otlpResourceAttributes = 1
+
+	otlpScopeMetricsScope   = 1
+	otlpScopeMetricsMetrics = 2
+
+	otlpScopeName    = 1
+	otlpScopeVersion = 2
+
+	otlpMetricName        = 1
+	otlpMetricDescription = 2
+	otlpMetricGauge       = 5
+	otlpMetricSum         = 7
+
+	otlpGaugeDataPoints = 1
+
+	otlpSumDataPoints  = 1
+	otlpSumTemporality = 2
+	otlpSumMonotonic   = 3
+
+	otlpPointTime       = 3
+	otlpPointAsDouble   = 4
+	otlpPointAttributes = 7
+
+	otlpKeyValueKey   = 1
+	otlpKeyValueValue = 2
+
+	otlpAnyValueString = 1
+
+	otlpTemporalityCumulative = 2
+
+	otlpPartialSuccess         = 1
+	otlpPartialSuccessRejected = 1
+	otlpPartialSuccessMessage  = 2
+)
+
+const otlpScope = "github.com/eWloYW8/Telemetry/server"
+
+// otlpResource is one ResourceMetrics entry: the attributes identifying a
+// node and the metric families collected from its samples.
+type otlpResource struct {
+	attributes []metricLabel
+	metrics    *metricSet
+}
+
+func appendOTLPRequest(b []byte, resources []otlpResource) []byte {
+	for _, res := range resources {
+		b = appendWireMessage(b, otlpRequestResourceMetrics, func(b []byte) []byte {
+			return appendOTLPResourceMetrics(b, res)
+		})
+	}
+	return b
+}
+
+func appendOTLPResourceMetrics(b []byte, res otlpResource) []byte {
+	b = appendWireMessage(b, otlpResourceMetricsResource, func(b []byte) []byte {
+		for _, attr := range res.attributes {
+			b = appendOTLPKeyValue(b, otlpResourceAttributes, attr)
+		}
+		return b
+	})
+	return appendWireMessage(b, otlpResourceMetricsScope, func(b []byte) []byte {
+		b = appendWireMessage(b, otlpScopeMetricsScope, func(b []byte) []byte {
+			b = protowire.AppendTag(b, otlpScopeName, protowire.BytesType)
+			return protowire.AppendString(b, otlpScope)
+		})
+		for _, f := range res.metrics.sorted() {
+			b = appendWireMessage(b, otlpScopeMetricsMetrics, func(b []byte) []byte {
+				return appendOTLPMetric(b, f)
+			})
+		}
+		return b
+	})
+}
+
+func appendOTLPMetric(b []byte, f *metricFamily) []byte {
+	name := f.name
+	if f.kind == metricCounter {
+		// OTLP sums carry monotonicity in the type; the suffix is added back
+		// by Prometheus-compatible backends.
+		name = strings.TrimSuffix(name, "_total")
+	}
+	b = protowire.AppendTag(b, otlpMetricName, protowire.BytesType)
+	b = protowire.AppendString(b, name)
+	b = protowire.AppendTag(b, otlpMetricDescription, protowire.BytesType)
+	b = protowire.AppendString(b, f.help)
+
+	if f.kind != metricCounter {
+		return appendWireMessage(b, otlpMetricGauge, func(b []byte) []byte {
+			return appendOTLPDataPoints(b, otlpGaugeDataPoints, f.values)
+		})
+	}
+	return appendWireMessage(b, otlpMetricSum, func(b []byte) []byte {
+		b = appendOTLPDataPoints(b, otlpSumDataPoints, f.values)
+		b = protowire.AppendTag(b, otlpSumTemporality, protowire.VarintType)
+		b = protowire.AppendVarint(b, otlpTemporalityCumulative)
+		b = protowire.AppendTag(b, otlpSumMonotonic, protowire.VarintType)
+		return protowire.AppendVarint(b, 1)
+	})
+}
+
+func appendOTLPDataPoints(b []byte, field protowire.Number, values []metricValue) []byte {
+	for _, v := range values {
+		b = appendWireMessage(b, field, func(b []byte) []byte {
+			b = protowire.AppendTag(b, otlpPointTime, protowire.Fixed64Type)
+			b = protowire.AppendFixed64(b, uint64(v.at))
+			b = protowire.AppendTag(b, otlpPointAsDouble, protowire.Fixed64Type)
+			b = protowire.AppendFixed64(b, math.Float64bits(v.value))
+			for _, l := range v.labels {
+				b = appendOTLPKeyValue(b, otlpPointAttributes, l)
+			}
+			return b
+		})
+	}
+	return b
+}
+
+func appendOTLPKeyValue(b []byte, field protowire.Number, l metricLabel) []byte {
+	return appendWireMessage(b, field, func(b []byte) []byte {
+		b = protowire.AppendTag(b, otlpKeyValueKey, protowire.BytesType)
+		b = protowire.AppendString(b, l.Name)
+		return appendWireMessage(b, otlpKeyValueValue, func(b []byte) []byte {
+			b = protowire.AppendTag(b, otlpAnyValueString, protowire.BytesType)
+			return protowire.AppendString(b, l.Value)
+		})
+	})
+}
+
+// parseOTLPPartialSuccess extracts the partial_success of an
+// ExportMetricsServiceResponse.
+func parseOTLPPartialSuccess(b []byte) (rejected int64, message string) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return 0, ""
+		}
+		b = b[n:]
+		if num != otlpPartialSuccess || typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return 0, ""
+			}
+			b = b[n:]
+			continue
+		}
+		inner, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return 0, ""
+		}
+		b = b[n:]
+		for len(inner) > 0 {
+			num, typ, n := protowire.ConsumeTag(inner)
+			if n < 0 {
+				return rejected, message
+			}
+			inner = inner[n:]
+			switch {
+			case num == otlpPartialSuccessRejected && typ == protowire.VarintType:
+				v, n := protowire.ConsumeVarint(inner)
+				if n < 0 {
+					return rejected, message
+				}
+				rejected = int64(v)
+				inner = inner[n:]
+			case num == otlpPartialSuccessMessage && typ == protowire.BytesType:
+				v, n := protowire.ConsumeString(inner)
+				if n < 0 {
+					return rejected, message
+				}
+				message = v
+				inner = inner[n:]
+			default:
+				n = protowire.ConsumeFieldValue(num, typ, inner)
+				if n < 0 {
+					return rejected, message
+				}
+				inner = inner[n:]
+			}
+		}
+	}
+	return rejected, message
+}
@@ -0,0 +1,373 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// parquetWriter streams a flat table of optional columns as a Parquet file.
+// Rows are buffered per column until a row group is full, then written as one
+// SNAPPY-compressed PLAIN data page per column; only the footer accumulates
+// for the whole file. Thrift structures are encoded with the compact protocol
+// by hand.
+type parquetWriter struct {
+	w       *countingWriter
+	columns []exportColumn
+	chunks  []parquetColumnBuffer
+
+	rowsInGroup int
+	totalRows   int64
+	rowGroups   []parquetRowGroup
+}
+
+const (
+	parquetMagic            = "PAR1"
+	parquetRowGroupRows     = 64 << 10
+	parquetRowGroupMaxBytes = 32 << 20
+
+	parquetTypeBoolean   = 0
+	parquetTypeInt64     = 2
+	parquetTypeDouble    = 5
+	parquetTypeByteArray = 6
+
+	parquetRepetitionOptional = 1
+	parquetConvertedUTF8      = 0
+	parquetEncodingPlain      = 0
+	parquetEncodingRLE        = 3
+	parquetCodecSnappy        = 1
+	parquetPageData           = 0
+)
+
+type parquetColumnBuffer struct {
+	defLevels []bool
+	values    []byte
+	bits      int
+}
+
+type parquetColumnChunk struct {
+	offset           int64
+	numValues        int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+type parquetRowGroup struct {
+	columns   []parquetColumnChunk
+	numRows   int64
+	totalSize int64
+}
+
+type countingWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func newParquetWriter(w io.Writer, columns []exportColumn) (*parquetWriter, error) {
+	pw := &parquetWriter{
+		w:       &countingWriter{w: bufio.NewWriterSize(w, 256<<10)},
+		columns: columns,
+		chunks:  make([]parquetColumnBuffer, len(columns)),
+	}
+	if _, err := io.WriteString(pw.w, parquetMagic); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+func parquetPhysicalType(kind exportKind) int32 {
+	switch kind {
+	case exportKindInt:
+		return parquetTypeInt64
+	case exportKindFloat:
+		return parquetTypeDouble
+	case exportKindBool:
+		return parquetTypeBoolean
+	default:
+		return parquetTypeByteArray
+	}
+}
+
+func (pw *parquetWriter) WriteRow(row []exportValue) error {
+	size := 0
+	for i := range pw.columns {
+		chunk := &pw.chunks[i]
+		v := row[i]
+		chunk.defLevels = append(chunk.defLevels, v.set)
+		if !v.set {
+			continue
+		}
+		switch pw.columns[i].kind {
+		case exportKindInt:
+			chunk.values = binary.LittleEndian.AppendUint64(chunk.values, uint64(v.i))
+		case exportKindFloat:
+			chunk.values = binary.LittleEndian.AppendUint64(chunk.values, math.Float64bits(v.f))
+		case exportKindBool:
+			// PLAIN booleans are bit-packed, least significant bit first.
+			if chunk.bits%8 == 0 {
+				chunk.values = append(chunk.values, 0)
+			}
+			if v.b {
+				chunk.values[len(chunk.values)-1] |= 1 << (chunk.bits % 8)
+			}
+			chunk.bits++
+		default:
+			chunk.values = binary.LittleEndian.AppendUint32(chunk.values, uint32(len(v.s)))
+			chunk.values = append(chunk.values, v.s...)
+		}
+		size += len(chunk.values)
+	}
+	pw.rowsInGroup++
+	if pw.rowsInGroup >= parquetRowGroupRows || size >= parquetRowGroupMaxBytes {
+		return pw.flushRowGroup()
+	}
+	return nil
+}
+
+// Flush pushes completed row groups to the output. Buffered rows stay in the
+// current row group so frequent flushes do not fragment the file.
+func (pw *parquetWriter) Flush() error {
+	return pw.w.w.Flush()
+}
+
+func (pw *parquetWriter) flushRowGroup() error {
+	if pw.rowsInGroup == 0 {
+		return nil
+	}
+	group := parquetRowGroup{numRows: int64(pw.rowsInGroup)}
+	for i := range pw.chunks {
+		chunk := &pw.chunks[i]
+		page := appendParquetDefLevels(make([]byte, 0, len(chunk.values)+len(chunk.defLevels)/4+16), chunk.defLevels)
+		page = append(page, chunk.values...)
+		compressed := snappyEncode(page)
+
+		header := appendParquetPageHeader(nil, len(chunk.defLevels), len(page), len(compressed))
+		offset := pw.w.n
+		if _, err := pw.w.Write(header); err != nil {
+			return err
+		}
+		if _, err := pw.w.Write(compressed); err != nil {
+			return err
+		}
+		cc := parquetColumnChunk{
+			offset:           offset,
+			numValues:        int64(len(chunk.defLevels)),
+			uncompressedSize: int64(len(header) + len(page)),
+			compressedSize:   int64(len(header) + len(compressed)),
+		}
+		group.columns = append(group.columns, cc)
+		group.totalSize += cc.uncompressedSize
+
+		chunk.defLevels = chunk.defLevels[:0]
+		chunk.values = chunk.values[:0]
+		chunk.bits = 0
+	}
+	pw.rowGroups = append(pw.rowGroups, group)
+	pw.totalRows += int64(pw.rowsInGroup)
+	pw.rowsInGroup = 0
+	return nil
+}
+
+// Close writes the remaining rows and the file footer.
+func (pw *parquetWriter) Close() error {
+	if err := pw.flushRowGroup(); err != nil {
+		return err
+	}
+	footer := pw.appendFileMetaData(nil)
+	if _, err := pw.w.Write(footer); err != nil {
+		return err
+	}
+	var tail [8]byte
+	binary.LittleEndian.PutUint32(tail[:4], uint32(len(footer)))
+	copy(tail[4:], parquetMagic)
+	if _, err := pw.w.Write(tail[:]); err != nil {
+		return err
+	}
+	return pw.w.w.Flush()
+}
+
+// appendParquetDefLevels writes definition levels (bit width 1) in the RLE
+// hybrid encoding with its 4-byte length prefix, using RLE runs only.
+func appendParquetDefLevels(b []byte, levels []bool) []byte {
+	start := len(b)
+	b = append(b, 0, 0, 0, 0)
+	for i := 0; i < len(levels); {
+		j := i + 1
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		b = binary.AppendUvarint(b, uint64(j-i)<<1)
+		if levels[i] {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+		i = j
+	}
+	binary.LittleEndian.PutUint32(b[start:], uint32(len(b)-start-4))
+	return b
+}
+
+func appendParquetPageHeader(b []byte, numValues, uncompressed, compressed int) []byte {
+	t := thriftWriter{b: b}
+	t.i32(1, parquetPageData)
+	t.i32(2, int32(uncompressed))
+	t.i32(3, int32(compressed))
+	t.beginStruct(5)
+	t.i32(1, int32(numValues))
+	t.i32(2, parquetEncodingPlain)
+	t.i32(3, parquetEncodingRLE)
+	t.i32(4, parquetEncodingRLE)
+	t.endStruct()
+	t.stop()
+	return t.b
+}
+
+func (pw *parquetWriter) appendFileMetaData(b []byte) []byte {
+	t := thriftWriter{b: b}
+	t.i32(1, 1)
+
+	t.beginList(2, thriftStruct, len(pw.columns)+1)
+	t.beginElem()
+	t.str(4, "schema")
+	t.i32(5, int32(len(pw.columns)))
+	t.endElem()
+	for _, col := range pw.columns {
+		t.beginElem()
+		t.i32(1, parquetPhysicalType(col.kind))
+		t.i32(3, parquetRepetitionOptional)
+		t.str(4, col.name)
+		if col.kind == exportKindString {
+			t.i32(6, parquetConvertedUTF8)
+		}
+		t.endElem()
+	}
+
+	t.i64(3, pw.totalRows)
+
+	t.beginList(4, thriftStruct, len(pw.rowGroups))
+	for _, group := range pw.rowGroups {
+		t.beginElem()
+		t.beginList(1, thriftStruct, len(group.columns))
+		for i, cc := range group.columns {
+			col := pw.columns[i]
+			t.beginElem()
+			t.i64(2, cc.offset)
+			t.beginStruct(3)
+			t.i32(1, parquetPhysicalType(col.kind))
+			t.beginList(2, thriftI32, 2)
+			t.listI32(parquetEncodingPlain)
+			t.listI32(parquetEncodingRLE)
+			t.beginList(3, thriftBinary, 1)
+			t.listStr(col.name)
+			t.i32(4, parquetCodecSnappy)
+			t.i64(5, cc.numValues)
+			t.i64(6, cc.uncompressedSize)
+			t.i64(7, cc.compressedSize)
+			t.i64(9, cc.offset)
+			t.endStruct()
+			t.endElem()
+		}
+		t.i64(2, group.totalSize)
+		t.i64(3, group.numRows)
+		t.endElem()
+	}
+
+	t.str(6, "telemetry-server")
+	t.stop()
+	return t.b
+}
+
+// Thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes Thrift compact protocol structs. Field ids are tracked
+// per nesting level for delta encoding; list elements that are structs use
+// beginElem/endElem.
+type thriftWriter struct {
+	b     []byte
+	last  int16
+	stack []int16
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.b = append(t.b, byte(delta)<<4|typ)
+	} else {
+		t.b = append(t.b, typ)
+		t.b = binary.AppendVarint(t.b, int64(id))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.b = binary.AppendVarint(t.b, int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.b = binary.AppendVarint(t.b, v)
+}
+
+func (t *thriftWriter) str(id int16, v string) {
+	t.field(id, thriftBinary)
+	t.b = binary.AppendUvarint(t.b, uint64(len(v)))
+	t.b = append(t.b, v...)
+}
+
+func (t *thriftWriter) beginStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.beginElem()
+}
+
+func (t *thriftWriter) endStruct() {
+	t.endElem()
+}
+
+func (t *thriftWriter) beginElem() {
+	t.stack = append(t.stack, t.last)
+	t.last = 0
+}
+
+func (t *thriftWriter) endElem() {
+	t.stop()
+	t.last = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+func (t *thriftWriter) stop() {
+	t.b = append(t.b, 0)
+}
+
+func (t *thriftWriter) beginList(id int16, elemType byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.b = append(t.b, byte(size)<<4|elemType)
+	} else {
+		t.b = append(t.b, 0xf0|elemType)
+		t.b = binary.AppendUvarint(t.b, uint64(size))
+	}
+}
+
+func (t *thriftWriter) listI32(v int32) {
+	t.b = binary.AppendVarint(t.b, int64(v))
+}
+
+func (t *thriftWriter) listStr(v string) {
+	t.b = binary.AppendUvarint(t.b, uint64(len(v)))
+	t.b = append(t.b, v...)
+}
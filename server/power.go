@@ -0,0 +1,530 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+
+	cpupb "github.com/eWloYW8/Telemetry/agent/modules/cpu/pb"
+	gpupb "github.com/eWloYW8/Telemetry/agent/modules/gpu/pb"
+	"github.com/eWloYW8/Telemetry/api"
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+	"github.com/eWloYW8/Telemetry/config"
+)
+
+// Power-capped device kinds, named after the registration module that
+// advertises them.
+const (
+	powerKindCPU    = "cpu"
+	powerKindGPU    = "gpu"
+	powerKindAMDGPU = "amdgpu"
+)
+
+const (
+	// powerSaturation is the share of its cap a device must draw to count
+	// as held back by the cap, in which case it asks for its maximum.
+	powerSaturation = 0.9
+	// powerHeadroom is added on top of the draw of unsaturated devices.
+	powerHeadroom = 1.1
+)
+
+var errPowerGroupNotFound = errors.New("power budget group not found")
+
+// powerDevice is a device of a group as seen by one controller step.
+type powerDevice struct {
+	nodeID string
+	kind   string
+	index  int32
+
+	minW, maxW float64
+	usageW     float64
+	capW       float64 // current cap, 0 when unknown
+	targetW    float64
+
+	controlled bool
+	reason     string
+	err        string
+}
+
+func (d *powerDevice) key() string {
+	return d.nodeID + "/" + d.kind + "/" + strconv.Itoa(int(d.index))
+}
+
+// demand is the cap a controlled device would like: its draw plus some
+// headroom, or its maximum when it is running into its current cap.
+func (d *powerDevice) demand() float64 {
+	if d.capW > 0 && d.usageW >= powerSaturation*d.capW {
+		return d.maxW
+	}
+	return math.Min(math.Max(d.usageW*powerHeadroom, d.minW), d.maxW)
+}
+
+func (d *powerDevice) toPB() *pb.PowerDevice {
+	return &pb.PowerDevice{
+		NodeId:      d.nodeID,
+		Kind:        d.kind,
+		Index:       d.index,
+		MinWatts:    d.minW,
+		MaxWatts:    d.maxW,
+		UsageWatts:  d.usageW,
+		CapWatts:    d.capW,
+		TargetWatts: d.targetW,
+		Controlled:  d.controlled,
+		Reason:      d.reason,
+		Error:       d.err,
+	}
+}
+
+// allocatePower sets the target of every device and reports whether the
+// budget is too small for the minimum caps. Uncontrolled devices keep their
+// cap, which is reserved from the budget. Controlled devices start from their
+// minimum; the rest of the budget first covers their demand, scaled down in
+// proportion when it does not fit, and what is left after that raises them
+// towards their maximum in proportion to their remaining headroom.
+func allocatePower(devices []*powerDevice, budget float64) bool {
+	spare := budget
+	var controlled []*powerDevice
+	for _, d := range devices {
+		if !d.controlled {
+			d.targetW = d.capW
+			spare -= d.capW
+			continue
+		}
+		d.targetW = d.minW
+		spare -= d.minW
+		controlled = append(controlled, d)
+	}
+	if spare < 0 {
+		return true
+	}
+
+	var wanted float64
+	for _, d := range controlled {
+		wanted += d.demand() - d.minW
+	}
+	if wanted >= spare {
+		if wanted > 0 {
+			for _, d := range controlled {
+				d.targetW += (d.demand() - d.minW) * spare / wanted
+			}
+		}
+		return false
+	}
+
+	spare -= wanted
+	var headroom float64
+	for _, d := range controlled {
+		d.targetW = d.demand()
+		headroom += d.maxW - d.targetW
+	}
+	if headroom > 0 {
+		for _, d := range controlled {
+			d.targetW = math.Min(d.maxW, d.targetW+(d.maxW-d.targetW)*spare/headroom)
+		}
+	}
+	return false
+}
+
+// powerGroup is a budget with the state the controller keeps for it between
+// steps.
+type powerGroup struct {
+	cfg      config.PowerBudgetConfig
+	nodes    map[string]struct{}
+	selector labelSelector
+
+	// caps holds the last cap the controller applied to each device, which
+	// is what a device that drops out of control keeps reserved. Sampled caps
+	// lag behind commands, so caps is also taken as the current cap, except
+	// for devices in resync: those were out of control since and may have
+	// been reset, e.g. by a reboot, so their sampled cap is trusted instead.
+	caps   map[string]float64
+	resync map[string]struct{}
+
+	mu     sync.RWMutex
+	status *pb.PowerGroup
+}
+
+func (g *powerGroup) matches(snapshot api.NodeSnapshot) bool {
+	if _, ok := g.nodes[snapshot.NodeID]; g.nodes != nil && !ok {
+		return false
+	}
+	return g.selector == nil || g.selector.Matches(snapshot.Labels)
+}
+
+// powerController keeps each power budget group within its budget by moving
+// CPU package and GPU power caps between the group's devices.
+type powerController struct {
+	interval  time.Duration
+	minChange float64
+	groups    []*powerGroup
+	store     *Store
+	dispatch  func(ctx context.Context, nodeID string, cmd *api.Command) error
+	log       zerolog.Logger
+}
+
+func newPowerController(cfg config.PowerConfig, store *Store, dispatch func(context.Context, string, *api.Command) error, logger zerolog.Logger) (*powerController, error) {
+	c := &powerController{
+		interval:  cfg.Interval,
+		minChange: cfg.MinChangeWatts,
+		store:     store,
+		dispatch:  dispatch,
+		log:       logger,
+	}
+	seen := make(map[string]struct{}, len(cfg.Budgets))
+	for _, budget := range cfg.Budgets {
+		name := strings.TrimSpace(budget.Name)
+		if name == "" {
+			return nil, fmt.Errorf("power budget: missing name")
+		}
+		if _, ok := seen[name]; ok {
+			return nil, fmt.Errorf("power budget %q: duplicate name", name)
+		}
+		seen[name] = struct{}{}
+		if budget.BudgetWatts <= 0 {
+			return nil, fmt.Errorf("power budget %q: budget_watts must be positive", name)
+		}
+		selector, err := parseLabelSelector(budget.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("power budget %q: %w", name, err)
+		}
+		nodes := sliceToSet(budget.Nodes)
+		if nodes == nil && selector == nil {
+			return nil, fmt.Errorf("power budget %q: nodes or selector required", name)
+		}
+		budget.Name = name
+		c.groups = append(c.groups, &powerGroup{
+			cfg:      budget,
+			nodes:    nodes,
+			selector: selector,
+			caps:     make(map[string]float64),
+			resync:   make(map[string]struct{}),
+			status:   &pb.PowerGroup{Name: name, BudgetWatts: budget.BudgetWatts},
+		})
+	}
+	return c, nil
+}
+
+func (c *powerController) Run(ctx context.Context) {
+	if len(c.groups) == 0 {
+		return
+	}
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.step(ctx)
+		}
+	}
+}
+
+// step rebalances every group once. Groups are handled in configuration
+// order and a node belongs to the first group that matches it.
+func (c *powerController) step(ctx context.Context) {
+	snapshots := c.store.ListNodeSnapshots()
+	claimed := make(map[string]string)
+	for _, g := range c.groups {
+		var members []api.NodeSnapshot
+		for _, snapshot := range snapshots {
+			if !g.matches(snapshot) {
+				continue
+			}
+			if owner, ok := claimed[snapshot.NodeID]; ok {
+				c.log.Debug().Str("group", g.cfg.Name).Str("node_id", snapshot.NodeID).Str("owner", owner).Msg("node already in another power budget")
+				continue
+			}
+			claimed[snapshot.NodeID] = g.cfg.Name
+			members = append(members, snapshot)
+		}
+		c.rebalance(ctx, g, members)
+	}
+}
+
+func (c *powerController) rebalance(ctx context.Context, g *powerGroup, members []api.NodeSnapshot) {
+	var devices []*powerDevice
+	for _, snapshot := range members {
+		devices = append(devices, powerDevices(snapshot)...)
+	}
+	live := make(map[string]struct{}, len(devices))
+	for _, d := range devices {
+		key := d.key()
+		live[key] = struct{}{}
+		applied, ok := g.caps[key]
+		switch {
+		case !d.controlled:
+			// Hold what the device was last given; its node may still be
+			// running with it.
+			if ok {
+				d.capW = applied
+			}
+			if d.capW <= 0 {
+				d.capW = d.maxW
+			}
+			g.resync[key] = struct{}{}
+		case ok:
+			if _, resync := g.resync[key]; !resync || d.capW <= 0 {
+				d.capW = applied
+			}
+			delete(g.resync, key)
+		default:
+			delete(g.resync, key)
+		}
+	}
+	for key := range g.caps {
+		if _, ok := live[key]; !ok {
+			delete(g.caps, key)
+			delete(g.resync, key)
+		}
+	}
+	overBudget := allocatePower(devices, g.cfg.BudgetWatts)
+
+	// Lower caps before raising others so that the group never runs above
+	// its budget in between; if a cap could not be lowered, the power it
+	// was meant to free is not handed out.
+	var lower, raise []*powerDevice
+	for _, d := range devices {
+		if !d.controlled {
+			continue
+		}
+		d.targetW = math.Round(d.targetW)
+		if d.capW > 0 && math.Abs(d.targetW-d.capW) < c.minChange {
+			d.targetW = d.capW
+			continue
+		}
+		if d.capW > 0 && d.targetW > d.capW {
+			raise = append(raise, d)
+		} else {
+			lower = append(lower, d)
+		}
+	}
+	if failed := c.applyCaps(ctx, g, lower); failed > 0 {
+		for _, d := range raise {
+			d.err = "skipped: lowering other caps failed"
+		}
+		c.log.Warn().Str("group", g.cfg.Name).Int("failed", failed).Msg("power caps not lowered; holding back increases")
+	} else {
+		c.applyCaps(ctx, g, raise)
+	}
+
+	status := &pb.PowerGroup{
+		Name:              g.cfg.Name,
+		BudgetWatts:       g.cfg.BudgetWatts,
+		OverBudget:        overBudget,
+		UpdatedAtUnixNano: time.Now().UnixNano(),
+	}
+	for _, d := range devices {
+		status.AllocatedWatts += d.targetW
+		status.UsageWatts += d.usageW
+		if !d.controlled {
+			status.ReservedWatts += d.capW
+		}
+		status.Devices = append(status.Devices, d.toPB())
+	}
+	if overBudget {
+		c.log.Warn().Str("group", g.cfg.Name).Float64("budget_watts", g.cfg.BudgetWatts).Float64("allocated_watts", status.AllocatedWatts).Msg("power budget below minimum caps")
+	}
+	g.mu.Lock()
+	g.status = status
+	g.mu.Unlock()
+}
+
+// applyCaps sends the cap commands of devices and returns how many failed.
+// Nodes are handled in parallel but the commands of one node go one after
+// the other, since an agent drops a queued command once a newer one of the
+// same type arrives. Caps are adjusted every interval, so only those that
+// fail to apply are audited.
+func (c *powerController) applyCaps(ctx context.Context, g *powerGroup, devices []*powerDevice) int {
+	ctx = withCommandOrigin(ctx, commandOrigin{source: "power", user: "power/" + g.cfg.Name, auditFailuresOnly: true})
+	byNode := make(map[string][]*powerDevice)
+	for _, d := range devices {
+		byNode[d.nodeID] = append(byNode[d.nodeID], d)
+	}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+	for nodeID, nodeDevices := range byNode {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, d := range nodeDevices {
+				err := c.dispatch(ctx, nodeID, powerCapCommand(d))
+				mu.Lock()
+				if err != nil {
+					d.err = err.Error()
+					failed++
+					c.log.Warn().Err(err).Str("group", g.cfg.Name).Str("node_id", nodeID).Str("kind", d.kind).Int32("index", d.index).Msg("set power cap")
+				} else {
+					g.caps[d.key()] = d.targetW
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return failed
+}
+
+func powerCapCommand(d *powerDevice) *api.Command {
+	switch d.kind {
+	case powerKindCPU:
+		return &api.Command{
+			Type:    "cpu_power_cap",
+			Payload: &cpupb.PowerCapCommand{PackageId: d.index, Microwatt: uint64(d.targetW * 1e6)},
+		}
+	default:
+		return &api.Command{
+			Type:    api.CommandType(d.kind + "_power_cap"),
+			Payload: &gpupb.PowerCapCommand{GpuIndex: d.index, Milliwatt: uint32(d.targetW * 1e3)},
+		}
+	}
+}
+
+// powerDevices lists the power-cappable devices a node registered, with
+// their latest draw and cap. A device is controlled only while its node is
+// connected, fresh and not cordoned and its draw is known.
+func powerDevices(snapshot api.NodeSnapshot) []*powerDevice {
+	if snapshot.Registration == nil {
+		return nil
+	}
+	var devices []*powerDevice
+	if reg, ok := snapshot.Registration.Modules[powerKindCPU].(*cpupb.ModuleRegistration); ok {
+		usage := map[int32]float64{}
+		if derived, ok := snapshot.Latest[string(categoryCPUPower)].Payload.(*pb.DerivedMetrics); ok {
+			for _, p := range derived.GetRapl() {
+				usage[p.GetPackageId()] = p.GetPackageWatts()
+			}
+		}
+		caps := map[int32]float64{}
+		if ultra, ok := snapshot.Latest["cpu_ultra_fast"].Payload.(*cpupb.UltraMetrics); ok {
+			for _, rapl := range ultra.GetRapl() {
+				caps[rapl.GetPackageId()] = float64(rapl.GetPowerCapMicroW()) / 1e6
+			}
+		}
+		for _, pc := range reg.GetPackageControls() {
+			if pc.GetPowerCapMaxMicroW() == 0 {
+				continue
+			}
+			d := &powerDevice{
+				nodeID: snapshot.NodeID,
+				kind:   powerKindCPU,
+				index:  pc.GetPackageId(),
+				minW:   float64(pc.GetPowerCapMinMicroW()) / 1e6,
+				maxW:   float64(pc.GetPowerCapMaxMicroW()) / 1e6,
+				capW:   float64(pc.GetPowerCapMicroW()) / 1e6,
+			}
+			if v, ok := caps[d.index]; ok && v > 0 {
+				d.capW = v
+			}
+			w, measured := usage[d.index]
+			d.usageW = w
+			d.controlled, d.reason = powerControllable(snapshot, measured)
+			devices = append(devices, d)
+		}
+	}
+	for _, kind := range []string{powerKindGPU, powerKindAMDGPU} {
+		reg, ok := snapshot.Registration.Modules[kind].(*gpupb.ModuleRegistration)
+		if !ok {
+			continue
+		}
+		latest := map[int32]*gpupb.DeviceFastMetrics{}
+		if fast, ok := snapshot.Latest[kind+"_fast"].Payload.(*gpupb.FastMetrics); ok {
+			for _, dev := range fast.GetDevices() {
+				latest[dev.GetIndex()] = dev
+			}
+		}
+		for _, static := range reg.GetStatic() {
+			if static.GetPowerMaxMilliwatt() == 0 {
+				continue
+			}
+			d := &powerDevice{
+				nodeID: snapshot.NodeID,
+				kind:   kind,
+				index:  static.GetIndex(),
+				minW:   float64(static.GetPowerMinMilliwatt()) / 1e3,
+				maxW:   float64(static.GetPowerMaxMilliwatt()) / 1e3,
+			}
+			dev, measured := latest[d.index]
+			if measured {
+				d.usageW = float64(dev.GetPowerUsageMilliwatt()) / 1e3
+				d.capW = float64(dev.GetPowerLimitMilliwatt()) / 1e3
+			}
+			d.controlled, d.reason = powerControllable(snapshot, measured)
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+func powerControllable(snapshot api.NodeSnapshot, measured bool) (bool, string) {
+	switch {
+	case !snapshot.Connected:
+		return false, "offline"
+	case snapshot.Stale:
+		return false, "stale"
+	case snapshot.Cordoned:
+		return false, "cordoned"
+	case !measured:
+		return false, "no power reading"
+	}
+	return true, ""
+}
+
+// Groups returns the latest allocation of every group, in configuration
+// order.
+func (c *powerController) Groups() []*pb.PowerGroup {
+	out := make([]*pb.PowerGroup, 0, len(c.groups))
+	for _, g := range c.groups {
+		g.mu.RLock()
+		out = append(out, g.status)
+		g.mu.RUnlock()
+	}
+	return out
+}
+
+func (c *powerController) Group(name string) (*pb.PowerGroup, error) {
+	for _, g := range c.groups {
+		if g.cfg.Name == name {
+			g.mu.RLock()
+			defer g.mu.RUnlock()
+			return g.status, nil
+		}
+	}
+	return nil, errPowerGroupNotFound
+}
+
+// dispatchPowerCap is the controller's way of sending a cap command.
+func (s *Server) dispatchPowerCap(ctx context.Context, nodeID string, cmd *api.Command) error {
+	if s.cfg.CommandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.CommandTimeout)
+		defer cancel()
+	}
+	_, err := s.dispatchCommand(ctx, nodeID, cmd)
+	return err
+}
+
+func (s *Server) handleListPower(w http.ResponseWriter, _ *http.Request) {
+	writeProto(w, http.StatusOK, &pb.PowerGroupsResponse{Groups: s.power.Groups()})
+}
+
+func (s *Server) handleGetPower(w http.ResponseWriter, r *http.Request) {
+	group, err := s.power.Group(chi.URLParam(r, "group"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeProto(w, http.StatusOK, group)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bufio"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const promContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+func (s *Server) handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	reg := newMetricSet()
+	for _, node := range s.store.ListNodeSnapshots() {
+		collectNodeMetrics(reg, node)
+	}
+	w.Header().Set("Content-Type", promContentType)
+	w.WriteHeader(http.StatusOK)
+	if err := writePromText(bufio.NewWriterSize(w, 32<<10), reg); err != nil {
+		s.log.Debug().Err(err).Msg("write metrics response failed")
+	}
+}
+
+// writePromText renders a metric set in the Prometheus text exposition
+// format. Timestamps are left to the scraper.
+func writePromText(w *bufio.Writer, reg *metricSet) error {
+	for _, f := range reg.sorted() {
+		w.WriteString("# HELP ")
+		w.WriteString(f.name)
+		w.WriteByte(' ')
+		w.WriteString(escapePromHelp(f.help))
+		w.WriteString("\n# TYPE ")
+		w.WriteString(f.name)
+		w.WriteByte(' ')
+		w.WriteString(f.kind)
+		w.WriteByte('\n')
+		for _, v := range f.values {
+			w.WriteString(f.name)
+			if len(v.labels) > 0 {
+				w.WriteByte('{')
+				for i, l := range v.labels {
+					if i > 0 {
+						w.WriteByte(',')
+					}
+					w.WriteString(l.Name)
+					w.WriteString(`="`)
+					w.WriteString(escapePromLabel(l.Value))
+					w.WriteByte('"')
+				}
+				w.WriteByte('}')
+			}
+			w.WriteByte(' ')
+			w.WriteString(formatPromValue(v.value))
+			w.WriteByte('\n')
+		}
+	}
+	return w.Flush()
+}
+
+var (
+	promHelpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	promLabelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapePromHelp(s string) string {
+	return promHelpEscaper.Replace(s)
+}
+
+func escapePromLabel(s string) string {
+	return promLabelEscaper.Replace(s)
+}
+
+func formatPromValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
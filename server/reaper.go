@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	errSessionStale    = status.Error(codes.Unavailable, "no heartbeat or metrics received within the stale timeout")
+	errSessionReplaced = status.Error(codes.Aborted, "node registered a newer session")
+	errSessionRevoked  = status.Error(codes.Unauthenticated, "client certificate revoked")
+)
+
+// reapLoop detects nodes whose stream is open but silent, e.g. a half-open
+// TCP connection, and forgets nodes that stayed away past the eviction TTL.
+func (s *Server) reapLoop(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.Reaper.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.reapNodes(now)
+		}
+	}
+}
+
+func (s *Server) reapNodes(now time.Time) {
+	staleAfter := s.cfg.Reaper.HeartbeatInterval * time.Duration(s.cfg.Reaper.StaleAfter)
+	for _, nodeID := range s.store.MarkStaleNodes(now.Add(-staleAfter).UnixNano()) {
+		s.log.Warn().Str("node_id", nodeID).Dur("stale_after", staleAfter).Msg("node stale, closing session")
+		if session, ok := s.getSession(nodeID); ok {
+			session.close(errSessionStale)
+		}
+		s.failPendingByNode(nodeID)
+		s.publishNodeStatus(nodeID)
+	}
+
+	if s.cfg.Reaper.EvictAfter < 0 {
+		return
+	}
+	for _, nodeID := range s.store.EvictNodes(now.Add(-s.cfg.Reaper.EvictAfter).UnixNano()) {
+		s.log.Info().Str("node_id", nodeID).Dur("evict_after", s.cfg.Reaper.EvictAfter).Msg("node evicted")
+		s.derive.Forget(nodeID)
+		s.alerts.Forget(nodeID)
+		s.wsHub.PublishNodeRemoved(nodeID)
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"crypto/tls"
+	"math"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/eWloYW8/Telemetry/config"
+)
+
+// Field numbers of prometheus.WriteRequest and the messages it embeds
+// (prometheus/prompb/remote.proto and types.proto).
+const (
+	promWriteTimeseries = 1
+	promWriteMetadata   = 3
+
+	promSeriesLabels  = 1
+	promSeriesSamples = 2
+
+	promLabelName  = 1
+	promLabelValue = 2
+
+	promSampleValue     = 1
+	promSampleTimestamp = 2
+
+	promMetadataType   = 1
+	promMetadataFamily = 2
+	promMetadataHelp   = 4
+
+	promMetadataCounter = 1
+	promMetadataGauge   = 2
+)
+
+// remoteWriteWriter sends Prometheus remote-write 1.0 requests: a
+// snappy-compressed WriteRequest with one time series per metric and label
+// set, samples in timestamp order.
+type remoteWriteWriter struct {
+	*httpSinkSender
+}
+
+func newRemoteWriteWriter(cfg config.SinkConfig, tlsCfg *tls.Config) *remoteWriteWriter {
+	sender := newHTTPSinkSender(cfg.URL, cfg.Headers, cfg.Timeout, tlsCfg)
+	sender.contentType = "application/x-protobuf"
+	sender.contentEncoding = "snappy"
+	headers := make(map[string]string, len(cfg.Headers)+1)
+	headers["X-Prometheus-Remote-Write-Version"] = "0.1.0"
+	for k, v := range cfg.Headers {
+		headers[k] = v
+	}
+	sender.headers = headers
+	return &remoteWriteWriter{httpSinkSender: sender}
+}
+
+type promSeries struct {
+	labels  []metricLabel
+	samples []metricValue
+}
+
+func (w *remoteWriteWriter) Encode(batch []nodeMetrics) ([]byte, error) {
+	series := make(map[string]*promSeries)
+	families := make(map[string]*metricFamily)
+	for _, nm := range batch {
+		for _, f := range nm.metrics.sorted() {
+			if _, ok := families[f.name]; !ok {
+				families[f.name] = f
+			}
+			for _, v := range f.values {
+				labels := make([]metricLabel, 0, len(v.labels)+1)
+				labels = append(labels, metricLabel{Name: "__name__", Value: f.name})
+				for _, l := range v.labels {
+					if l.Value != "" {
+						labels = append(labels, l)
+					}
+				}
+				sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+				key := labelsKey(labels)
+				s, ok := series[key]
+				if !ok {
+					s = &promSeries{labels: labels}
+					series[key] = s
+				}
+				s.samples = append(s.samples, v)
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buf := make([]byte, 0, 64<<10)
+	for _, key := range keys {
+		s := series[key]
+		sort.SliceStable(s.samples, func(i, j int) bool { return s.samples[i].at < s.samples[j].at })
+		buf = appendWireMessage(buf, promWriteTimeseries, func(b []byte) []byte {
+			for _, l := range s.labels {
+				b = appendWireMessage(b, promSeriesLabels, func(b []byte) []byte {
+					b = protowire.AppendTag(b, promLabelName, protowire.BytesType)
+					b = protowire.AppendString(b, l.Name)
+					b = protowire.AppendTag(b, promLabelValue, protowire.BytesType)
+					return protowire.AppendString(b, l.Value)
+				})
+			}
+			for _, v := range s.samples {
+				b = appendWireMessage(b, promSeriesSamples, func(b []byte) []byte {
+					b = protowire.AppendTag(b, promSampleValue, protowire.Fixed64Type)
+					b = protowire.AppendFixed64(b, math.Float64bits(v.value))
+					b = protowire.AppendTag(b, promSampleTimestamp, protowire.VarintType)
+					return protowire.AppendVarint(b, uint64(v.at/1e6))
+				})
+			}
+			return b
+		})
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := families[name]
+		kind := uint64(promMetadataGauge)
+		if f.kind == metricCounter {
+			kind = promMetadataCounter
+		}
+		buf = appendWireMessage(buf, promWriteMetadata, func(b []byte) []byte {
+			b = protowire.AppendTag(b, promMetadataType, protowire.VarintType)
+			b = protowire.AppendVarint(b, kind)
+			b = protowire.AppendTag(b, promMetadataFamily, protowire.BytesType)
+			b = protowire.AppendString(b, f.name)
+			b = protowire.AppendTag(b, promMetadataHelp, protowire.BytesType)
+			return protowire.AppendString(b, f.help)
+		})
+	}
+	return snappyEncode(buf), nil
+}
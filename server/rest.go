@@ -3,10 +3,13 @@ package server
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,6 +28,9 @@ const maxProtoPayloadBytes = 1 << 20
 func (s *Server) newRouter() http.Handler {
 	r := chi.NewRouter()
 	r.Use(s.httpLogMiddleware)
+	if s.cfg.HTTPTLS.CertFile != "" && s.cfg.HTTPTLS.HSTSMaxAge > 0 {
+		r.Use(s.hstsMiddleware)
+	}
 	uiStatic := s.newUIStaticHandler()
 
 	r.Get("/api/healthz", func(w http.ResponseWriter, _ *http.Request) {
@@ -34,14 +40,55 @@ func (s *Server) newRouter() http.Handler {
 		http.Redirect(w, r, "/api/healthz", http.StatusTemporaryRedirect)
 	})
 
+	// Agents enrolling have no API token; the bootstrap token in the request
+	// authenticates them.
+	r.Post("/api/enroll", s.handleEnroll)
+
+	r.With(s.authenticate).Get("/metrics", s.handleMetrics)
+
+	// Every token may read; commands need an operator, and node management
+	// and enrollment tokens an admin.
 	r.Route("/api", func(r chi.Router) {
+		r.Use(s.authenticate)
+
 		r.Get("/nodes", s.handleListNodes)
 		r.Get("/nodes/{nodeID}", s.handleGetNode)
 		r.Get("/nodes/{nodeID}/modules", s.handleGetNodeModules)
+		r.Get("/nodes/{nodeID}/samples", s.handleGetNodeSamples)
+		r.Get("/nodes/{nodeID}/rollups", s.handleGetNodeRollups)
+		r.Get("/export", s.handleExport)
+		r.Get("/alerts", s.handleListAlerts)
 		r.Get("/ws/metrics", s.handleWSMetrics)
-
-		r.Post("/nodes/{nodeID}/commands", s.handleDispatchCommand)
-		r.Post("/nodes/{nodeID}/commands/{commandType}", s.handleDispatchCommandByType)
+		r.Get("/commands", s.handleListCommands)
+		r.Get("/commands/{commandID}", s.handleGetCommand)
+		r.Get("/audit", s.handleListAudit)
+		r.Get("/schedules", s.handleListSchedules)
+		r.Get("/schedules/{scheduleID}", s.handleGetSchedule)
+		r.Get("/schedules/{scheduleID}/runs", s.handleListScheduleRuns)
+		r.Get("/power", s.handleListPower)
+		r.Get("/power/{group}", s.handleGetPower)
+
+		r.Group(func(r chi.Router) {
+			r.Use(s.requireRole(roleOperator))
+			r.Post("/nodes/{nodeID}/commands", s.handleDispatchCommand)
+			r.Post("/nodes/{nodeID}/commands/{commandType}", s.handleDispatchCommandByType)
+			r.Post("/commands", s.handleFanoutCommand)
+			r.Post("/schedules", s.handleCreateSchedule)
+			r.Put("/schedules/{scheduleID}", s.handleUpdateSchedule)
+			r.Delete("/schedules/{scheduleID}", s.handleDeleteSchedule)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(s.requireRole(roleAdmin))
+			r.Delete("/nodes/{nodeID}", s.handleDeleteNode)
+			r.Post("/nodes/{nodeID}/cordon", s.handleCordonNode)
+			r.Delete("/nodes/{nodeID}/cordon", s.handleUncordonNode)
+			r.Put("/nodes/{nodeID}/annotations", s.handleSetNodeAnnotations)
+			r.Put("/nodes/{nodeID}/labels", s.handleSetNodeLabels)
+			r.Get("/enrollment/tokens", s.handleListEnrollmentTokens)
+			r.Post("/enrollment/tokens", s.handleCreateEnrollmentToken)
+			r.Delete("/enrollment/tokens/{tokenID}", s.handleRevokeEnrollmentToken)
+		})
 	})
 
 	r.Handle("/*", uiStatic)
@@ -72,6 +119,11 @@ func (r *httpStatusRecorder) Flush() {
 	}
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *httpStatusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 func (r *httpStatusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	hijacker, ok := r.ResponseWriter.(http.Hijacker)
 	if !ok {
@@ -117,12 +169,20 @@ func (s *Server) httpLogMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func (s *Server) handleListNodes(w http.ResponseWriter, _ *http.Request) {
+func (s *Server) handleListNodes(w http.ResponseWriter, r *http.Request) {
+	selector, err := parseLabelSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 	snapshots := s.store.ListNodeSnapshots()
 	out := &pb.ListNodesResponse{
 		Nodes: make([]*pb.NodeSnapshot, 0, len(snapshots)),
 	}
 	for _, snapshot := range snapshots {
+		if !selector.Matches(snapshot.Labels) {
+			continue
+		}
 		out.Nodes = append(out.Nodes, toPBNodeSnapshot(snapshot))
 	}
 	writeProto(w, http.StatusOK, out)
@@ -138,6 +198,100 @@ func (s *Server) handleGetNode(w http.ResponseWriter, r *http.Request) {
 	writeProto(w, http.StatusOK, toPBNodeSnapshot(snapshot))
 }
 
+// handleDeleteNode removes a disconnected node, its metadata and its latest
+// samples. Its history ages out with retention.
+func (s *Server) handleDeleteNode(w http.ResponseWriter, r *http.Request) {
+	nodeID := chi.URLParam(r, "nodeID")
+	if err := s.store.DeleteNode(nodeID); err != nil {
+		switch {
+		case errors.Is(err, errNodeNotFound):
+			writeError(w, http.StatusNotFound, err)
+		case errors.Is(err, errNodeConnected):
+			writeError(w, http.StatusConflict, err)
+		default:
+			writeError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	s.derive.Forget(nodeID)
+	s.alerts.Forget(nodeID)
+	// A node that registers later under the same id is a new node and must
+	// not receive commands issued to this one.
+	for _, held := range s.offline.DropNode(nodeID) {
+		s.commands.Fail(held.cmd.ID, commandStateFailed, errHeldNodeDeleted)
+	}
+	s.wsHub.PublishNodeRemoved(nodeID)
+	s.log.Info().Str("node_id", nodeID).Msg("node deleted")
+	writeProto(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) handleCordonNode(w http.ResponseWriter, r *http.Request) {
+	var req pb.NodeCordonRequest
+	if err := decodeOptionalProto(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.updateNodeMeta(w, chi.URLParam(r, "nodeID"), func(nodeID string) error {
+		return s.store.SetNodeCordon(nodeID, true, req.GetReason())
+	})
+}
+
+func (s *Server) handleUncordonNode(w http.ResponseWriter, r *http.Request) {
+	s.updateNodeMeta(w, chi.URLParam(r, "nodeID"), func(nodeID string) error {
+		return s.store.SetNodeCordon(nodeID, false, "")
+	})
+}
+
+func (s *Server) handleSetNodeAnnotations(w http.ResponseWriter, r *http.Request) {
+	// An empty body is a valid encoding of an empty map and clears them.
+	var req pb.NodeAnnotations
+	if err := decodeOptionalProto(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.updateNodeMeta(w, chi.URLParam(r, "nodeID"), func(nodeID string) error {
+		return s.store.SetNodeAnnotations(nodeID, req.GetAnnotations())
+	})
+}
+
+func (s *Server) handleSetNodeLabels(w http.ResponseWriter, r *http.Request) {
+	var req pb.NodeLabels
+	if err := decodeOptionalProto(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	for key := range req.GetLabels() {
+		if err := validateLabelKey(key); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	s.updateNodeMeta(w, chi.URLParam(r, "nodeID"), func(nodeID string) error {
+		return s.store.SetNodeLabels(nodeID, req.GetLabels())
+	})
+}
+
+// updateNodeMeta applies a metadata change to a known node, publishes the new
+// status and responds with it.
+func (s *Server) updateNodeMeta(w http.ResponseWriter, nodeID string, update func(nodeID string) error) {
+	if _, err := s.store.GetNodeSnapshot(nodeID); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err := update(nodeID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.publishNodeStatus(nodeID)
+	snapshot, err := s.store.GetNodeSnapshot(nodeID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	snapshot.Latest = nil
+	writeProto(w, http.StatusOK, toPBNodeSnapshot(snapshot))
+}
+
 func (s *Server) handleGetNodeModules(w http.ResponseWriter, r *http.Request) {
 	nodeID := chi.URLParam(r, "nodeID")
 	snapshot, err := s.store.GetNodeSnapshot(nodeID)
@@ -152,6 +306,139 @@ func (s *Server) handleGetNodeModules(w http.ResponseWriter, r *http.Request) {
 	writeProto(w, http.StatusOK, &pb.NodeModulesResponse{Modules: modules})
 }
 
+func (s *Server) handleGetNodeSamples(w http.ResponseWriter, r *http.Request) {
+	nodeID := chi.URLParam(r, "nodeID")
+	query := r.URL.Query()
+	from, err := parseTimeQuery(query.Get("from"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid from: %w", err))
+		return
+	}
+	to, err := parseTimeQuery(query.Get("to"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid to: %w", err))
+		return
+	}
+	if from > 0 && to > 0 && from > to {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("from must not be after to"))
+		return
+	}
+
+	samples, err := s.store.QuerySamples(nodeID, api.MetricCategory(strings.TrimSpace(query.Get("category"))), from, to)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	out := &pb.SamplesResponse{
+		Samples: make([]*pb.TimedSample, 0, len(samples)),
+	}
+	for _, sample := range samples {
+		out.Samples = append(out.Samples, toPBTimedSample(sample))
+	}
+	writeProto(w, http.StatusOK, out)
+}
+
+func (s *Server) handleGetNodeRollups(w http.ResponseWriter, r *http.Request) {
+	nodeID := chi.URLParam(r, "nodeID")
+	query := r.URL.Query()
+	from, err := parseTimeQuery(query.Get("from"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid from: %w", err))
+		return
+	}
+	to, err := parseTimeQuery(query.Get("to"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid to: %w", err))
+		return
+	}
+	var resolution time.Duration
+	if raw := strings.TrimSpace(query.Get("resolution")); raw != "" {
+		resolution, err = time.ParseDuration(raw)
+		if err != nil || resolution < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid resolution %q", raw))
+			return
+		}
+	}
+
+	out, err := s.store.QueryRollups(
+		nodeID,
+		api.MetricCategory(strings.TrimSpace(query.Get("category"))),
+		strings.TrimSpace(query.Get("metric")),
+		from,
+		to,
+		resolution,
+	)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeProto(w, http.StatusOK, out)
+}
+
+// handleListAlerts lists pending and firing alerts by default; state takes a
+// comma-separated subset of pending, firing and resolved, or "all".
+func (s *Server) handleListAlerts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	states := csvToSet(strings.ToLower(query.Get("state")))
+	if states == nil {
+		states = map[string]struct{}{alertStatePending: {}, alertStateFiring: {}}
+	}
+	if _, all := states["all"]; all {
+		states = nil
+	}
+	for state := range states {
+		switch state {
+		case alertStatePending, alertStateFiring, alertStateResolved:
+		default:
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown alert state %q", state))
+			return
+		}
+	}
+	writeProto(w, http.StatusOK, &pb.AlertsResponse{
+		Alerts: s.alerts.Alerts(states, strings.TrimSpace(query.Get("node"))),
+	})
+}
+
+// parseBoolQuery parses a boolean query parameter; an empty value is false.
+func parseBoolQuery(raw string) (bool, error) {
+	if raw == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(raw)
+}
+
+// parseDeliverBy accepts a time to live such as 30m, counted from now, or
+// an absolute time as parseTimeQuery does.
+func parseDeliverBy(raw string, now time.Time) (int64, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	if ttl, err := time.ParseDuration(raw); err == nil {
+		if ttl <= 0 {
+			return 0, fmt.Errorf("time to live must be positive")
+		}
+		return now.Add(ttl).UnixNano(), nil
+	}
+	return parseTimeQuery(raw)
+}
+
+// parseTimeQuery accepts unix nanoseconds or RFC 3339 timestamps; an empty
+// value yields 0 (unbounded).
+func parseTimeQuery(raw string) (int64, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, nil
+	}
+	if v, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return v, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, raw)
+	if err != nil {
+		return 0, fmt.Errorf("expected unix nanoseconds or RFC 3339 time, got %q", raw)
+	}
+	return t.UnixNano(), nil
+}
+
 func (s *Server) handleDispatchCommand(w http.ResponseWriter, r *http.Request) {
 	nodeID := chi.URLParam(r, "nodeID")
 
@@ -235,6 +522,18 @@ func parseCommandPayloadPB(commandType api.CommandType, raw []byte) (any, error)
 			return nil, fmt.Errorf("decode gpu_power_cap payload: %w", err)
 		}
 		return &payload, nil
+	case "amdgpu_clock_range":
+		var payload gpupb.ClockRangeCommand
+		if err := proto.Unmarshal(raw, &payload); err != nil {
+			return nil, fmt.Errorf("decode amdgpu_clock_range payload: %w", err)
+		}
+		return &payload, nil
+	case "amdgpu_power_cap":
+		var payload gpupb.PowerCapCommand
+		if err := proto.Unmarshal(raw, &payload); err != nil {
+			return nil, fmt.Errorf("decode amdgpu_power_cap payload: %w", err)
+		}
+		return &payload, nil
 	case "process_signal":
 		var payload processpb.SignalCommand
 		if err := proto.Unmarshal(raw, &payload); err != nil {
@@ -246,21 +545,158 @@ func parseCommandPayloadPB(commandType api.CommandType, raw []byte) (any, error)
 	}
 }
 
+// executeCommand queues a command and answers 202 with its status right
+// away; the command runs in the background and is polled at
+// /api/commands/{id}. With wait=true the request blocks until the result
+// instead. Every command is tracked before it is validated against the
+// node's registration, so one rejected as invalid or for a cordoned or
+// offline node is still recorded, as failed. dry_run=true only validates and
+// answers 204 for a valid command, without tracking it. A command id that is
+// still in flight is not sent again: the answer is 202 with that command's
+// status.
 func (s *Server) executeCommand(w http.ResponseWriter, r *http.Request, nodeID string, cmd *api.Command) {
-	ctx := context.WithoutCancel(r.Context())
-	var cancel context.CancelFunc
-	if s.cfg.CommandTimeout > 0 {
-		ctx, cancel = context.WithTimeout(ctx, s.cfg.CommandTimeout)
-		defer cancel()
+	query := r.URL.Query()
+	wait, err := parseBoolQuery(query.Get("wait"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid wait: %w", err))
+		return
 	}
-	res, err := s.dispatchCommand(ctx, nodeID, cmd)
+	dryRun, err := parseBoolQuery(query.Get("dry_run"))
 	if err != nil {
-		writeError(w, http.StatusBadGateway, err)
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid dry_run: %w", err))
+		return
+	}
+	deliverBy, err := parseDeliverBy(query.Get("deliver_by"), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid deliver_by: %w", err))
+		return
+	}
+	if deliverBy > 0 {
+		cmd.DeliverBy = deliverBy
+	}
+	if dryRun {
+		reg := s.store.NodeRegistration(nodeID)
+		if reg == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("node %s not found", nodeID))
+			return
+		}
+		if err := validateCommand(reg, cmd); err != nil {
+			writeCommandError(w, err)
+			return
+		}
+		writeProto(w, http.StatusNoContent, nil)
+		return
+	}
+
+	// Track the command before checking it, so that rejected commands are
+	// audited like any other.
+	ctx := withCommandOrigin(context.WithoutCancel(r.Context()), httpCommandOrigin(r))
+	status, started := s.prepareCommand(ctx, nodeID, cmd)
+	if !started {
+		// The id is still in flight: report the first command's status
+		// rather than sending it again.
+		w.Header().Set("Location", "/api/commands/"+cmd.ID)
+		writeProto(w, http.StatusAccepted, status)
+		return
+	}
+	sess, err := s.admitCommand(ctx, nodeID, cmd)
+	if errors.Is(err, errCommandHeld) {
+		// Holding the command for the offline node does not wait, so wait
+		// makes no difference here.
+		status, _ = s.commands.Get(cmd.ID)
+		w.Header().Set("Location", "/api/commands/"+cmd.ID)
+		writeProto(w, http.StatusAccepted, status)
+		return
+	}
+	if err != nil {
+		writeCommandError(w, err)
+		return
+	}
+	if !wait {
+		go func() {
+			ctx, cancel := context.WithTimeout(ctx, s.cfg.CommandTimeout)
+			defer cancel()
+			_, _ = s.sendCommand(ctx, sess, cmd)
+		}()
+		w.Header().Set("Location", "/api/commands/"+cmd.ID)
+		writeProto(w, http.StatusAccepted, status)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.CommandTimeout)
+	defer cancel()
+	res, err := s.sendCommand(ctx, sess, cmd)
+	if err != nil {
+		writeCommandError(w, err)
 		return
 	}
 	writeProto(w, http.StatusOK, api.ToPBCommandResult(res))
 }
 
+func writeCommandError(w http.ResponseWriter, err error) {
+	var invalid *commandValidationError
+	if errors.As(err, &invalid) {
+		writeProto(w, http.StatusUnprocessableEntity, &pb.ErrorResponse{
+			Error:        err.Error(),
+			TimeUnixNano: time.Now().UnixNano(),
+			Violations:   invalid.violations,
+		})
+		return
+	}
+	switch {
+	case errors.Is(err, errNodeCordoned), errors.Is(err, errCommandInFlight):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, errDeliverByPassed), errors.Is(err, errDeliverByTooFar):
+		writeError(w, http.StatusBadRequest, err)
+	case errors.Is(err, errOfflineQueueFull):
+		writeError(w, http.StatusServiceUnavailable, err)
+	default:
+		writeError(w, http.StatusBadGateway, err)
+	}
+}
+
+func (s *Server) handleGetCommand(w http.ResponseWriter, r *http.Request) {
+	commandID := chi.URLParam(r, "commandID")
+	status, ok := s.commands.Get(commandID)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("command %s not found", commandID))
+		return
+	}
+	writeProto(w, http.StatusOK, status)
+}
+
+// handleListCommands lists recent commands, newest first, optionally filtered
+// by node, type and a comma-separated list of states.
+func (s *Server) handleListCommands(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	states := csvToSet(strings.ToLower(query.Get("state")))
+	for state := range states {
+		switch state {
+		case commandStateQueued, commandStateHeld, commandStateSent, commandStateSucceeded, commandStateFailed, commandStateSuperseded, commandStateTimedOut:
+		default:
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown command state %q", state))
+			return
+		}
+	}
+	limit := 0
+	if raw := query.Get("limit"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", raw))
+			return
+		}
+		limit = v
+	}
+	writeProto(w, http.StatusOK, &pb.CommandsResponse{
+		Commands: s.commands.List(
+			strings.TrimSpace(query.Get("node")),
+			api.CommandType(strings.TrimSpace(query.Get("type"))),
+			states,
+			limit,
+		),
+	})
+}
+
 func decodeProto(r *http.Request, dst proto.Message) error {
 	if dst == nil {
 		return fmt.Errorf("nil protobuf target")
@@ -278,6 +714,18 @@ func decodeProto(r *http.Request, dst proto.Message) error {
 	return nil
 }
 
+// decodeOptionalProto decodes a request body that may be empty.
+func decodeOptionalProto(r *http.Request, dst proto.Message) error {
+	raw, err := readRawProto(r)
+	if err != nil {
+		return err
+	}
+	if err := proto.Unmarshal(raw, dst); err != nil {
+		return fmt.Errorf("decode protobuf payload: %w", err)
+	}
+	return nil
+}
+
 func readRawProto(r *http.Request) ([]byte, error) {
 	defer r.Body.Close()
 	payload, err := io.ReadAll(io.LimitReader(r.Body, maxProtoPayloadBytes))
@@ -310,11 +758,45 @@ func writeError(w http.ResponseWriter, code int, err error) {
 }
 
 func toPBNodeSnapshot(snapshot api.NodeSnapshot) *pb.NodeSnapshot {
-	return &pb.NodeSnapshot{
-		NodeId:           snapshot.NodeID,
-		Connected:        snapshot.Connected,
-		LastSeenUnixNano: snapshot.LastSeen,
-		SourceIp:         snapshot.SourceIP,
-		Registration:     api.ToPBRegistration(snapshot.Registration),
+	out := &pb.NodeSnapshot{
+		NodeId:             snapshot.NodeID,
+		Connected:          snapshot.Connected,
+		Stale:              snapshot.Stale,
+		Cordoned:           snapshot.Cordoned,
+		CordonReason:       snapshot.CordonReason,
+		CordonedAtUnixNano: snapshot.CordonedAt,
+		Annotations:        snapshot.Annotations,
+		Labels:             snapshot.Labels,
+		LastSeenUnixNano:   snapshot.LastSeen,
+		SourceIp:           snapshot.SourceIP,
+		Registration:       api.ToPBRegistration(snapshot.Registration),
+	}
+	if len(snapshot.Latest) > 0 {
+		categories := make([]string, 0, len(snapshot.Latest))
+		for category := range snapshot.Latest {
+			categories = append(categories, category)
+		}
+		sort.Strings(categories)
+		out.Latest = make([]*pb.MetricSample, 0, len(categories))
+		for _, category := range categories {
+			sample := snapshot.Latest[category]
+			out.Latest = append(out.Latest, api.ToPBMetricSample(api.MetricSample{
+				Category: sample.Category,
+				At:       sample.At,
+				Payload:  sample.Payload,
+			}))
+		}
+	}
+	return out
+}
+
+func toPBTimedSample(sample api.TimedSample) *pb.TimedSample {
+	return &pb.TimedSample{
+		NodeId: sample.NodeID,
+		Sample: api.ToPBMetricSample(api.MetricSample{
+			Category: sample.Category,
+			At:       sample.At,
+			Payload:  sample.Payload,
+		}),
 	}
 }
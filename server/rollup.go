@@ -0,0 +1,375 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/eWloYW8/Telemetry/api"
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+	"github.com/eWloYW8/Telemetry/config"
+)
+
+const rollupSnapshotFile = "rollups.pb"
+
+// rollupSkipCategories are payloads that describe a changing set of entities
+// rather than a time series; rolling them up would only grow cardinality.
+var rollupSkipCategories = map[api.MetricCategory]struct{}{
+	"process": {},
+}
+
+type rollupKey struct {
+	nodeID   string
+	category api.MetricCategory
+	metric   string
+	labels   string
+}
+
+type rollupBucket struct {
+	start  int64
+	min    float64
+	max    float64
+	sum    float64
+	count  uint64
+	last   float64
+	lastAt int64
+}
+
+func (b *rollupBucket) add(v float64, at int64) {
+	if b.count == 0 || v < b.min {
+		b.min = v
+	}
+	if b.count == 0 || v > b.max {
+		b.max = v
+	}
+	b.sum += v
+	b.count++
+	if at >= b.lastAt {
+		b.last = v
+		b.lastAt = at
+	}
+}
+
+type rollupSeries struct {
+	labels  []metricLabel
+	buckets []rollupBucket
+}
+
+// rollupTier aggregates raw samples into fixed-width buckets holding the
+// min/max/avg/last of every numeric payload field.
+type rollupTier struct {
+	resolution int64
+	retention  time.Duration
+
+	mu     sync.RWMutex
+	series map[rollupKey]*rollupSeries
+}
+
+func (t *rollupTier) add(key rollupKey, labels []metricLabel, v float64, at int64) {
+	start := at - at%t.resolution
+	series, ok := t.series[key]
+	if !ok {
+		series = &rollupSeries{labels: labels}
+		t.series[key] = series
+	}
+	n := len(series.buckets)
+	if n > 0 && series.buckets[n-1].start == start {
+		series.buckets[n-1].add(v, at)
+		return
+	}
+	if n == 0 || series.buckets[n-1].start < start {
+		series.buckets = append(series.buckets, rollupBucket{start: start})
+		series.buckets[n].add(v, at)
+		return
+	}
+	// Late sample: find or insert its bucket.
+	i := sort.Search(n, func(i int) bool { return series.buckets[i].start >= start })
+	if i < n && series.buckets[i].start == start {
+		series.buckets[i].add(v, at)
+		return
+	}
+	series.buckets = append(series.buckets, rollupBucket{})
+	copy(series.buckets[i+1:], series.buckets[i:])
+	series.buckets[i] = rollupBucket{start: start}
+	series.buckets[i].add(v, at)
+}
+
+func (t *rollupTier) prune(now time.Time) {
+	if t.retention <= 0 {
+		return
+	}
+	cutoff := now.Add(-t.retention).UnixNano()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, series := range t.series {
+		i := sort.Search(len(series.buckets), func(i int) bool {
+			return series.buckets[i].start+t.resolution > cutoff
+		})
+		if i == len(series.buckets) {
+			delete(t.series, key)
+			continue
+		}
+		if i > 0 {
+			series.buckets = append(series.buckets[:0:0], series.buckets[i:]...)
+		}
+	}
+}
+
+type rollupStore struct {
+	tiers []*rollupTier
+	path  string
+}
+
+// newRollupStore builds the configured tiers ordered from finest to coarsest.
+// When dir is set, tiers are restored from and saved to a snapshot there.
+func newRollupStore(tiers []config.RollupTierConfig, dir string) (*rollupStore, error) {
+	s := &rollupStore{}
+	for _, cfg := range tiers {
+		if cfg.Resolution <= 0 {
+			continue
+		}
+		s.tiers = append(s.tiers, &rollupTier{
+			resolution: int64(cfg.Resolution),
+			retention:  cfg.Retention,
+			series:     make(map[rollupKey]*rollupSeries),
+		})
+	}
+	sort.Slice(s.tiers, func(i, j int) bool { return s.tiers[i].resolution < s.tiers[j].resolution })
+	if dir != "" {
+		s.path = filepath.Join(dir, rollupSnapshotFile)
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *rollupStore) Add(nodeID string, samples []api.MetricSample) {
+	if len(s.tiers) == 0 {
+		return
+	}
+	for _, sample := range samples {
+		if _, skip := rollupSkipCategories[sample.Category]; skip {
+			continue
+		}
+		points := flattenPayload(sample.Payload)
+		if len(points) == 0 {
+			continue
+		}
+		for _, tier := range s.tiers {
+			tier.mu.Lock()
+			for _, p := range points {
+				key := rollupKey{nodeID: nodeID, category: sample.Category, metric: p.Metric, labels: labelsKey(p.Labels)}
+				tier.add(key, p.Labels, p.Value, sample.At)
+			}
+			tier.mu.Unlock()
+		}
+	}
+}
+
+// tierFor picks the coarsest tier whose resolution still satisfies the
+// requested one, falling back to the finest tier.
+func (s *rollupStore) tierFor(resolution time.Duration) *rollupTier {
+	if len(s.tiers) == 0 {
+		return nil
+	}
+	chosen := s.tiers[0]
+	for _, tier := range s.tiers {
+		if tier.resolution <= int64(resolution) {
+			chosen = tier
+		}
+	}
+	return chosen
+}
+
+func (s *rollupStore) Query(nodeID string, category api.MetricCategory, metric string, from, to int64, resolution time.Duration) (*pb.RollupsResponse, error) {
+	tier := s.tierFor(resolution)
+	if tier == nil {
+		return nil, fmt.Errorf("no rollup tiers configured")
+	}
+	out := &pb.RollupsResponse{NodeId: nodeID, ResolutionNanos: tier.resolution}
+
+	tier.mu.RLock()
+	defer tier.mu.RUnlock()
+	for key, series := range tier.series {
+		if key.nodeID != nodeID ||
+			(category != "" && key.category != category) ||
+			(metric != "" && key.metric != metric && !strings.HasPrefix(key.metric, metric+".")) {
+			continue
+		}
+		buckets := make([]*pb.RollupBucket, 0, len(series.buckets))
+		for _, b := range series.buckets {
+			if b.start+tier.resolution <= from || (to > 0 && b.start > to) {
+				continue
+			}
+			buckets = append(buckets, toPBRollupBucket(b))
+		}
+		if len(buckets) == 0 {
+			continue
+		}
+		out.Series = append(out.Series, &pb.RollupSeries{
+			Category: string(key.category),
+			Metric:   key.metric,
+			Labels:   labelsToMap(series.labels),
+			Buckets:  buckets,
+		})
+	}
+	sort.Slice(out.Series, func(i, j int) bool {
+		a, b := out.Series[i], out.Series[j]
+		if a.GetCategory() != b.GetCategory() {
+			return a.GetCategory() < b.GetCategory()
+		}
+		if a.GetMetric() != b.GetMetric() {
+			return a.GetMetric() < b.GetMetric()
+		}
+		return labelsKey(mapToLabels(a.GetLabels())) < labelsKey(mapToLabels(b.GetLabels()))
+	})
+	return out, nil
+}
+
+func (s *rollupStore) Prune(now time.Time) {
+	for _, tier := range s.tiers {
+		tier.prune(now)
+	}
+}
+
+func toPBRollupBucket(b rollupBucket) *pb.RollupBucket {
+	avg := 0.0
+	if b.count > 0 {
+		avg = b.sum / float64(b.count)
+	}
+	return &pb.RollupBucket{
+		StartUnixNano: b.start,
+		Min:           b.min,
+		Max:           b.max,
+		Avg:           avg,
+		Last:          b.last,
+		Count:         b.count,
+		Sum:           b.sum,
+	}
+}
+
+func labelsToMap(labels []metricLabel) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(labels))
+	for _, l := range labels {
+		out[l.Name] = l.Value
+	}
+	return out
+}
+
+func mapToLabels(in map[string]string) []metricLabel {
+	out := make([]metricLabel, 0, len(in))
+	for name, value := range in {
+		out = append(out, metricLabel{Name: name, Value: value})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Save writes all tiers to the snapshot file. Buckets lost between the last
+// save and a crash are not rebuilt.
+func (s *rollupStore) Save() error {
+	if s.path == "" {
+		return nil
+	}
+	snapshot := &pb.RollupSnapshot{}
+	for _, tier := range s.tiers {
+		byNode := make(map[string]*pb.RollupsResponse)
+		tier.mu.RLock()
+		for key, series := range tier.series {
+			resp, ok := byNode[key.nodeID]
+			if !ok {
+				resp = &pb.RollupsResponse{NodeId: key.nodeID, ResolutionNanos: tier.resolution}
+				byNode[key.nodeID] = resp
+				snapshot.Tiers = append(snapshot.Tiers, resp)
+			}
+			buckets := make([]*pb.RollupBucket, 0, len(series.buckets))
+			for _, b := range series.buckets {
+				buckets = append(buckets, toPBRollupBucket(b))
+			}
+			resp.Series = append(resp.Series, &pb.RollupSeries{
+				Category: string(key.category),
+				Metric:   key.metric,
+				Labels:   labelsToMap(series.labels),
+				Buckets:  buckets,
+			})
+		}
+		tier.mu.RUnlock()
+	}
+
+	raw, err := proto.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("encode rollup snapshot: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("create rollup snapshot dir: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return fmt.Errorf("write rollup snapshot: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("rename rollup snapshot: %w", err)
+	}
+	return nil
+}
+
+// load restores tiers from the snapshot written by Save.
+func (s *rollupStore) load() error {
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read rollup snapshot: %w", err)
+	}
+	var snapshot pb.RollupSnapshot
+	if err := proto.Unmarshal(raw, &snapshot); err != nil {
+		return fmt.Errorf("decode rollup snapshot: %w", err)
+	}
+	for _, resp := range snapshot.GetTiers() {
+		var tier *rollupTier
+		for _, t := range s.tiers {
+			if t.resolution == resp.GetResolutionNanos() {
+				tier = t
+				break
+			}
+		}
+		if tier == nil {
+			continue
+		}
+		for _, series := range resp.GetSeries() {
+			labels := mapToLabels(series.GetLabels())
+			key := rollupKey{
+				nodeID:   resp.GetNodeId(),
+				category: api.MetricCategory(series.GetCategory()),
+				metric:   series.GetMetric(),
+				labels:   labelsKey(labels),
+			}
+			restored := &rollupSeries{labels: labels, buckets: make([]rollupBucket, 0, len(series.GetBuckets()))}
+			for _, b := range series.GetBuckets() {
+				restored.buckets = append(restored.buckets, rollupBucket{
+					start:  b.GetStartUnixNano(),
+					min:    b.GetMin(),
+					max:    b.GetMax(),
+					sum:    b.GetSum(),
+					count:  b.GetCount(),
+					last:   b.GetLast(),
+					lastAt: b.GetStartUnixNano(),
+				})
+			}
+			tier.series[key] = restored
+		}
+	}
+	return nil
+}
@@ -0,0 +1,558 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/eWloYW8/Telemetry/api"
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+)
+
+const (
+	scheduleFile          = "schedules.pb"
+	scheduleCheckInterval = time.Second
+	scheduleRunHistory    = 50
+	// scheduleGrace is how late an activation may start and still count as
+	// on time rather than missed.
+	scheduleGrace = time.Minute
+	// scheduleMaxMissed caps how many missed activations a run counts, so
+	// that catching up on a frequent schedule after a long outage stays
+	// cheap.
+	scheduleMaxMissed = 10000
+
+	missedRunSkip = "skip"
+	missedRunOnce = "run_once"
+
+	scheduleRunRunning   = "running"
+	scheduleRunCompleted = "completed"
+	scheduleRunFailed    = "failed"
+	scheduleRunSkipped   = "skipped"
+)
+
+var errScheduleNotFound = errors.New("schedule not found")
+
+// scheduleFunc runs one activation of a schedule and returns the fan-out
+// outcome.
+type scheduleFunc func(ctx context.Context, def *pb.Schedule, runID string) (*pb.FanoutCommandResponse, error)
+
+type scheduleEntry struct {
+	def     *pb.Schedule
+	cron    *cronSchedule
+	loc     *time.Location
+	runs    []*pb.ScheduleRun
+	running bool
+}
+
+func (e *scheduleEntry) next() time.Time {
+	return e.cron.Next(time.Unix(0, e.def.GetLastRunUnixNano()).In(e.loc))
+}
+
+func (e *scheduleEntry) toPB() *pb.Schedule {
+	out := proto.Clone(e.def).(*pb.Schedule)
+	if next := e.next(); !next.IsZero() && !e.def.GetPaused() {
+		out.NextRunUnixNano = next.UnixNano()
+	}
+	return out
+}
+
+func (e *scheduleEntry) addRun(run *pb.ScheduleRun) {
+	e.runs = append(e.runs, run)
+	if over := len(e.runs) - scheduleRunHistory; over > 0 {
+		e.runs = append(e.runs[:0:0], e.runs[over:]...)
+	}
+}
+
+// scheduler fires commands on cron schedules. Definitions and their recent
+// runs are written through to a snapshot file like node metadata; the last
+// activation of each schedule is persisted so that activations missed while
+// the server was down are noticed on restart. Runs are persisted with their
+// counts only; per-node results are kept in memory.
+type scheduler struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]*scheduleEntry
+	run     scheduleFunc
+	log     zerolog.Logger
+}
+
+func newScheduler(dir string, run scheduleFunc, logger zerolog.Logger) (*scheduler, error) {
+	s := &scheduler{
+		entries: make(map[string]*scheduleEntry),
+		run:     run,
+		log:     logger,
+	}
+	if dir != "" {
+		s.path = filepath.Join(dir, scheduleFile)
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// validateSchedule checks and normalizes a definition and returns its parsed
+// cron expression and time zone.
+func validateSchedule(def *pb.Schedule) (*cronSchedule, *time.Location, error) {
+	if def == nil {
+		return nil, nil, fmt.Errorf("missing schedule")
+	}
+	def.Name = strings.TrimSpace(def.GetName())
+	def.Cron = strings.TrimSpace(def.GetCron())
+	cron, err := parseCron(def.GetCron())
+	if err != nil {
+		return nil, nil, err
+	}
+	if def.Timezone = strings.TrimSpace(def.GetTimezone()); def.Timezone == "" {
+		def.Timezone = "UTC"
+	}
+	loc, err := time.LoadLocation(def.GetTimezone())
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid timezone: %w", err)
+	}
+	switch def.GetMissedRunPolicy() {
+	case "":
+		def.MissedRunPolicy = missedRunSkip
+	case missedRunSkip, missedRunOnce:
+	default:
+		return nil, nil, fmt.Errorf("unknown missed_run_policy %q (want %s or %s)", def.GetMissedRunPolicy(), missedRunSkip, missedRunOnce)
+	}
+
+	if def.GetCommand() == nil {
+		return nil, nil, fmt.Errorf("missing command")
+	}
+	def.Command.Type = strings.TrimSpace(def.GetCommand().GetType())
+	if def.GetCommand().GetType() == "" {
+		return nil, nil, fmt.Errorf("missing command type")
+	}
+	if api.FromPBCommand(def.GetCommand()) == nil {
+		return nil, nil, fmt.Errorf("invalid command payload")
+	}
+	def.Nodes = setToSortedSlice(sliceToSet(def.GetNodes()))
+	if _, err := parseLabelSelector(def.GetSelector()); err != nil {
+		return nil, nil, err
+	}
+	if len(def.GetNodes()) == 0 && strings.TrimSpace(def.GetSelector()) == "" {
+		return nil, nil, fmt.Errorf("nodes or selector required")
+	}
+	return cron, loc, nil
+}
+
+func (s *scheduler) List() []*pb.Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]*pb.Schedule, 0, len(s.entries))
+	for _, e := range s.entries {
+		out = append(out, e.toPB())
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].GetName() != out[j].GetName() {
+			return out[i].GetName() < out[j].GetName()
+		}
+		return out[i].GetId() < out[j].GetId()
+	})
+	return out
+}
+
+func (s *scheduler) Get(id string) (*pb.Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[id]
+	if !ok {
+		return nil, fmt.Errorf("schedule %s: %w", id, errScheduleNotFound)
+	}
+	return e.toPB(), nil
+}
+
+// Runs returns the recent runs of a schedule, newest first.
+func (s *scheduler) Runs(id string) ([]*pb.ScheduleRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[id]
+	if !ok {
+		return nil, fmt.Errorf("schedule %s: %w", id, errScheduleNotFound)
+	}
+	out := make([]*pb.ScheduleRun, 0, len(e.runs))
+	for i := len(e.runs) - 1; i >= 0; i-- {
+		out = append(out, proto.Clone(e.runs[i]).(*pb.ScheduleRun))
+	}
+	return out, nil
+}
+
+// Create adds a validated schedule. Its first activation is the first one
+// after now.
+func (s *scheduler) Create(def *pb.Schedule, cron *cronSchedule, loc *time.Location, now time.Time) (*pb.Schedule, error) {
+	def = proto.Clone(def).(*pb.Schedule)
+	def.Id = uuid.NewString()
+	def.CreatedAtUnixNano = now.UnixNano()
+	def.UpdatedAtUnixNano = now.UnixNano()
+	def.LastRunUnixNano = now.UnixNano()
+	def.NextRunUnixNano = 0
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := &scheduleEntry{def: def, cron: cron, loc: loc}
+	s.entries[def.Id] = e
+	if err := s.saveLocked(); err != nil {
+		delete(s.entries, def.Id)
+		return nil, err
+	}
+	return e.toPB(), nil
+}
+
+// Update replaces a schedule's definition with a validated one, keeping its
+// id, creation time, last activation and runs.
+func (s *scheduler) Update(id string, def *pb.Schedule, cron *cronSchedule, loc *time.Location, now time.Time) (*pb.Schedule, error) {
+	def = proto.Clone(def).(*pb.Schedule)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[id]
+	if !ok {
+		return nil, fmt.Errorf("schedule %s: %w", id, errScheduleNotFound)
+	}
+	def.Id = id
+	def.CreatedAtUnixNano = e.def.GetCreatedAtUnixNano()
+	def.UpdatedAtUnixNano = now.UnixNano()
+	def.LastRunUnixNano = e.def.GetLastRunUnixNano()
+	def.NextRunUnixNano = 0
+	if e.def.GetPaused() && !def.GetPaused() {
+		// Activations that passed while paused are not missed runs.
+		def.LastRunUnixNano = now.UnixNano()
+	}
+
+	prev := *e
+	e.def, e.cron, e.loc = def, cron, loc
+	if err := s.saveLocked(); err != nil {
+		e.def, e.cron, e.loc = prev.def, prev.cron, prev.loc
+		return nil, err
+	}
+	return e.toPB(), nil
+}
+
+func (s *scheduler) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[id]
+	if !ok {
+		return fmt.Errorf("schedule %s: %w", id, errScheduleNotFound)
+	}
+	delete(s.entries, id)
+	if err := s.saveLocked(); err != nil {
+		s.entries[id] = e
+		return err
+	}
+	return nil
+}
+
+func (s *scheduler) Run(ctx context.Context) {
+	s.mu.Lock()
+	s.log.Info().Int("schedules", len(s.entries)).Msg("scheduler started")
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(scheduleCheckInterval)
+	defer ticker.Stop()
+	s.tick(ctx, time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.tick(ctx, now)
+		}
+	}
+}
+
+// tick starts every schedule whose next activation has come. Activations
+// that passed unnoticed are folded into the latest one, counting at most
+// scheduleMaxMissed of them; if even that one is older than the grace period
+// it is skipped or run depending on the missed run policy.
+func (s *scheduler) tick(ctx context.Context, now time.Time) {
+	type dueRun struct {
+		entry *scheduleEntry
+		def   *pb.Schedule
+		run   *pb.ScheduleRun
+	}
+	var (
+		due     []dueRun
+		changed bool
+	)
+
+	s.mu.Lock()
+	for _, e := range s.entries {
+		if e.def.GetPaused() {
+			continue
+		}
+		at := e.next()
+		if at.IsZero() || at.After(now) {
+			continue
+		}
+		last := e.cron.Prev(now.In(e.loc))
+		if last.Before(at) {
+			last = at
+		}
+		var missed uint32
+		for next := at; missed < scheduleMaxMissed; missed++ {
+			if next = e.cron.Next(next); next.IsZero() || next.After(last) {
+				break
+			}
+		}
+		at = last
+		late := now.Sub(at) > scheduleGrace
+		if late {
+			missed++
+		}
+		e.def.LastRunUnixNano = at.UnixNano()
+		changed = true
+
+		run := &pb.ScheduleRun{
+			ScheduleId:          e.def.GetId(),
+			RunId:               uuid.NewString(),
+			ScheduledAtUnixNano: at.UnixNano(),
+			StartedAtUnixNano:   now.UnixNano(),
+			Missed:              missed,
+		}
+		switch {
+		case late && e.def.GetMissedRunPolicy() != missedRunOnce:
+			run.Status = scheduleRunSkipped
+			run.Error = fmt.Sprintf("missed by %s", now.Sub(at).Truncate(time.Second))
+		case e.running:
+			run.Status = scheduleRunSkipped
+			run.Error = "previous run still running"
+		default:
+			run.Status = scheduleRunRunning
+			e.running = true
+			due = append(due, dueRun{entry: e, def: proto.Clone(e.def).(*pb.Schedule), run: run})
+		}
+		if run.Status == scheduleRunSkipped {
+			run.FinishedAtUnixNano = now.UnixNano()
+			s.log.Warn().
+				Str("schedule_id", e.def.GetId()).
+				Str("schedule", e.def.GetName()).
+				Time("scheduled_at", at).
+				Str("reason", run.Error).
+				Msg("schedule run skipped")
+		}
+		e.addRun(run)
+	}
+	if changed {
+		if err := s.saveLocked(); err != nil {
+			s.log.Warn().Err(err).Msg("save schedules")
+		}
+	}
+	s.mu.Unlock()
+
+	for _, d := range due {
+		go s.execute(ctx, d.entry, d.def, d.run)
+	}
+}
+
+func (s *scheduler) execute(ctx context.Context, e *scheduleEntry, def *pb.Schedule, run *pb.ScheduleRun) {
+	s.log.Info().
+		Str("schedule_id", def.GetId()).
+		Str("schedule", def.GetName()).
+		Str("run_id", run.GetRunId()).
+		Str("command_type", def.GetCommand().GetType()).
+		Uint32("missed", run.GetMissed()).
+		Msg("running schedule")
+	resp, err := s.run(ctx, def, run.GetRunId())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.running = false
+	run.FinishedAtUnixNano = time.Now().UnixNano()
+	if err != nil {
+		run.Status = scheduleRunFailed
+		run.Error = err.Error()
+		s.log.Warn().Err(err).Str("schedule_id", def.GetId()).Str("run_id", run.GetRunId()).Msg("schedule run failed")
+	} else {
+		run.Status = scheduleRunCompleted
+		run.Succeeded = resp.GetSucceeded()
+		run.Failed = resp.GetFailed()
+		run.Results = resp.GetResults()
+	}
+	if err := s.saveLocked(); err != nil {
+		s.log.Warn().Err(err).Msg("save schedules")
+	}
+}
+
+func (s *scheduler) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	ids := make([]string, 0, len(s.entries))
+	for id := range s.entries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	snapshot := &pb.ScheduleSnapshot{}
+	for _, id := range ids {
+		e := s.entries[id]
+		snapshot.Schedules = append(snapshot.Schedules, e.def)
+		for _, run := range e.runs {
+			if len(run.GetResults()) > 0 {
+				run = proto.Clone(run).(*pb.ScheduleRun)
+				run.Results = nil
+			}
+			snapshot.Runs = append(snapshot.Runs, run)
+		}
+	}
+
+	raw, err := proto.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("encode schedules: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("create schedules dir: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return fmt.Errorf("write schedules: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("rename schedules: %w", err)
+	}
+	return nil
+}
+
+func (s *scheduler) load() error {
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read schedules: %w", err)
+	}
+	var snapshot pb.ScheduleSnapshot
+	if err := proto.Unmarshal(raw, &snapshot); err != nil {
+		return fmt.Errorf("decode schedules: %w", err)
+	}
+	for _, def := range snapshot.GetSchedules() {
+		cron, loc, err := validateSchedule(def)
+		if err != nil {
+			return fmt.Errorf("schedule %s: %w", def.GetId(), err)
+		}
+		s.entries[def.GetId()] = &scheduleEntry{def: def, cron: cron, loc: loc}
+	}
+	for _, run := range snapshot.GetRuns() {
+		e, ok := s.entries[run.GetScheduleId()]
+		if !ok {
+			continue
+		}
+		if run.GetStatus() == scheduleRunRunning {
+			run.Status = scheduleRunFailed
+			run.Error = "interrupted by server shutdown"
+		}
+		e.addRun(run)
+	}
+	return nil
+}
+
+// runSchedule fans a scheduled command out through the normal dispatch path,
+// on behalf of the schedule.
+func (s *Server) runSchedule(ctx context.Context, def *pb.Schedule, runID string) (*pb.FanoutCommandResponse, error) {
+	job, err := s.newFanoutJob(&pb.FanoutCommandRequest{
+		Nodes:       def.GetNodes(),
+		Selector:    def.GetSelector(),
+		Command:     def.GetCommand(),
+		Concurrency: def.GetConcurrency(),
+		Id:          runID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx = withCommandOrigin(ctx, commandOrigin{source: "schedule", user: "schedule/" + def.GetId()})
+	return s.runFanout(ctx, job, nil), nil
+}
+
+func (s *Server) handleListSchedules(w http.ResponseWriter, _ *http.Request) {
+	writeProto(w, http.StatusOK, &pb.SchedulesResponse{Schedules: s.schedules.List()})
+}
+
+func (s *Server) handleGetSchedule(w http.ResponseWriter, r *http.Request) {
+	def, err := s.schedules.Get(chi.URLParam(r, "scheduleID"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeProto(w, http.StatusOK, def)
+}
+
+func (s *Server) handleCreateSchedule(w http.ResponseWriter, r *http.Request) {
+	var req pb.Schedule
+	if err := decodeProto(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	cron, loc, err := validateSchedule(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	def, err := s.schedules.Create(&req, cron, loc, time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.log.Info().Str("schedule_id", def.GetId()).Str("schedule", def.GetName()).Str("cron", def.GetCron()).Msg("schedule created")
+	writeProto(w, http.StatusCreated, def)
+}
+
+func (s *Server) handleUpdateSchedule(w http.ResponseWriter, r *http.Request) {
+	var req pb.Schedule
+	if err := decodeProto(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	cron, loc, err := validateSchedule(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	def, err := s.schedules.Update(chi.URLParam(r, "scheduleID"), &req, cron, loc, time.Now())
+	if err != nil {
+		writeScheduleError(w, err)
+		return
+	}
+	s.log.Info().Str("schedule_id", def.GetId()).Str("schedule", def.GetName()).Str("cron", def.GetCron()).Msg("schedule updated")
+	writeProto(w, http.StatusOK, def)
+}
+
+func (s *Server) handleDeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	scheduleID := chi.URLParam(r, "scheduleID")
+	if err := s.schedules.Delete(scheduleID); err != nil {
+		writeScheduleError(w, err)
+		return
+	}
+	s.log.Info().Str("schedule_id", scheduleID).Msg("schedule deleted")
+	writeProto(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) handleListScheduleRuns(w http.ResponseWriter, r *http.Request) {
+	runs, err := s.schedules.Runs(chi.URLParam(r, "scheduleID"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeProto(w, http.StatusOK, &pb.ScheduleRunsResponse{Runs: runs})
+}
+
+func writeScheduleError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errScheduleNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
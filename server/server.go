@@ -2,16 +2,20 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -26,6 +30,10 @@ import (
 type nodeSession struct {
 	nodeID string
 	cmdQ   chan *api.Command
+	// cert is the client certificate the stream was opened with.
+	cert *x509.Certificate
+	// close ends the stream with the given cause.
+	close context.CancelCauseFunc
 }
 
 type ingestItem struct {
@@ -41,6 +49,18 @@ type Server struct {
 	store *Store
 	wsHub *wsHub
 
+	tls    *security.CertReloader
+	tokens *tokenStore
+	// httpTLS is nil when the HTTP listener serves plain HTTP.
+	httpTLS        *security.CertReloader
+	httpClientAuth tls.ClientAuthType
+	certRoles      map[string]authRole
+	identity       *nodeIdentityPolicy
+	// issuer is nil when enrollment is not configured.
+	issuer       *certIssuer
+	enrollTokens *enrollmentTokens
+	wsUpgrader   websocket.Upgrader
+
 	grpcServer *grpc.Server
 	httpServer *http.Server
 
@@ -49,27 +69,156 @@ type Server struct {
 
 	pendingMu sync.Mutex
 	pending   map[string]pendingEntry
+	commands  *commandTracker
+	offline   *offlineQueue
+	audit     *auditLog
+	schedules *scheduler
+	power     *powerController
 
 	ingestQ chan ingestItem
+	derive  *deriver
+	sinks   []*sinkExporter
+	alerts  *alertEngine
 
 	droppedIngest atomic.Uint64
+	failedStore   atomic.Uint64
 }
 
+var (
+	errNodeOffline     = errors.New("node is offline")
+	errNodeCordoned    = errors.New("node is cordoned")
+	errCommandInFlight = errors.New("command is already in flight")
+)
+
 type pendingEntry struct {
 	nodeID string
 	ch     chan *api.CommandResult
 }
 
-func New(cfg config.ServerConfig, logger zerolog.Logger) *Server {
-	return &Server{
-		cfg:      cfg,
-		log:      logger.With().Str("component", "server").Logger(),
-		store:    NewStore(),
-		wsHub:    newWSHub(logger.With().Str("component", "server.ws").Logger()),
-		sessions: make(map[string]*nodeSession),
-		pending:  make(map[string]pendingEntry),
-		ingestQ:  make(chan ingestItem, cfg.IngestQueueSize),
+func New(cfg config.ServerConfig, logger zerolog.Logger) (*Server, error) {
+	identity, err := newNodeIdentityPolicy(cfg.NodeIdentity)
+	if err != nil {
+		return nil, err
+	}
+	httpClientAuth, err := parseHTTPClientAuth(cfg.HTTPTLS)
+	if err != nil {
+		return nil, err
+	}
+	certRoles, err := parseClientRoles(cfg.HTTPTLS, httpClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := newSampleBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	rollupDir := ""
+	if cfg.Storage.Backend == "disk" {
+		rollupDir = cfg.Storage.Path
+	}
+	rollups, err := newRollupStore(cfg.Rollups, rollupDir)
+	if err != nil {
+		_ = backend.Close()
+		return nil, err
+	}
+	meta, err := newNodeMetaStore(cfg.Storage.Path)
+	if err != nil {
+		_ = backend.Close()
+		return nil, err
+	}
+	auditPath := cfg.Audit.Path
+	if auditPath == "" {
+		auditPath = filepath.Join(cfg.Storage.Path, auditFile)
+	}
+	audit, err := openAuditLog(auditPath, logger.With().Str("component", "server.audit").Logger())
+	if err != nil {
+		_ = backend.Close()
+		return nil, err
+	}
+	store, err := NewStore(backend, rollups, meta, cfg.Retention)
+	if err != nil {
+		_ = audit.Close()
+		_ = backend.Close()
+		return nil, err
+	}
+	s := &Server{
+		cfg:            cfg,
+		log:            logger.With().Str("component", "server").Logger(),
+		store:          store,
+		wsHub:          newWSHub(store.NodeLabels, logger.With().Str("component", "server.ws").Logger()),
+		sessions:       make(map[string]*nodeSession),
+		pending:        make(map[string]pendingEntry),
+		audit:          audit,
+		identity:       identity,
+		httpClientAuth: httpClientAuth,
+		certRoles:      certRoles,
+		commands:       newCommandTracker(cfg.CommandHistory, audit),
+		ingestQ:        make(chan ingestItem, cfg.IngestQueueSize),
+		derive:         newDeriver(),
+	}
+	s.wsUpgrader = websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		CheckOrigin:     s.checkWSOrigin,
+	}
+	if cfg.Auth.TokensFile != "" {
+		s.tokens, err = newTokenStore(cfg.Auth.TokensFile, logger.With().Str("component", "server.auth").Logger())
+		if err != nil {
+			_ = store.Close()
+			_ = audit.Close()
+			return nil, err
+		}
+	} else if len(certRoles) == 0 {
+		s.log.Warn().Msg("auth.tokens_file is not set; the HTTP API is unauthenticated")
+	}
+	if cfg.Enrollment.CACertFile != "" {
+		s.issuer, err = newCertIssuer(cfg.Enrollment, cfg.NodeIdentity.Template)
+		if err != nil {
+			_ = store.Close()
+			_ = audit.Close()
+			return nil, err
+		}
 	}
+	s.enrollTokens, err = newEnrollmentTokens(cfg.Storage.Path, cfg.Enrollment.TokenTTL)
+	if err != nil {
+		_ = store.Close()
+		_ = audit.Close()
+		return nil, err
+	}
+	s.offline, err = newOfflineQueue(cfg.Storage.Path, cfg.OfflineCommands, logger.With().Str("component", "server.offline").Logger())
+	if err != nil {
+		_ = store.Close()
+		_ = audit.Close()
+		return nil, err
+	}
+	for _, held := range s.offline.All() {
+		s.commands.Restore(held.cmd, held.origin)
+	}
+	s.sinks, err = newSinkExporters(cfg.Exporters, store, logger.With().Str("component", "server.sink").Logger())
+	if err != nil {
+		_ = store.Close()
+		_ = audit.Close()
+		return nil, err
+	}
+	s.alerts, err = newAlertEngine(cfg.Alerting, s.wsHub.PublishAlert, logger.With().Str("component", "server.alert").Logger())
+	if err != nil {
+		_ = store.Close()
+		_ = audit.Close()
+		return nil, err
+	}
+	s.schedules, err = newScheduler(cfg.Storage.Path, s.runSchedule, logger.With().Str("component", "server.schedule").Logger())
+	if err != nil {
+		_ = store.Close()
+		_ = audit.Close()
+		return nil, err
+	}
+	s.power, err = newPowerController(cfg.Power, store, s.dispatchPowerCap, logger.With().Str("component", "server.power").Logger())
+	if err != nil {
+		_ = store.Close()
+		_ = audit.Close()
+		return nil, err
+	}
+	return s, nil
 }
 
 func (s *Server) Run(ctx context.Context) error {
@@ -77,14 +226,25 @@ func (s *Server) Run(ctx context.Context) error {
 		Str("grpc_listen", s.cfg.GRPCListen).
 		Str("http_listen", s.cfg.HTTPListen).
 		Dur("retention", s.cfg.Retention).
+		Int("max_samples_per_node", s.cfg.MaxSamplesPerNode).
+		Str("storage_backend", s.cfg.Storage.Backend).
 		Int("ingest_queue_size", s.cfg.IngestQueueSize).
 		Int("per_node_queue_size", s.cfg.PerNodeQueueSize).
 		Msg("server configuration loaded")
+	defer func() {
+		if err := s.store.Close(); err != nil {
+			s.log.Warn().Err(err).Msg("close storage")
+		}
+		if err := s.audit.Close(); err != nil {
+			s.log.Warn().Err(err).Msg("close audit log")
+		}
+	}()
 
-	tlsCfg, err := security.LoadServerTLSConfig(s.cfg.TLS)
+	certs, err := security.NewServerCertReloader(s.cfg.TLS, s.log)
 	if err != nil {
 		return err
 	}
+	s.tls = certs
 	grpcListener, err := net.Listen("tcp", s.cfg.GRPCListen)
 	if err != nil {
 		return fmt.Errorf("listen grpc: %w", err)
@@ -93,13 +253,37 @@ func (s *Server) Run(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("listen http: %w", err)
 	}
+	if s.cfg.HTTPTLS.CertFile != "" {
+		s.httpTLS, err = security.NewHTTPCertReloader(s.cfg.HTTPTLS.TLSConfig, s.httpClientAuth, s.log)
+		if err != nil {
+			return err
+		}
+		httpListener = tls.NewListener(httpListener, s.httpTLS.TLSConfig())
+	}
+	var redirectListener net.Listener
+	if s.cfg.HTTPTLS.RedirectListen != "" {
+		redirectListener, err = net.Listen("tcp", s.cfg.HTTPTLS.RedirectListen)
+		if err != nil {
+			return fmt.Errorf("listen http redirect: %w", err)
+		}
+	}
 
-	s.grpcServer = grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsCfg)))
+	s.grpcServer = grpc.NewServer(grpc.Creds(credentials.NewTLS(s.tls.TLSConfig())))
 	pb.RegisterTelemetryServiceServer(s.grpcServer, s)
 
 	go s.ingestLoop(ctx)
 	go s.wsHub.Run(ctx)
 	go s.reportDropStats(ctx)
+	go s.pruneLoop(ctx)
+	for _, sink := range s.sinks {
+		go sink.Run(ctx)
+	}
+	go s.alerts.Run(ctx)
+	go s.reapLoop(ctx)
+	go s.schedules.Run(ctx)
+	go s.power.Run(ctx)
+	go s.expireHeldLoop(ctx)
+	go s.revokedSessionsLoop(ctx)
 
 	router := s.newRouter()
 	s.httpServer = &http.Server{
@@ -109,15 +293,28 @@ func (s *Server) Run(ctx context.Context) error {
 		IdleTimeout:  s.cfg.HTTPIdleTimeout,
 	}
 
-	errCh := make(chan error, 2)
+	errCh := make(chan error, 3)
 	go func() {
 		s.log.Info().Str("addr", s.cfg.GRPCListen).Msg("grpc server listening")
 		errCh <- s.grpcServer.Serve(grpcListener)
 	}()
 	go func() {
-		s.log.Info().Str("addr", s.cfg.HTTPListen).Msg("http server listening")
+		s.log.Info().Str("addr", s.cfg.HTTPListen).Bool("tls", s.httpTLS != nil).Msg("http server listening")
 		errCh <- s.httpServer.Serve(httpListener)
 	}()
+	var redirectServer *http.Server
+	if redirectListener != nil {
+		redirectServer = &http.Server{
+			Handler:      http.HandlerFunc(s.redirectToHTTPS),
+			ReadTimeout:  s.cfg.HTTPReadTimeout,
+			WriteTimeout: s.cfg.HTTPWriteTimeout,
+			IdleTimeout:  s.cfg.HTTPIdleTimeout,
+		}
+		go func() {
+			s.log.Info().Str("addr", s.cfg.HTTPTLS.RedirectListen).Msg("http redirect listening")
+			errCh <- redirectServer.Serve(redirectListener)
+		}()
+	}
 
 	select {
 	case <-ctx.Done():
@@ -125,6 +322,9 @@ func (s *Server) Run(ctx context.Context) error {
 		defer cancel()
 		s.grpcServer.GracefulStop()
 		_ = s.httpServer.Shutdown(txCtx)
+		if redirectServer != nil {
+			_ = redirectServer.Shutdown(txCtx)
+		}
 		return ctx.Err()
 	case err := <-errCh:
 		if err == nil || errors.Is(err, http.ErrServerClosed) {
@@ -140,7 +340,31 @@ func (s *Server) ingestLoop(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case item := <-s.ingestQ:
+			item.samples = append(item.samples, s.derive.Derive(item.nodeID, item.samples)...)
+			if err := s.store.AppendSamples(item.nodeID, item.samples); err != nil {
+				s.failedStore.Add(uint64(len(item.samples)))
+			}
 			s.wsHub.PublishMetrics(item.nodeID, item.samples)
+			s.alerts.Observe(item.nodeID, item.samples)
+			for _, sink := range s.sinks {
+				sink.Enqueue(item.nodeID, item.samples)
+			}
+		}
+	}
+}
+
+func (s *Server) pruneLoop(ctx context.Context) {
+	const pruneInterval = time.Minute
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := s.store.Prune(now); err != nil {
+				s.log.Warn().Err(err).Msg("storage prune failed")
+			}
 		}
 	}
 }
@@ -163,16 +387,29 @@ func (s *Server) StreamTelemetry(stream pb.TelemetryService_StreamTelemetryServe
 	if nodeID == "" {
 		return fmt.Errorf("registration node_id is empty")
 	}
+	if err := s.checkNodeIdentity(stream.Context(), nodeID); err != nil {
+		return err
+	}
 	sourceIP := peerIPFromContext(stream.Context())
 
-	session := &nodeSession{nodeID: nodeID, cmdQ: make(chan *api.Command, s.cfg.PerNodeQueueSize)}
+	ctx, cancel := context.WithCancelCause(stream.Context())
+	defer cancel(nil)
+	session := &nodeSession{
+		nodeID: nodeID,
+		cmdQ:   make(chan *api.Command, s.cfg.PerNodeQueueSize),
+		cert:   peerCertificate(stream.Context()),
+		close:  cancel,
+	}
 	s.store.SetNodeRegistration(reg)
+	// A new stream usually means a restarted agent whose counters started
+	// over; derive rates from its next samples only.
+	s.derive.Forget(nodeID)
 	s.store.SetNodeSourceIP(nodeID, sourceIP)
 	s.registerSession(session)
-	if snapshot, err := s.store.GetNodeSnapshot(nodeID); err == nil {
-		s.wsHub.PublishNodeSnapshot(toPBNodeSnapshot(snapshot))
-	}
-	defer s.unregisterSession(nodeID)
+	s.alerts.Seen(nodeID)
+	s.publishNodeStatus(nodeID)
+	defer s.unregisterSession(session)
+	go s.deliverHeld(ctx, session)
 
 	if err := stream.Send(api.ToPBServerMessage(&api.ServerMessage{
 		Kind: api.MessageKindAck,
@@ -183,21 +420,26 @@ func (s *Server) StreamTelemetry(stream pb.TelemetryService_StreamTelemetryServe
 
 	s.log.Info().Str("node_id", nodeID).Str("source_ip", sourceIP).Msg("node connected")
 
-	ctx, cancel := context.WithCancel(stream.Context())
-	defer cancel()
 	errCh := make(chan error, 2)
 
 	go func() {
 		for {
 			select {
 			case <-ctx.Done():
-				errCh <- nil
+				// A session closed by the server ends with its cause; a
+				// stream closed by the agent ends cleanly.
+				if cause := context.Cause(ctx); errors.Is(cause, errSessionStale) || errors.Is(cause, errSessionReplaced) || errors.Is(cause, errSessionRevoked) {
+					errCh <- cause
+				} else {
+					errCh <- nil
+				}
 				return
 			case cmd := <-session.cmdQ:
 				if err := stream.Send(api.ToPBServerMessage(&api.ServerMessage{Kind: api.MessageKindCommand, Command: cmd})); err != nil {
 					errCh <- err
 					return
 				}
+				s.commands.MarkSent(cmd.ID)
 			}
 		}
 	}()
@@ -250,6 +492,7 @@ func (s *Server) handleAgentMessage(nodeID string, msg *api.AgentMessage) {
 			if n := len(msg.Metrics.Samples); n > 0 {
 				s.store.TouchNode(nodeID, msg.Metrics.Samples[n-1].At)
 			}
+			s.alerts.Seen(nodeID)
 			select {
 			case s.ingestQ <- ingestItem{nodeID: nodeID, samples: msg.Metrics.Samples}:
 			default:
@@ -259,9 +502,8 @@ func (s *Server) handleAgentMessage(nodeID string, msg *api.AgentMessage) {
 	case api.MessageKindHeartbeat:
 		if msg.Heartbeat != nil {
 			s.store.TouchNode(nodeID, msg.Heartbeat.At)
-			if snapshot, err := s.store.GetNodeSnapshot(nodeID); err == nil {
-				s.wsHub.PublishNodeSnapshot(toPBNodeSnapshot(snapshot))
-			}
+			s.alerts.Seen(nodeID)
+			s.publishNodeStatus(nodeID)
 		}
 	case api.MessageKindCommandResult:
 		if msg.Result != nil {
@@ -273,22 +515,40 @@ func (s *Server) handleAgentMessage(nodeID string, msg *api.AgentMessage) {
 func (s *Server) registerSession(session *nodeSession) {
 	s.sessionsMu.Lock()
 	defer s.sessionsMu.Unlock()
+	if prev, ok := s.sessions[session.nodeID]; ok && prev.close != nil {
+		prev.close(errSessionReplaced)
+	}
 	s.sessions[session.nodeID] = session
 	s.store.SetNodeConnected(session.nodeID, true)
-	if snapshot, err := s.store.GetNodeSnapshot(session.nodeID); err == nil {
-		s.wsHub.PublishNodeSnapshot(toPBNodeSnapshot(snapshot))
-	}
+	s.publishNodeStatus(session.nodeID)
 }
 
-func (s *Server) unregisterSession(nodeID string) {
+// unregisterSession drops a session unless the node has already registered a
+// newer one, e.g. after reconnecting while the old stream hung half-open.
+func (s *Server) unregisterSession(session *nodeSession) {
+	nodeID := session.nodeID
 	s.sessionsMu.Lock()
+	if s.sessions[nodeID] != session {
+		s.sessionsMu.Unlock()
+		return
+	}
 	delete(s.sessions, nodeID)
 	s.sessionsMu.Unlock()
 	s.failPendingByNode(nodeID)
 	s.store.SetNodeConnected(nodeID, false)
-	if snapshot, err := s.store.GetNodeSnapshot(nodeID); err == nil {
-		s.wsHub.PublishNodeSnapshot(toPBNodeSnapshot(snapshot))
+	s.publishNodeStatus(nodeID)
+}
+
+// publishNodeStatus broadcasts a node state change. Latest samples are left
+// out because subscribers already receive them as live metric messages; the
+// full snapshot is sent once when a client connects.
+func (s *Server) publishNodeStatus(nodeID string) {
+	snapshot, err := s.store.GetNodeSnapshot(nodeID)
+	if err != nil {
+		return
 	}
+	snapshot.Latest = nil
+	s.wsHub.PublishNodeSnapshot(toPBNodeSnapshot(snapshot))
 }
 
 func (s *Server) getSession(nodeID string) (*nodeSession, bool) {
@@ -309,7 +569,11 @@ func (s *Server) registerPending(commandID, nodeID string) chan *api.CommandResu
 	return ch
 }
 
+// resolvePending hands a result to the dispatcher waiting on it. Results that
+// nobody waits for any more, e.g. after a timeout, still update the command's
+// tracked state.
 func (s *Server) resolvePending(result *api.CommandResult) {
+	s.commands.Complete(result)
 	s.pendingMu.Lock()
 	entry, ok := s.pending[result.CommandID]
 	if ok {
@@ -349,6 +613,7 @@ func (s *Server) failPendingByNode(nodeID string) {
 			Error:      "node disconnected before command completion",
 			FinishedAt: now,
 		}
+		s.commands.Complete(result)
 		select {
 		case entry.ch <- result:
 		default:
@@ -357,17 +622,79 @@ func (s *Server) failPendingByNode(nodeID string) {
 	}
 }
 
-func (s *Server) dispatchCommand(ctx context.Context, nodeID string, cmd *api.Command) (*api.CommandResult, error) {
+// commandSession returns the session a command for nodeID would be sent on.
+func (s *Server) commandSession(nodeID string) (*nodeSession, error) {
+	if s.store.NodeCordoned(nodeID) {
+		return nil, fmt.Errorf("node %s: %w", nodeID, errNodeCordoned)
+	}
 	sess, ok := s.getSession(nodeID)
 	if !ok {
-		return nil, fmt.Errorf("node %s is offline", nodeID)
+		return nil, fmt.Errorf("node %s: %w", nodeID, errNodeOffline)
 	}
+	return sess, nil
+}
 
+// prepareCommand assigns a command its id, node and issue time and starts
+// tracking it on behalf of the origin carried by ctx. It reports false, with
+// the existing status, for a command id that is still in flight.
+func (s *Server) prepareCommand(ctx context.Context, nodeID string, cmd *api.Command) (*pb.CommandStatus, bool) {
 	if cmd.ID == "" {
 		cmd.ID = uuid.NewString()
 	}
 	cmd.NodeID = nodeID
 	cmd.IssuedAt = time.Now().UnixNano()
+	return s.commands.Track(cmd, commandOriginFrom(ctx))
+}
+
+// dispatchCommand sends a command to a node and waits for its result. Every
+// outcome, including a command that fails validation or a node that is
+// offline or cordoned, ends up in the command tracker. A command with a
+// deliver_by time for an offline node is held instead, and dispatchCommand
+// returns errCommandHeld without waiting for it. A command whose id is still
+// in flight is not sent again; dispatchCommand returns errCommandInFlight and
+// the tracker keeps the first one's status.
+func (s *Server) dispatchCommand(ctx context.Context, nodeID string, cmd *api.Command) (*api.CommandResult, error) {
+	if _, started := s.prepareCommand(ctx, nodeID, cmd); !started {
+		return nil, fmt.Errorf("command %s: %w", cmd.ID, errCommandInFlight)
+	}
+	return s.deliverCommand(ctx, nodeID, cmd)
+}
+
+// deliverCommand is dispatchCommand for a command prepareCommand has
+// already tracked.
+func (s *Server) deliverCommand(ctx context.Context, nodeID string, cmd *api.Command) (*api.CommandResult, error) {
+	sess, err := s.admitCommand(ctx, nodeID, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return s.sendCommand(ctx, sess, cmd)
+}
+
+// admitCommand checks a tracked command against its node and returns the
+// session to send it to. A command that fails validation or targets an
+// offline or cordoned node is failed in the tracker; one with a deliver_by
+// time for an offline node is held and errCommandHeld returned.
+func (s *Server) admitCommand(ctx context.Context, nodeID string, cmd *api.Command) (*nodeSession, error) {
+	if err := validateCommand(s.store.NodeRegistration(nodeID), cmd); err != nil {
+		s.commands.Fail(cmd.ID, commandStateFailed, err)
+		return nil, err
+	}
+	sess, err := s.commandSession(nodeID)
+	if err != nil {
+		if errors.Is(err, errNodeOffline) && cmd.DeliverBy > 0 {
+			err = s.holdCommand(ctx, cmd, err)
+		}
+		if !errors.Is(err, errCommandHeld) {
+			s.commands.Fail(cmd.ID, commandStateFailed, err)
+		}
+		return nil, err
+	}
+	return sess, nil
+}
+
+// sendCommand writes a tracked command to a session and waits for its result.
+func (s *Server) sendCommand(ctx context.Context, sess *nodeSession, cmd *api.Command) (*api.CommandResult, error) {
+	nodeID := sess.nodeID
 	s.log.Info().
 		Str("node_id", nodeID).
 		Str("command_id", cmd.ID).
@@ -380,6 +707,7 @@ func (s *Server) dispatchCommand(ctx context.Context, nodeID string, cmd *api.Co
 	case sess.cmdQ <- cmd:
 	case <-ctx.Done():
 		s.clearPending(cmd.ID)
+		s.failCommand(cmd.ID, ctx.Err())
 		return nil, ctx.Err()
 	}
 
@@ -411,10 +739,19 @@ func (s *Server) dispatchCommand(ctx context.Context, nodeID string, cmd *api.Co
 			Str("command_id", cmd.ID).
 			Str("command_type", string(cmd.Type)).
 			Msg("command wait canceled or timed out")
+		s.failCommand(cmd.ID, ctx.Err())
 		return nil, ctx.Err()
 	}
 }
 
+func (s *Server) failCommand(commandID string, err error) {
+	state := commandStateFailed
+	if errors.Is(err, context.DeadlineExceeded) {
+		state = commandStateTimedOut
+	}
+	s.commands.Fail(commandID, state, err)
+}
+
 func (s *Server) reportDropStats(ctx context.Context) {
 	const reportInterval = 5 * time.Second
 	ticker := time.NewTicker(reportInterval)
@@ -422,14 +759,28 @@ func (s *Server) reportDropStats(ctx context.Context) {
 
 	logOnce := func() {
 		droppedIngest := s.droppedIngest.Swap(0)
+		failedStore := s.failedStore.Swap(0)
 		wsDropped, wsSlowClients := s.wsHub.SwapDropStats()
-		if droppedIngest == 0 && wsDropped == 0 && wsSlowClients == 0 {
+		var sinkDropped, sinkFailed uint64
+		for _, sink := range s.sinks {
+			dropped, failed := sink.SwapDropStats()
+			sinkDropped += dropped
+			sinkFailed += failed
+		}
+		alertDropped, alertFailed := s.alerts.SwapDropStats()
+		if droppedIngest == 0 && failedStore == 0 && wsDropped == 0 && wsSlowClients == 0 &&
+			sinkDropped == 0 && sinkFailed == 0 && alertDropped == 0 && alertFailed == 0 {
 			return
 		}
 		s.log.Warn().
 			Uint64("ingest_dropped_samples", droppedIngest).
+			Uint64("storage_failed_samples", failedStore).
 			Uint64("ws_dropped_samples", wsDropped).
 			Uint64("ws_slow_clients_dropped", wsSlowClients).
+			Uint64("sink_dropped_samples", sinkDropped).
+			Uint64("sink_failed_samples", sinkFailed).
+			Uint64("alert_webhook_dropped", alertDropped).
+			Uint64("alert_webhook_failed", alertFailed).
 			Dur("window", reportInterval).
 			Msg("drop summary")
 	}
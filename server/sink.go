@@ -0,0 +1,417 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/eWloYW8/Telemetry/api"
+	"github.com/eWloYW8/Telemetry/config"
+)
+
+const sinkMaxRetryBackoff = 30 * time.Second
+
+// sinkWriter encodes batches for one push protocol and delivers them.
+type sinkWriter interface {
+	Encode(batch []nodeMetrics) ([]byte, error)
+	Send(ctx context.Context, body []byte) error
+	Close() error
+}
+
+// nodeMetrics are the metric families collected from a batch of samples of
+// one node.
+type nodeMetrics struct {
+	nodeID   string
+	hostname string
+	metrics  *metricSet
+}
+
+// sinkError marks a failed delivery and whether it may be retried. A partial
+// error means the receiver accepted the request but rejected some points; it
+// is neither retried nor counted as failed.
+type sinkError struct {
+	err        error
+	retryable  bool
+	partial    bool
+	retryAfter time.Duration
+}
+
+func (e *sinkError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sinkError) Unwrap() error {
+	return e.err
+}
+
+// sinkExporter feeds a sinkWriter from a bounded queue filled by the ingest
+// loop. When the receiver falls behind the queue overflows and samples are
+// dropped instead of blocking ingestion.
+type sinkExporter struct {
+	name       string
+	cfg        config.ExportQueueConfig
+	categories map[api.MetricCategory]struct{}
+	log        zerolog.Logger
+	store      *Store
+	writer     sinkWriter
+	queue      chan ingestItem
+
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+}
+
+func newSinkExporter(name string, cfg config.ExportQueueConfig, categories []string, store *Store, writer sinkWriter, logger zerolog.Logger) *sinkExporter {
+	e := &sinkExporter{
+		name:   name,
+		cfg:    cfg,
+		log:    logger.With().Str("sink", name).Logger(),
+		store:  store,
+		writer: writer,
+		queue:  make(chan ingestItem, cfg.QueueSize),
+	}
+	if len(categories) > 0 {
+		e.categories = make(map[api.MetricCategory]struct{}, len(categories))
+		for _, category := range categories {
+			e.categories[api.MetricCategory(category)] = struct{}{}
+		}
+	}
+	return e
+}
+
+// newSinkExporters builds the OTLP exporter and the configured push sinks.
+func newSinkExporters(cfg config.ExportersConfig, store *Store, logger zerolog.Logger) ([]*sinkExporter, error) {
+	var out []*sinkExporter
+	closeAll := func() {
+		for _, e := range out {
+			_ = e.writer.Close()
+		}
+	}
+	if cfg.OTLP.Enabled {
+		writer, err := newOTLPWriter(cfg.OTLP)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, newSinkExporter("otlp", cfg.OTLP.ExportQueueConfig, cfg.OTLP.Categories, store, writer, logger))
+	}
+	for _, sinkCfg := range cfg.Sinks {
+		tlsCfg, err := exportTLSConfig(sinkCfg.CAFile)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("sink %s: %w", sinkCfg.Name, err)
+		}
+		var writer sinkWriter
+		switch sinkCfg.Type {
+		case "influxdb":
+			writer = newInfluxWriter(sinkCfg, tlsCfg)
+		case "remote_write":
+			writer = newRemoteWriteWriter(sinkCfg, tlsCfg)
+		default:
+			closeAll()
+			return nil, fmt.Errorf("sink %s: unsupported type %q", sinkCfg.Name, sinkCfg.Type)
+		}
+		out = append(out, newSinkExporter(sinkCfg.Name, sinkCfg.ExportQueueConfig, sinkCfg.Categories, store, writer, logger))
+	}
+	return out, nil
+}
+
+// exportTLSConfig trusts the system roots plus an optional CA file.
+func exportTLSConfig(caFile string) (*tls.Config, error) {
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return tlsCfg, nil
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read export ca file: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("parse export ca pem")
+	}
+	tlsCfg.RootCAs = pool
+	return tlsCfg, nil
+}
+
+// Enqueue hands the samples the sink accepts to the exporter without
+// blocking.
+func (e *sinkExporter) Enqueue(nodeID string, samples []api.MetricSample) {
+	if e.categories != nil {
+		var kept []api.MetricSample
+		for _, sample := range samples {
+			if _, ok := e.categories[sample.Category]; ok {
+				kept = append(kept, sample)
+			}
+		}
+		samples = kept
+	}
+	if len(samples) == 0 {
+		return
+	}
+	select {
+	case e.queue <- ingestItem{nodeID: nodeID, samples: samples}:
+	default:
+		e.dropped.Add(uint64(len(samples)))
+	}
+}
+
+// SwapDropStats returns and resets the number of samples dropped on a full
+// queue and the number that could not be delivered after all retries.
+func (e *sinkExporter) SwapDropStats() (dropped, failed uint64) {
+	return e.dropped.Swap(0), e.failed.Swap(0)
+}
+
+func (e *sinkExporter) Run(ctx context.Context) {
+	e.log.Info().
+		Int("batch_size", e.cfg.BatchSize).
+		Int("queue_size", e.cfg.QueueSize).
+		Int("categories", len(e.categories)).
+		Msg("sink exporter started")
+	defer func() {
+		if err := e.writer.Close(); err != nil {
+			e.log.Debug().Err(err).Msg("close sink writer")
+		}
+	}()
+
+	ticker := time.NewTicker(e.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]ingestItem, 0, 64)
+	pending := 0
+	flush := func(ctx context.Context, retry bool) {
+		if pending == 0 {
+			return
+		}
+		e.export(ctx, batch, pending, retry)
+		clear(batch)
+		batch = batch[:0]
+		pending = 0
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			for drained := false; !drained; {
+				select {
+				case item := <-e.queue:
+					batch = append(batch, item)
+					pending += len(item.samples)
+				default:
+					drained = true
+				}
+			}
+			// One last attempt within the export timeout; retries would
+			// hold up shutdown.
+			finalCtx, cancel := context.WithTimeout(context.Background(), e.cfg.Timeout)
+			flush(finalCtx, false)
+			cancel()
+			return
+		case item := <-e.queue:
+			batch = append(batch, item)
+			pending += len(item.samples)
+			if pending >= e.cfg.BatchSize {
+				flush(ctx, true)
+			}
+		case <-ticker.C:
+			flush(ctx, true)
+		}
+	}
+}
+
+func (e *sinkExporter) export(ctx context.Context, batch []ingestItem, samples int, retry bool) {
+	body, err := e.writer.Encode(e.collect(batch))
+	if err != nil {
+		e.failed.Add(uint64(samples))
+		e.log.Warn().Err(err).Int("samples", samples).Msg("sink encode failed")
+		return
+	}
+	if len(body) == 0 {
+		return
+	}
+
+	maxRetries := e.cfg.MaxRetries
+	if !retry {
+		maxRetries = 0
+	}
+	attempts, err := sendWithRetry(ctx, maxRetries, e.cfg.RetryBackoff, e.log, func(ctx context.Context) error {
+		return e.writer.Send(ctx, body)
+	})
+	if err == nil {
+		return
+	}
+	var sendErr *sinkError
+	if errors.As(err, &sendErr) && sendErr.partial {
+		e.log.Warn().Err(err).Msg("sink export partially rejected")
+		return
+	}
+	e.failed.Add(uint64(samples))
+	e.log.Warn().Err(err).Int("samples", samples).Int("attempts", attempts).Msg("sink export failed")
+}
+
+// sendWithRetry calls send until it succeeds or fails for good. Retryable
+// sinkErrors are retried up to maxRetries times with jittered exponential
+// backoff, waiting at least as long as the receiver's Retry-After. It
+// returns the number of attempts made and the last error.
+func sendWithRetry(ctx context.Context, maxRetries int, backoff time.Duration, log zerolog.Logger, send func(context.Context) error) (int, error) {
+	for attempt := 1; ; attempt++ {
+		err := send(ctx)
+		if err == nil {
+			return attempt, nil
+		}
+		var sendErr *sinkError
+		if !errors.As(err, &sendErr) || !sendErr.retryable || attempt > maxRetries || ctx.Err() != nil {
+			return attempt, err
+		}
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if sendErr.retryAfter > wait {
+			wait = sendErr.retryAfter
+		}
+		log.Debug().Err(err).Dur("retry_in", wait).Msg("delivery will be retried")
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, err
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, sinkMaxRetryBackoff)
+	}
+}
+
+// collect translates a batch into metric families grouped by node, in the
+// order nodes first appear in the batch.
+func (e *sinkExporter) collect(batch []ingestItem) []nodeMetrics {
+	out := make([]nodeMetrics, 0, 8)
+	index := make(map[string]int)
+	for _, item := range batch {
+		var modules map[string]any
+		reg := e.store.NodeRegistration(item.nodeID)
+		if reg != nil {
+			modules = reg.Modules
+		}
+		i, ok := index[item.nodeID]
+		if !ok {
+			nm := nodeMetrics{nodeID: item.nodeID, metrics: newMetricSet()}
+			if reg != nil {
+				nm.hostname = reg.Basic.Hostname
+			}
+			i = len(out)
+			index[item.nodeID] = i
+			out = append(out, nm)
+		}
+		set := out[i].metrics
+		nodeLabel := label("node", item.nodeID)
+		for _, sample := range item.samples {
+			set.at = sample.At
+			collectSampleMetrics(set, nodeLabel, sample.Category, sample.Payload, modules)
+		}
+	}
+	return out
+}
+
+// httpSinkSender POSTs encoded batches. 429 and 5xx responses are retryable;
+// checkBody, when set, inspects successful response bodies.
+type httpSinkSender struct {
+	client          *http.Client
+	url             string
+	headers         map[string]string
+	contentType     string
+	contentEncoding string
+	checkBody       func([]byte) error
+}
+
+func newHTTPSinkSender(url string, headers map[string]string, timeout time.Duration, tlsCfg *tls.Config) *httpSinkSender {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsCfg != nil {
+		transport.TLSClientConfig = tlsCfg
+	}
+	return &httpSinkSender{
+		client:  &http.Client{Transport: transport, Timeout: timeout},
+		url:     url,
+		headers: headers,
+	}
+}
+
+func (s *httpSinkSender) Send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return &sinkError{err: fmt.Errorf("build request: %w", err)}
+	}
+	req.Header.Set("Content-Type", s.contentType)
+	if s.contentEncoding != "" {
+		req.Header.Set("Content-Encoding", s.contentEncoding)
+	}
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return &sinkError{err: fmt.Errorf("post %s: %w", s.url, err), retryable: true}
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		if s.checkBody != nil {
+			return s.checkBody(respBody)
+		}
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return &sinkError{
+			err:        fmt.Errorf("post %s: status %d: %s", s.url, resp.StatusCode, bytes.TrimSpace(respBody)),
+			retryable:  true,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	default:
+		return &sinkError{err: fmt.Errorf("post %s: status %d: %s", s.url, resp.StatusCode, bytes.TrimSpace(respBody))}
+	}
+}
+
+func (s *httpSinkSender) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// appendWireMessage appends an embedded message field whose body is written by
+// fn. The body is built in place and the length prefix inserted afterwards.
+func appendWireMessage(b []byte, field protowire.Number, fn func([]byte) []byte) []byte {
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	start := len(b)
+	b = fn(b)
+	size := len(b) - start
+	prefix := protowire.SizeVarint(uint64(size))
+	b = append(b, make([]byte, prefix)...)
+	copy(b[start+prefix:], b[start:start+size])
+	protowire.AppendVarint(b[start:start], uint64(size))
+	return b
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// Snappy block-format encoder used for Prometheus remote-write bodies. It is a
+// plain greedy LZ77 over independent 64 KiB blocks, emitting literals and
+// two-byte-offset copies only, which any conforming decoder accepts.
+
+const (
+	snappyMaxBlockSize   = 1 << 16
+	snappyMinMatchLength = 4
+	snappyTableBits      = 14
+	snappyMaxCopyLength  = 64
+
+	snappyTagLiteral = 0x00
+	snappyTagCopy2   = 0x02
+)
+
+func snappyEncode(src []byte) []byte {
+	dst := make([]byte, 0, binary.MaxVarintLen64+len(src)+len(src)/6+32)
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+	var table [1 << snappyTableBits]int32
+	for len(src) > 0 {
+		block := src
+		if len(block) > snappyMaxBlockSize {
+			block = block[:snappyMaxBlockSize]
+		}
+		src = src[len(block):]
+		dst = snappyEncodeBlock(dst, block, &table)
+	}
+	return dst
+}
+
+func snappyHash(v uint32) uint32 {
+	return (v * 0x1e35a7bd) >> (32 - snappyTableBits)
+}
+
+func snappyEncodeBlock(dst, src []byte, table *[1 << snappyTableBits]int32) []byte {
+	if len(src) < 2*snappyMinMatchLength {
+		return snappyEmitLiteral(dst, src)
+	}
+	// Entries hold position+1 so the zero value means empty.
+	clear(table[:])
+	nextEmit := 0
+	s := 0
+	for s+snappyMinMatchLength <= len(src) {
+		cur := binary.LittleEndian.Uint32(src[s:])
+		h := snappyHash(cur)
+		candidate := int(table[h]) - 1
+		table[h] = int32(s + 1)
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != cur {
+			s++
+			continue
+		}
+
+		dst = snappyEmitLiteral(dst, src[nextEmit:s])
+		base := s
+		s = snappyExtendMatch(src, candidate+snappyMinMatchLength, s+snappyMinMatchLength)
+		dst = snappyEmitCopy(dst, base-candidate, s-base)
+		nextEmit = s
+	}
+	return snappyEmitLiteral(dst, src[nextEmit:])
+}
+
+// snappyExtendMatch returns the end of the match between src[c:] and src[s:].
+func snappyExtendMatch(src []byte, c, s int) int {
+	for s+8 <= len(src) {
+		if x := binary.LittleEndian.Uint64(src[s:]) ^ binary.LittleEndian.Uint64(src[c:]); x != 0 {
+			return s + bits.TrailingZeros64(x)/8
+		}
+		s += 8
+		c += 8
+	}
+	for s < len(src) && src[s] == src[c] {
+		s++
+		c++
+	}
+	return s
+}
+
+func snappyEmitLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyTagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// snappyEmitCopy emits a back-reference; offsets stay below 64 KiB because
+// blocks never reference each other.
+func snappyEmitCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := min(length, snappyMaxCopyLength)
+		dst = append(dst, byte(n-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
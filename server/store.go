@@ -1,30 +1,64 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"maps"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/eWloYW8/Telemetry/api"
 )
 
+var (
+	errNodeNotFound  = errors.New("not found")
+	errNodeConnected = errors.New("still connected")
+)
+
 type nodeBuffer struct {
 	mu           sync.RWMutex
 	registration *api.Registration
 	connected    bool
+	stale        bool
 	lastSeen     int64
 	sourceIP     string
+	// labels are the effective labels, replaced as a whole whenever the
+	// registration or the overrides change.
+	labels map[string]string
+
+	// lastContact is the server time of the last registration, heartbeat or
+	// metrics batch. Unlike lastSeen it does not depend on the agent clock.
+	lastContact int64
+
+	latest map[api.MetricCategory]api.MetricSample
 }
 
 type Store struct {
 	mu    sync.RWMutex
 	nodes map[string]*nodeBuffer
+	meta  *nodeMetaStore
+
+	backend   SampleBackend
+	rollups   *rollupStore
+	retention time.Duration
+
+	lastRollupSave time.Time
 }
 
-func NewStore() *Store {
-	return &Store{
-		nodes: make(map[string]*nodeBuffer),
+func NewStore(backend SampleBackend, rollups *rollupStore, meta *nodeMetaStore, retention time.Duration) (*Store, error) {
+	s := &Store{
+		nodes:          make(map[string]*nodeBuffer),
+		meta:           meta,
+		backend:        backend,
+		rollups:        rollups,
+		retention:      retention,
+		lastRollupSave: time.Now(),
+	}
+	if err := s.restore(); err != nil {
+		return nil, fmt.Errorf("restore node state: %w", err)
 	}
+	return s, nil
 }
 
 func (s *Store) ensureNode(nodeID string) *nodeBuffer {
@@ -44,7 +78,10 @@ func (s *Store) SetNodeRegistration(reg *api.Registration) {
 	defer n.mu.Unlock()
 	cp := *reg
 	n.registration = &cp
+	n.labels = nodeLabels(n.registration, s.meta.Get(reg.NodeID).labels)
 	n.connected = true
+	n.stale = false
+	n.lastContact = time.Now().UnixNano()
 	if reg.At > 0 {
 		n.lastSeen = reg.At
 	}
@@ -69,32 +106,66 @@ func (s *Store) TouchNode(nodeID string, at int64) {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 	n.lastSeen = at
+	n.lastContact = time.Now().UnixNano()
+	n.stale = false
 }
 
-func (s *Store) ListNodeSnapshots() []api.NodeSnapshot {
+// MarkStaleNodes flags connected nodes not heard from since cutoff (server
+// time) as stale and returns their ids. Nodes already stale are skipped.
+func (s *Store) MarkStaleNodes(cutoff int64) []string {
+	var out []string
+	for _, id := range s.nodeIDs() {
+		n := s.ensureNode(id)
+		n.mu.Lock()
+		if n.connected && !n.stale && n.lastContact < cutoff {
+			n.stale = true
+			out = append(out, id)
+		}
+		n.mu.Unlock()
+	}
+	return out
+}
+
+// EvictNodes forgets disconnected nodes not heard from since cutoff and
+// returns their ids. Their history stays in the backend, and can still be
+// queried by node id, until retention.
+func (s *Store) EvictNodes(cutoff int64) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []string
+	for id, n := range s.nodes {
+		n.mu.RLock()
+		evict := !n.connected && n.lastContact < cutoff
+		n.mu.RUnlock()
+		if evict {
+			delete(s.nodes, id)
+			out = append(out, id)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (s *Store) nodeIDs() []string {
 	s.mu.RLock()
 	ids := make([]string, 0, len(s.nodes))
 	for id := range s.nodes {
 		ids = append(ids, id)
 	}
 	s.mu.RUnlock()
-
 	sort.Strings(ids)
+	return ids
+}
+
+func (s *Store) ListNodeSnapshots() []api.NodeSnapshot {
+	ids := s.nodeIDs()
 	result := make([]api.NodeSnapshot, 0, len(ids))
 	for _, id := range ids {
 		n := s.ensureNode(id)
 		n.mu.RLock()
-		snapshot := api.NodeSnapshot{
-			NodeID:    id,
-			Connected: n.connected,
-			LastSeen:  n.lastSeen,
-			SourceIP:  n.sourceIP,
-		}
-		if n.registration != nil {
-			cp := *n.registration
-			snapshot.Registration = &cp
-		}
+		snapshot := n.snapshotLocked(id)
 		n.mu.RUnlock()
+		s.applyMeta(&snapshot)
 		result = append(result, snapshot)
 	}
 	return result
@@ -108,16 +179,143 @@ func (s *Store) GetNodeSnapshot(nodeID string) (api.NodeSnapshot, error) {
 		return api.NodeSnapshot{}, fmt.Errorf("node %s not found", nodeID)
 	}
 	n.mu.RLock()
+	snapshot := n.snapshotLocked(nodeID)
+	n.mu.RUnlock()
+	s.applyMeta(&snapshot)
+	return snapshot, nil
+}
+
+func (s *Store) applyMeta(snapshot *api.NodeSnapshot) {
+	meta := s.meta.Get(snapshot.NodeID)
+	snapshot.Cordoned = meta.cordoned
+	snapshot.CordonReason = meta.cordonReason
+	snapshot.CordonedAt = meta.cordonedAt
+	snapshot.Annotations = maps.Clone(meta.annotations)
+}
+
+// NodeLabels returns the effective labels of a node, nil if it is unknown.
+// The map must not be modified.
+func (s *Store) NodeLabels(nodeID string) map[string]string {
+	s.mu.RLock()
+	n, ok := s.nodes[nodeID]
+	s.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	n.mu.RLock()
 	defer n.mu.RUnlock()
+	return n.labels
+}
+
+// SetNodeLabels replaces the server-side label overrides of a node.
+func (s *Store) SetNodeLabels(nodeID string, overrides map[string]string) error {
+	if err := s.meta.Update(nodeID, func(meta *nodeMeta) {
+		meta.labels = maps.Clone(overrides)
+	}); err != nil {
+		return err
+	}
+	n := s.ensureNode(nodeID)
+	n.mu.Lock()
+	n.labels = nodeLabels(n.registration, overrides)
+	n.mu.Unlock()
+	return nil
+}
+
+// NodeCordoned reports whether control commands to the node are rejected.
+func (s *Store) NodeCordoned(nodeID string) bool {
+	return s.meta.Get(nodeID).cordoned
+}
+
+// SetNodeCordon cordons or uncordons a node. Cordoning an already cordoned
+// node only updates the reason.
+func (s *Store) SetNodeCordon(nodeID string, cordoned bool, reason string) error {
+	return s.meta.Update(nodeID, func(meta *nodeMeta) {
+		if !cordoned {
+			meta.cordoned, meta.cordonReason, meta.cordonedAt = false, "", 0
+			return
+		}
+		if !meta.cordoned {
+			meta.cordoned = true
+			meta.cordonedAt = time.Now().UnixNano()
+		}
+		meta.cordonReason = reason
+	})
+}
+
+// SetNodeAnnotations replaces the annotations of a node.
+func (s *Store) SetNodeAnnotations(nodeID string, annotations map[string]string) error {
+	return s.meta.Update(nodeID, func(meta *nodeMeta) {
+		meta.annotations = maps.Clone(annotations)
+	})
+}
+
+// DeleteNode forgets a disconnected node together with its metadata and its
+// latest samples, so that it is not restored on the next start.
+func (s *Store) DeleteNode(nodeID string) error {
+	s.mu.Lock()
+	n, ok := s.nodes[nodeID]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("node %s: %w", nodeID, errNodeNotFound)
+	}
+	n.mu.RLock()
+	connected := n.connected
+	n.mu.RUnlock()
+	if connected {
+		s.mu.Unlock()
+		return fmt.Errorf("node %s: %w", nodeID, errNodeConnected)
+	}
+	delete(s.nodes, nodeID)
+	s.mu.Unlock()
+	return errors.Join(s.meta.Delete(nodeID), s.backend.DeleteNode(nodeID))
+}
+
+// NodeKnown reports whether the server has seen a node: it registered since
+// the start, was restored from the backend or has metadata.
+func (s *Store) NodeKnown(nodeID string) bool {
+	s.mu.RLock()
+	_, ok := s.nodes[nodeID]
+	s.mu.RUnlock()
+	return ok || !s.meta.Get(nodeID).empty()
+}
+
+// NodeRegistration returns the last registration of a node, or nil if the
+// node has not registered since the server started.
+func (s *Store) NodeRegistration(nodeID string) *api.Registration {
+	s.mu.RLock()
+	n, ok := s.nodes[nodeID]
+	s.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.registration
+}
+
+func (n *nodeBuffer) snapshotLocked(nodeID string) api.NodeSnapshot {
 	snapshot := api.NodeSnapshot{
 		NodeID:    nodeID,
 		Connected: n.connected,
+		Stale:     n.stale,
 		LastSeen:  n.lastSeen,
 		SourceIP:  n.sourceIP,
+		Labels:    maps.Clone(n.labels),
 	}
 	if n.registration != nil {
 		cp := *n.registration
 		snapshot.Registration = &cp
 	}
-	return snapshot, nil
+	if len(n.latest) > 0 {
+		snapshot.Latest = make(map[string]api.TimedSample, len(n.latest))
+		for category, sample := range n.latest {
+			snapshot.Latest[string(category)] = api.TimedSample{
+				NodeID:   nodeID,
+				Category: sample.Category,
+				At:       sample.At,
+				Payload:  sample.Payload,
+			}
+		}
+	}
+	return snapshot
 }
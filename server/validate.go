@@ -0,0 +1,275 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	cpupb "github.com/eWloYW8/Telemetry/agent/modules/cpu/pb"
+	gpupb "github.com/eWloYW8/Telemetry/agent/modules/gpu/pb"
+	processpb "github.com/eWloYW8/Telemetry/agent/modules/process/pb"
+	"github.com/eWloYW8/Telemetry/api"
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+)
+
+// commandValidationError is a command the target node cannot carry out,
+// judged from the hardware ranges in its registration.
+type commandValidationError struct {
+	nodeID     string
+	cmdType    api.CommandType
+	violations []*pb.FieldViolation
+}
+
+func (e *commandValidationError) Error() string {
+	parts := make([]string, 0, len(e.violations))
+	for _, v := range e.violations {
+		parts = append(parts, v.GetField()+": "+v.GetReason())
+	}
+	return fmt.Sprintf("invalid %s command for node %s: %s", e.cmdType, e.nodeID, strings.Join(parts, "; "))
+}
+
+// commandValidator collects the violations of one command.
+type commandValidator struct {
+	violations []*pb.FieldViolation
+}
+
+func (v *commandValidator) addf(field, format string, args ...any) {
+	v.violations = append(v.violations, &pb.FieldViolation{Field: field, Reason: fmt.Sprintf(format, args...)})
+}
+
+// checkRange checks a requested min/max pair, where 0 leaves a bound
+// unchanged, against the hardware limits lo..hi; a hi of 0 means the limits
+// are unknown.
+func (v *commandValidator) checkRange(prefix string, minVal, maxVal, lo, hi uint64, unit string) {
+	if minVal > 0 && maxVal > 0 && minVal > maxVal {
+		v.addf(prefix+"min_"+unit, "%d is above %smax_%s %d", minVal, prefix, unit, maxVal)
+	}
+	if hi == 0 {
+		return
+	}
+	for _, bound := range []struct {
+		field string
+		value uint64
+	}{{prefix + "min_" + unit, minVal}, {prefix + "max_" + unit, maxVal}} {
+		if bound.value > 0 && (bound.value < lo || bound.value > hi) {
+			v.addf(bound.field, "%d is outside the supported range %d-%d", bound.value, lo, hi)
+		}
+	}
+}
+
+// validateCommand checks a command against the registration of its target
+// node. Nodes that never registered, and command types the server does not
+// know, are left for the agent to judge.
+func validateCommand(reg *api.Registration, cmd *api.Command) error {
+	if reg == nil {
+		return nil
+	}
+	var v commandValidator
+	switch cmd.Type {
+	case "cpu_scaling_range", "cpu_governor", "cpu_uncore_range", "cpu_power_cap":
+		module, _ := reg.Modules["cpu"].(*cpupb.ModuleRegistration)
+		if module == nil {
+			v.addf("type", "node has no cpu module")
+			break
+		}
+		validateCPUCommand(&v, module, cmd)
+	case "gpu_clock_range", "gpu_power_cap", "amdgpu_clock_range", "amdgpu_power_cap":
+		kind, _, _ := strings.Cut(string(cmd.Type), "_")
+		module, _ := reg.Modules[kind].(*gpupb.ModuleRegistration)
+		if module == nil {
+			v.addf("type", "node has no %s module", kind)
+			break
+		}
+		validateGPUCommand(&v, module, cmd)
+	case "process_signal":
+		payload, ok := commandPayload[*processpb.SignalCommand](&v, cmd)
+		if !ok {
+			break
+		}
+		if payload.GetPid() <= 0 {
+			v.addf("pid", "must be positive")
+		}
+		if payload.GetSignal() <= 0 || payload.GetSignal() > 64 {
+			v.addf("signal", "%d is not a signal number", payload.GetSignal())
+		}
+	default:
+		return nil
+	}
+	if len(v.violations) == 0 {
+		return nil
+	}
+	return &commandValidationError{nodeID: reg.NodeID, cmdType: cmd.Type, violations: v.violations}
+}
+
+func validateCPUCommand(v *commandValidator, module *cpupb.ModuleRegistration, cmd *api.Command) {
+	// packages resolves the packages a command targets; nil targets all.
+	packages := func(id *int32) []*cpupb.PackageControl {
+		if id == nil {
+			return module.GetPackageControls()
+		}
+		for _, pc := range module.GetPackageControls() {
+			if pc.GetPackageId() == *id {
+				return []*cpupb.PackageControl{pc}
+			}
+		}
+		v.addf("package_id", "package %d not found", *id)
+		return nil
+	}
+
+	switch cmd.Type {
+	case "cpu_scaling_range":
+		payload, ok := commandPayload[*cpupb.ScalingRangeCommand](v, cmd)
+		if !ok {
+			return
+		}
+		if payload.GetMinKhz() == 0 && payload.GetMaxKhz() == 0 {
+			v.addf("min_khz", "min_khz or max_khz is required")
+			return
+		}
+		targets := packages(payload.PackageId)
+		if payload.PackageId != nil && targets == nil {
+			return
+		}
+		lo, hi := module.GetStatic().GetCpuinfoMinKhz(), module.GetStatic().GetCpuinfoMaxKhz()
+		for _, pc := range targets {
+			if pc.GetScalingHwMaxKhz() > 0 {
+				lo, hi = pc.GetScalingHwMinKhz(), pc.GetScalingHwMaxKhz()
+				break
+			}
+		}
+		v.checkRange("", payload.GetMinKhz(), payload.GetMaxKhz(), lo, hi, "khz")
+	case "cpu_governor":
+		payload, ok := commandPayload[*cpupb.GovernorCommand](v, cmd)
+		if !ok {
+			return
+		}
+		governor := payload.GetGovernor()
+		if governor == "" {
+			v.addf("governor", "governor is required")
+			return
+		}
+		for _, pc := range packages(payload.PackageId) {
+			available := pc.GetAvailableGovernors()
+			if len(available) > 0 && !slices.Contains(available, governor) {
+				v.addf("governor", "%q is not available on package %d (available: %s)", governor, pc.GetPackageId(), strings.Join(available, ", "))
+				return
+			}
+		}
+	case "cpu_uncore_range":
+		payload, ok := commandPayload[*cpupb.UncoreRangeCommand](v, cmd)
+		if !ok {
+			return
+		}
+		if !module.GetStatic().GetSupportsIntelUncore() {
+			v.addf("type", "node does not support uncore frequency control")
+			return
+		}
+		if payload.GetMinKhz() == 0 && payload.GetMaxKhz() == 0 {
+			v.addf("min_khz", "min_khz or max_khz is required")
+			return
+		}
+		id := payload.GetPackageId()
+		targets := packages(&id)
+		if targets == nil {
+			return
+		}
+		pc := targets[0]
+		if pc.GetUncoreMaxKhz() == 0 {
+			v.addf("package_id", "package %d has no uncore frequency control", id)
+			return
+		}
+		v.checkRange("", payload.GetMinKhz(), payload.GetMaxKhz(), pc.GetUncoreMinKhz(), pc.GetUncoreMaxKhz(), "khz")
+	case "cpu_power_cap":
+		payload, ok := commandPayload[*cpupb.PowerCapCommand](v, cmd)
+		if !ok {
+			return
+		}
+		if payload.GetMicrowatt() == 0 {
+			v.addf("microwatt", "must be positive")
+			return
+		}
+		domain := strings.ToLower(strings.TrimSpace(payload.GetDomain()))
+		if domain != "" && domain != "package" && domain != "dram" {
+			v.addf("domain", "unsupported power cap domain %q (want package or dram)", payload.GetDomain())
+			return
+		}
+		id := payload.GetPackageId()
+		targets := packages(&id)
+		if targets == nil {
+			return
+		}
+		pc := targets[0]
+		lo, hi := pc.GetPowerCapMinMicroW(), pc.GetPowerCapMaxMicroW()
+		if domain == "dram" {
+			lo, hi = pc.GetDramPowerCapMinMicroW(), pc.GetDramPowerCapMaxMicroW()
+		}
+		if hi == 0 {
+			v.addf("package_id", "package %d has no %s power cap control", id, cmp.Or(domain, "package"))
+			return
+		}
+		if payload.GetMicrowatt() < lo || payload.GetMicrowatt() > hi {
+			v.addf("microwatt", "%d is outside the supported range %d-%d", payload.GetMicrowatt(), lo, hi)
+		}
+	}
+}
+
+func validateGPUCommand(v *commandValidator, module *gpupb.ModuleRegistration, cmd *api.Command) {
+	device := func(index int32) *gpupb.StaticInfo {
+		for _, static := range module.GetStatic() {
+			if static.GetIndex() == index {
+				return static
+			}
+		}
+		v.addf("gpu_index", "gpu %d not found (node has %d)", index, len(module.GetStatic()))
+		return nil
+	}
+
+	switch cmd.Type {
+	case "gpu_clock_range", "amdgpu_clock_range":
+		payload, ok := commandPayload[*gpupb.ClockRangeCommand](v, cmd)
+		if !ok {
+			return
+		}
+		static := device(payload.GetGpuIndex())
+		if static == nil {
+			return
+		}
+		if payload.GetSmMinMhz()|payload.GetSmMaxMhz()|payload.GetMemMinMhz()|payload.GetMemMaxMhz() == 0 {
+			v.addf("sm_min_mhz", "at least one clock bound is required")
+			return
+		}
+		v.checkRange("sm_", uint64(payload.GetSmMinMhz()), uint64(payload.GetSmMaxMhz()),
+			uint64(static.GetSmClockMinMhz()), uint64(static.GetSmClockMaxMhz()), "mhz")
+		v.checkRange("mem_", uint64(payload.GetMemMinMhz()), uint64(payload.GetMemMaxMhz()),
+			uint64(static.GetMemClockMinMhz()), uint64(static.GetMemClockMaxMhz()), "mhz")
+	case "gpu_power_cap", "amdgpu_power_cap":
+		payload, ok := commandPayload[*gpupb.PowerCapCommand](v, cmd)
+		if !ok {
+			return
+		}
+		static := device(payload.GetGpuIndex())
+		if static == nil {
+			return
+		}
+		mw := payload.GetMilliwatt()
+		switch {
+		case mw == 0:
+			v.addf("milliwatt", "must be positive")
+		case static.GetPowerMaxMilliwatt() > 0 && (mw < static.GetPowerMinMilliwatt() || mw > static.GetPowerMaxMilliwatt()):
+			v.addf("milliwatt", "%d is outside the supported range %d-%d", mw, static.GetPowerMinMilliwatt(), static.GetPowerMaxMilliwatt())
+		}
+	}
+}
+
+// commandPayload returns the payload of cmd if it has the type its command
+// type calls for.
+func commandPayload[T comparable](v *commandValidator, cmd *api.Command) (T, bool) {
+	payload, ok := cmd.Payload.(T)
+	var zero T
+	if !ok || payload == zero {
+		v.addf("payload", "missing %s payload", cmd.Type)
+		return zero, false
+	}
+	return payload, true
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "github.com/eWloYW8/Telemetry/api/pb"
+	"github.com/eWloYW8/Telemetry/config"
+)
+
+// webhookNotifier POSTs alert state changes to an HTTP endpoint as JSON
+// AlertsResponse documents, one alert per request. Notifications queue up to
+// QueueSize and are dropped beyond that so a slow receiver cannot stall
+// evaluation.
+type webhookNotifier struct {
+	cfg    config.WebhookConfig
+	log    zerolog.Logger
+	sender *httpSinkSender
+	queue  chan []byte
+
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+}
+
+func newWebhookNotifier(cfg config.WebhookConfig, logger zerolog.Logger) (*webhookNotifier, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("webhook %s: missing url", cfg.Name)
+	}
+	tlsCfg, err := exportTLSConfig(cfg.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("webhook %s: %w", cfg.Name, err)
+	}
+	sender := newHTTPSinkSender(cfg.URL, cfg.Headers, cfg.Timeout, tlsCfg)
+	sender.contentType = "application/json"
+	return &webhookNotifier{
+		cfg:    cfg,
+		log:    logger.With().Str("webhook", cfg.Name).Logger(),
+		sender: sender,
+		queue:  make(chan []byte, cfg.QueueSize),
+	}, nil
+}
+
+// Notify queues an alert without blocking.
+func (n *webhookNotifier) Notify(alert *pb.Alert) {
+	body, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(&pb.AlertsResponse{Alerts: []*pb.Alert{alert}})
+	if err != nil {
+		n.failed.Add(1)
+		return
+	}
+	select {
+	case n.queue <- body:
+	default:
+		n.dropped.Add(1)
+	}
+}
+
+// SwapDropStats returns and resets the number of notifications dropped on a
+// full queue and the number that could not be delivered after all retries.
+func (n *webhookNotifier) SwapDropStats() (dropped, failed uint64) {
+	return n.dropped.Swap(0), n.failed.Swap(0)
+}
+
+func (n *webhookNotifier) Run(ctx context.Context) {
+	n.log.Info().Int("queue_size", n.cfg.QueueSize).Msg("alert webhook started")
+	defer n.sender.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			// Pending notifications get one attempt each within the
+			// timeout; retries would hold up shutdown.
+			finalCtx, cancel := context.WithTimeout(context.Background(), n.cfg.Timeout)
+			defer cancel()
+			for {
+				select {
+				case body := <-n.queue:
+					n.deliver(finalCtx, body, 0)
+				default:
+					return
+				}
+			}
+		case body := <-n.queue:
+			n.deliver(ctx, body, n.cfg.MaxRetries)
+		}
+	}
+}
+
+func (n *webhookNotifier) deliver(ctx context.Context, body []byte, maxRetries int) {
+	attempts, err := sendWithRetry(ctx, maxRetries, n.cfg.RetryBackoff, n.log, func(ctx context.Context) error {
+		return n.sender.Send(ctx, body)
+	})
+	if err != nil {
+		n.failed.Add(1)
+		n.log.Warn().Err(err).Int("attempts", attempts).Msg("alert webhook delivery failed")
+	}
+}
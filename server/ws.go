@@ -2,6 +2,8 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -25,22 +27,18 @@ const (
 	wsPingPeriod         = 20 * time.Second
 )
 
-var wsUpgrader = websocket.Upgrader{
-	ReadBufferSize:  4096,
-	WriteBufferSize: 4096,
-	CheckOrigin: func(_ *http.Request) bool {
-		return true
-	},
-}
-
 type wsBroadcast struct {
 	nodeID   string
 	category string
 	payload  []byte
+	// all bypasses client filters, e.g. for removals of nodes whose labels
+	// are gone.
+	all bool
 }
 
 type wsHub struct {
 	log        zerolog.Logger
+	nodeLabels func(nodeID string) map[string]string
 	register   chan *wsClient
 	unregister chan *wsClient
 	broadcast  chan wsBroadcast
@@ -50,9 +48,10 @@ type wsHub struct {
 	droppedSlowClients atomic.Uint64
 }
 
-func newWSHub(logger zerolog.Logger) *wsHub {
+func newWSHub(nodeLabels func(nodeID string) map[string]string, logger zerolog.Logger) *wsHub {
 	return &wsHub{
 		log:        logger,
+		nodeLabels: nodeLabels,
 		register:   make(chan *wsClient, 256),
 		unregister: make(chan *wsClient, 256),
 		broadcast:  make(chan wsBroadcast, 8192),
@@ -65,8 +64,7 @@ func (h *wsHub) Run(ctx context.Context) {
 		select {
 		case <-ctx.Done():
 			for c := range h.clients {
-				close(c.send)
-				_ = c.conn.Close()
+				c.close()
 			}
 			return
 		case c := <-h.register:
@@ -74,20 +72,20 @@ func (h *wsHub) Run(ctx context.Context) {
 		case c := <-h.unregister:
 			if _, ok := h.clients[c]; ok {
 				delete(h.clients, c)
-				close(c.send)
-				_ = c.conn.Close()
+				c.close()
 			}
 		case event := <-h.broadcast:
+			var labels map[string]string
+			if h.nodeLabels != nil && !event.all {
+				labels = h.nodeLabels(event.nodeID)
+			}
 			for c := range h.clients {
-				if !c.match(event.nodeID, event.category) {
+				if !event.all && !c.match(event.nodeID, event.category, labels) {
 					continue
 				}
-				select {
-				case c.send <- event.payload:
-				default:
+				if !c.trySend(event.payload) {
 					delete(h.clients, c)
-					close(c.send)
-					_ = c.conn.Close()
+					c.close()
 					h.droppedSlowClients.Add(1)
 				}
 			}
@@ -143,6 +141,43 @@ func (h *wsHub) PublishNodeSnapshot(snapshot *pb.NodeSnapshot) {
 	}
 }
 
+// PublishNodeRemoved tells clients to drop a node the server has evicted or
+// an operator deleted.
+func (h *wsHub) PublishNodeRemoved(nodeID string) {
+	msg := &pb.WSOutgoingMessage{
+		Type: "node_removed",
+		Node: &pb.NodeSnapshot{NodeId: nodeID},
+	}
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return
+	}
+	select {
+	case h.broadcast <- wsBroadcast{nodeID: nodeID, category: "", payload: payload, all: true}:
+	default:
+		h.droppedBroadcast.Add(1)
+	}
+}
+
+func (h *wsHub) PublishAlert(alert *pb.Alert) {
+	if alert == nil {
+		return
+	}
+	msg := &pb.WSOutgoingMessage{
+		Type:  "alert",
+		Alert: alert,
+	}
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return
+	}
+	select {
+	case h.broadcast <- wsBroadcast{nodeID: alert.GetNodeId(), category: "", payload: payload}:
+	default:
+		h.droppedBroadcast.Add(1)
+	}
+}
+
 func (h *wsHub) SwapDropStats() (droppedBroadcast uint64, droppedSlowClients uint64) {
 	if h == nil {
 		return 0, 0
@@ -154,26 +189,76 @@ type wsClient struct {
 	conn       *websocket.Conn
 	send       chan []byte
 	remoteAddr string
+	identity   *authIdentity
+
+	// closeMu guards closing send against goroutines that outlive the
+	// connection, such as command and fan-out dispatchers. done is closed
+	// with it.
+	closeMu sync.Mutex
+	closed  bool
+	done    chan struct{}
 
 	mu         sync.RWMutex
 	nodes      map[string]struct{}
 	categories map[string]struct{}
+	selector   labelSelector
 }
 
-func newWSClient(conn *websocket.Conn, remoteAddr string, nodes, categories map[string]struct{}, queueSize int) *wsClient {
+func newWSClient(conn *websocket.Conn, remoteAddr string, identity *authIdentity, nodes, categories map[string]struct{}, selector labelSelector, queueSize int) *wsClient {
 	if queueSize <= 0 {
 		queueSize = wsDefaultClientQueue
 	}
 	return &wsClient{
 		conn:       conn,
 		send:       make(chan []byte, queueSize),
+		done:       make(chan struct{}),
 		remoteAddr: remoteAddr,
+		identity:   identity,
 		nodes:      nodes,
 		categories: categories,
+		selector:   selector,
+	}
+}
+
+// trySend queues a message without blocking. It reports false if the queue
+// is full or the client is gone.
+func (c *wsClient) trySend(payload []byte) bool {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closed {
+		return false
+	}
+	select {
+	case c.send <- payload:
+		return true
+	default:
+		return false
+	}
+}
+
+// gone reports whether the hub has closed the client.
+func (c *wsClient) gone() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// close ends the client's send queue and connection. Only the hub calls it.
+func (c *wsClient) close() {
+	c.closeMu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+		close(c.send)
 	}
+	c.closeMu.Unlock()
+	_ = c.conn.Close()
 }
 
-func (c *wsClient) match(nodeID, category string) bool {
+func (c *wsClient) match(nodeID, category string, labels map[string]string) bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	if len(c.nodes) > 0 {
@@ -181,6 +266,9 @@ func (c *wsClient) match(nodeID, category string) bool {
 			return false
 		}
 	}
+	if c.selector != nil && !c.selector.Matches(labels) {
+		return false
+	}
 	if category != "" && len(c.categories) > 0 {
 		if _, ok := c.categories[category]; !ok {
 			return false
@@ -189,10 +277,11 @@ func (c *wsClient) match(nodeID, category string) bool {
 	return true
 }
 
-func (c *wsClient) setFilters(nodes, categories map[string]struct{}) {
+func (c *wsClient) setFilters(nodes, categories map[string]struct{}, selector labelSelector) {
 	c.mu.Lock()
 	c.nodes = nodes
 	c.categories = categories
+	c.selector = selector
 	c.mu.Unlock()
 }
 
@@ -268,9 +357,7 @@ func (s *Server) sendWSCommandResult(client *wsClient, result *api.CommandResult
 	if err != nil {
 		return
 	}
-	select {
-	case client.send <- payload:
-	default:
+	if !client.trySend(payload) && !client.gone() {
 		s.log.Warn().
 			Str("remote_addr", client.remoteAddr).
 			Str("command_id", result.CommandID).
@@ -279,6 +366,28 @@ func (s *Server) sendWSCommandResult(client *wsClient, result *api.CommandResult
 	}
 }
 
+func (s *Server) sendWSError(client *wsClient, err error) {
+	s.sendWSMessage(client, &pb.WSOutgoingMessage{
+		Type:  "error",
+		Error: err.Error(),
+	})
+}
+
+// sendWSMessage queues a message for one client, dropping it if the client
+// is too slow or gone.
+func (s *Server) sendWSMessage(client *wsClient, msg *pb.WSOutgoingMessage) {
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return
+	}
+	if !client.trySend(payload) && !client.gone() {
+		s.log.Warn().
+			Str("remote_addr", client.remoteAddr).
+			Str("type", msg.GetType()).
+			Msg("dropping websocket message for slow client")
+	}
+}
+
 func (s *Server) handleWSCommand(client *wsClient, req *pb.WSCommandRequest) {
 	if req == nil || req.GetCommand() == nil {
 		s.sendWSCommandResult(client, wsCommandErrorResult("", "", "", errInvalidCommandRequest))
@@ -314,7 +423,7 @@ func (s *Server) handleWSCommand(client *wsClient, req *pb.WSCommandRequest) {
 	}
 
 	go func() {
-		ctx := context.Background()
+		ctx := withCommandOrigin(context.Background(), client.commandOrigin())
 		var cancel context.CancelFunc
 		if s.cfg.CommandTimeout > 0 {
 			ctx, cancel = context.WithTimeout(ctx, s.cfg.CommandTimeout)
@@ -324,6 +433,12 @@ func (s *Server) handleWSCommand(client *wsClient, req *pb.WSCommandRequest) {
 		}
 
 		result, err := s.dispatchCommand(ctx, nodeID, cmd)
+		if errors.Is(err, errCommandHeld) || errors.Is(err, errCommandInFlight) {
+			if status, ok := s.commands.Get(cmd.ID); ok {
+				s.sendWSMessage(client, &pb.WSOutgoingMessage{Type: "command_status", CommandStatus: status})
+				return
+			}
+		}
 		if err != nil {
 			if result == nil {
 				result = wsCommandErrorResult(nodeID, cmd.ID, cmd.Type, err)
@@ -358,7 +473,12 @@ func (e *wsCommandError) Error() string {
 }
 
 func (s *Server) handleWSMetrics(w http.ResponseWriter, r *http.Request) {
-	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	selector, err := parseLabelSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	conn, err := s.wsUpgrader.Upgrade(w, r, nil)
 	if err != nil {
 		s.log.Warn().Err(err).Msg("websocket upgrade failed")
 		return
@@ -373,8 +493,10 @@ func (s *Server) handleWSMetrics(w http.ResponseWriter, r *http.Request) {
 	client := newWSClient(
 		conn,
 		r.RemoteAddr,
+		authIdentityFrom(r.Context()),
 		csvToSet(r.URL.Query().Get("nodes")),
 		csvToSet(r.URL.Query().Get("categories")),
+		selector,
 		queueSize,
 	)
 
@@ -391,13 +513,15 @@ func (s *Server) handleWSMetrics(w http.ResponseWriter, r *http.Request) {
 			ServerTimeUnixNano: time.Now().UnixNano(),
 			Nodes:              setToSortedSlice(client.nodes),
 			Categories:         setToSortedSlice(client.categories),
+			Selector:           selector.String(),
 		},
 	})
-	select {
-	case client.send <- welcome:
-	default:
-	}
+	client.trySend(welcome)
 	for _, snapshot := range s.store.ListNodeSnapshots() {
+		// The initial burst is filtered like the broadcasts that follow it.
+		if !client.match(snapshot.NodeID, "", s.store.NodeLabels(snapshot.NodeID)) {
+			continue
+		}
 		msg, err := proto.Marshal(&pb.WSOutgoingMessage{
 			Type: "node",
 			Node: toPBNodeSnapshot(snapshot),
@@ -405,11 +529,20 @@ func (s *Server) handleWSMetrics(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			continue
 		}
-		select {
-		case client.send <- msg:
-		default:
-			break
+		client.trySend(msg)
+	}
+	for _, alert := range s.alerts.Alerts(map[string]struct{}{alertStatePending: {}, alertStateFiring: {}}, "") {
+		if !client.match(alert.GetNodeId(), "", s.store.NodeLabels(alert.GetNodeId())) {
+			continue
+		}
+		msg, err := proto.Marshal(&pb.WSOutgoingMessage{
+			Type:  "alert",
+			Alert: alert,
+		})
+		if err != nil {
+			continue
 		}
+		client.trySend(msg)
 	}
 
 	go client.writePump()
@@ -418,11 +551,31 @@ func (s *Server) handleWSMetrics(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if strings.EqualFold(ctrl.GetOp(), "subscribe") {
-			client.setFilters(sliceToSet(ctrl.GetNodes()), sliceToSet(ctrl.GetCategories()))
+			selector, err := parseLabelSelector(ctrl.GetSelector())
+			if err != nil {
+				// Keep the previous filters rather than widen the
+				// subscription to everything.
+				s.sendWSError(client, err)
+				return
+			}
+			client.setFilters(sliceToSet(ctrl.GetNodes()), sliceToSet(ctrl.GetCategories()), selector)
 			return
 		}
 		if strings.EqualFold(ctrl.GetOp(), "command") {
+			if err := s.authorize(client.identity, roleOperator); err != nil {
+				req := ctrl.GetCommand()
+				s.sendWSCommandResult(client, wsCommandErrorResult(req.GetNodeId(), req.GetCommand().GetId(), api.CommandType(req.GetCommand().GetType()), err))
+				return
+			}
 			s.handleWSCommand(client, ctrl.GetCommand())
+			return
+		}
+		if strings.EqualFold(ctrl.GetOp(), "fanout") {
+			if err := s.authorize(client.identity, roleOperator); err != nil {
+				s.sendWSError(client, fmt.Errorf("fanout: %w", err))
+				return
+			}
+			s.handleWSFanout(client, ctrl.GetFanout())
 		}
 	}); err != nil && !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
 		s.log.Debug().Err(err).Str("remote_addr", r.RemoteAddr).Msg("ws client closed")
@@ -16,11 +16,13 @@ import {
   defaultChartRenderMaxPoints,
   defaultDashboardUpdateIntervalMs,
   defaultRichControlSliderGradientEnabled,
+  loadApiToken,
   loadChartRenderMaxPoints,
   loadDashboardUpdateIntervalMs,
   loadRichControlSliderGradientEnabled,
   normalizeChartRenderMaxPoints,
   normalizeDashboardUpdateIntervalMs,
+  saveApiToken,
   saveChartRenderMaxPoints,
   saveDashboardUpdateIntervalMs,
   saveRichControlSliderGradientEnabled,
@@ -62,6 +64,7 @@ export function SettingsModuleView({
   const [dashboardUpdateIntervalMsValue, setDashboardUpdateIntervalMsValue] = useState(
     String(defaultDashboardUpdateIntervalMs),
   );
+  const [apiTokenValue, setApiTokenValue] = useState("");
 
   useEffect(() => {
     setPerSeriesValue(String(historyLimits.perSeriesMaxPoints));
@@ -80,6 +83,7 @@ export function SettingsModuleView({
     setRichSliderGradientEnabled(loadRichControlSliderGradientEnabled());
     setChartRenderMaxPointsValue(String(loadChartRenderMaxPoints()));
     setDashboardUpdateIntervalMsValue(String(loadDashboardUpdateIntervalMs()));
+    setApiTokenValue(loadApiToken());
   }, []);
 
   return (
@@ -163,6 +167,16 @@ export function SettingsModuleView({
               onChange={(e) => setDashboardUpdateIntervalMsValue(e.target.value)}
             />
           </label>
+          <label className="space-y-1">
+            <div className="text-sm font-medium text-[var(--telemetry-text)]">API Token</div>
+            <Input
+              type="password"
+              autoComplete="off"
+              placeholder="Required when the server has auth enabled"
+              value={apiTokenValue}
+              onChange={(e) => setApiTokenValue(e.target.value)}
+            />
+          </label>
         </div>
 
         <div className="flex flex-wrap gap-2">
@@ -178,6 +192,7 @@ export function SettingsModuleView({
               saveRichControlSliderGradientEnabled(richSliderGradientEnabled);
               saveChartRenderMaxPoints(normalizeChartRenderMaxPoints(chartRenderMaxPointsValue));
               saveDashboardUpdateIntervalMs(normalizeDashboardUpdateIntervalMs(dashboardUpdateIntervalMsValue));
+              saveApiToken(apiTokenValue);
             }}
           >
             Save
@@ -3,6 +3,7 @@
 export const richControlSliderGradientEnabledStorageKey = "telemetry.rich-control-slider.gradient-enabled.v1";
 export const chartRenderMaxPointsStorageKey = "telemetry.chart.render-max-points.v1";
 export const dashboardUpdateIntervalMsStorageKey = "telemetry.dashboard.update-interval-ms.v1";
+export const apiTokenStorageKey = "telemetry.api-token.v1";
 export const defaultRichControlSliderGradientEnabled = true;
 export const defaultChartRenderMaxPoints = 5000;
 export const defaultDashboardUpdateIntervalMs = 20;
@@ -96,3 +97,27 @@ export function saveDashboardUpdateIntervalMs(intervalMs: number): void {
   }
   window.dispatchEvent(new CustomEvent(uiSettingsChangedEventName));
 }
+
+export function loadApiToken(): string {
+  if (typeof window === "undefined") return "";
+  try {
+    return window.localStorage.getItem(apiTokenStorageKey)?.trim() ?? "";
+  } catch {
+    return "";
+  }
+}
+
+export function saveApiToken(token: string): void {
+  if (typeof window === "undefined") return;
+  try {
+    const normalized = token.trim();
+    if (normalized) {
+      window.localStorage.setItem(apiTokenStorageKey, normalized);
+    } else {
+      window.localStorage.removeItem(apiTokenStorageKey);
+    }
+  } catch {
+    // ignore localStorage errors
+  }
+  window.dispatchEvent(new CustomEvent(uiSettingsChangedEventName));
+}
@@ -17,6 +17,7 @@ import {
 } from "./metric-history";
 import { markStaleNodes } from "./node-store";
 import {
+  loadApiToken,
   loadDashboardUpdateIntervalMs,
   uiSettingsChangedEventName,
 } from "./ui-settings";
@@ -340,13 +341,18 @@ export function useTelemetryWS() {
 
   useEffect(() => {
     const wsProtocol = window.location.protocol === "https:" ? "wss" : "ws";
-    const wsURL = `${wsProtocol}://${window.location.host}/api/ws/metrics`;
+    const wsBaseURL = `${wsProtocol}://${window.location.host}/api/ws/metrics`;
 
     let socket: WebSocket | null = null;
+    let socketToken = "";
     let retryTimer: number | null = null;
     let closedByClient = false;
 
     const connect = () => {
+      // Browsers cannot set headers on websockets, so the API token goes in
+      // the query string.
+      socketToken = loadApiToken();
+      const wsURL = socketToken ? `${wsBaseURL}?access_token=${encodeURIComponent(socketToken)}` : wsBaseURL;
       socket = new WebSocket(wsURL);
       socket.binaryType = "arraybuffer";
       socketRef.current = socket;
@@ -401,9 +407,18 @@ export function useTelemetryWS() {
       };
     };
 
+    // Reconnect with a changed token; onclose schedules the retry.
+    const syncToken = () => {
+      if (loadApiToken() !== socketToken) {
+        socket?.close();
+      }
+    };
+    window.addEventListener(uiSettingsChangedEventName, syncToken);
+
     connect();
 
     return () => {
+      window.removeEventListener(uiSettingsChangedEventName, syncToken);
       closedByClient = true;
       if (retryTimer !== null) {
         window.clearTimeout(retryTimer);